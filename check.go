@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+	"github.com/andreistefanzx/cert-watcher/pkg/watcher"
+)
+
+// newCheckCommand returns the check command, which validates the
+// certificates of the watched secrets once, the way -validate-certificates
+// does before a restart, and exits non-zero if any of them fails, for CI
+// pipelines and CronJobs.
+func newCheckCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "Check the certificates of the watched secrets once",
+		Args:  cobra.NoArgs,
+	}
+	flags := cmd.Flags()
+	secretName := flags.String("secret-name", "", "Name of the secrets to check; a glob such as '*-tls', or a regular expression between slashes")
+	secretSelector := flags.String("secret-selector", "", "Label selector of the secrets to check instead of -secret-name")
+	configFile := flags.String("config", "", "Check the secrets of the mappings in this config file instead of -secret-name")
+	namespace := flags.String("namespace", "default", "Namespace of the secrets, and of mappings that do not set one")
+	expiryThreshold := flags.Duration("expiry-threshold", 0, "Also fail certificates that expire within this duration")
+	verifyChain := flags.Bool("verify-chain", false, "Also require tls.crt to chain to ca.crt when present")
+	insideCluster := flags.Bool("inside-cluster", false, "Run from inside the cluster")
+	kubeconfig := flags.String("kubeconfig", "", "Path to a kubeconfig file; defaults to $KUBECONFIG or $HOME/.kube/config")
+	kubeContext := flags.String("context", "", "Kubeconfig context to use; defaults to the current context")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		var mappings []watcher.Mapping
+		switch {
+		case *configFile != "":
+			config, err := watcher.LoadConfig(*configFile, watcher.Mapping{Namespace: *namespace, Kind: restarter.KindDeployment})
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			mappings = config.Mappings
+		case watcher.CountSet(*secretName, *secretSelector) == 1:
+			mappings = []watcher.Mapping{{Namespace: *namespace, Secret: *secretName, SecretSelector: *secretSelector}}
+		default:
+			fmt.Println("one of -secret-name, -secret-selector or -config is required")
+			os.Exit(1)
+		}
+
+		clientset, err := newClientset(*insideCluster, *kubeconfig, *kubeContext)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		secrets, err := checkedSecrets(context.Background(), clientset, mappings)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if len(secrets) == 0 {
+			fmt.Println("no secrets matched")
+			os.Exit(1)
+		}
+
+		failed := 0
+		for _, secret := range secrets {
+			if err := checkCertificate(secret, *verifyChain, *expiryThreshold); err != nil {
+				failed++
+				fmt.Printf("FAIL %s/%s: %v\n", secret.Namespace, secret.Name, err)
+				continue
+			}
+			cert, _ := watcher.ParseCertificate(secret.Data[corev1.TLSCertKey])
+			fmt.Printf("OK   %s/%s: expires in %s\n", secret.Namespace, secret.Name, time.Until(cert.NotAfter).Round(time.Minute))
+		}
+		if failed > 0 {
+			fmt.Printf("%d of %d certificates failed\n", failed, len(secrets))
+			os.Exit(1)
+		}
+	}
+	return cmd
+}
+
+// checkedSecrets returns the secrets the secret mappings watch, sorted by
+// namespace and name. Mappings of other sources are ignored.
+func checkedSecrets(ctx context.Context, clientset kubernetes.Interface, mappings []watcher.Mapping) ([]*corev1.Secret, error) {
+	seen := map[string]bool{}
+	var secrets []*corev1.Secret
+	for _, m := range mappings {
+		if m.Secret == "" && m.SecretSelector == "" {
+			continue
+		}
+		list, err := clientset.CoreV1().Secrets(m.Namespace).List(ctx, metav1.ListOptions{LabelSelector: m.SecretSelector})
+		if err != nil {
+			return nil, fmt.Errorf("listing secrets in %s: %w", m.Namespace, err)
+		}
+		for i := range list.Items {
+			secret := &list.Items[i]
+			key := secret.Namespace + "/" + secret.Name
+			if !m.MatchesSecret(secret) || seen[key] {
+				continue
+			}
+			seen[key] = true
+			secrets = append(secrets, secret)
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		if secrets[i].Namespace != secrets[j].Namespace {
+			return secrets[i].Namespace < secrets[j].Namespace
+		}
+		return secrets[i].Name < secrets[j].Name
+	})
+	return secrets, nil
+}
+
+// checkCertificate validates secret as watcher.ValidateCertificate does,
+// and with a threshold, also fails a certificate that expires within it.
+func checkCertificate(secret *corev1.Secret, verifyChain bool, threshold time.Duration) error {
+	if err := watcher.ValidateCertificate(secret, verifyChain); err != nil {
+		return err
+	}
+	cert, err := watcher.ParseCertificate(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return err
+	}
+	if remaining := time.Until(cert.NotAfter); remaining < threshold {
+		return fmt.Errorf("certificate expires in %s at %s", remaining.Round(time.Minute), cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
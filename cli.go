@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/kubernetes"
+)
+
+func main() {
+	root := newRootCommand()
+	root.SetArgs(cliArgs(os.Args[1:]))
+	if err := root.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func newRootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "cert-watcher",
+		Short: "Restart workloads when the certificates and secrets they use change",
+		Long: `cert-watcher restarts workloads when the certificates and secrets they use
+change. Running it with flags but no command runs watch.`,
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return flagsFromEnv(cmd.Flags())
+		},
+	}
+	root.AddCommand(
+		newWatchCommand(),
+		newCheckCommand(),
+		newTriggerCommand(),
+		newReportCommand(),
+		newValidateCommand(),
+		newHistoryCommand(),
+		newVersionCommand(),
+	)
+	return root
+}
+
+// cliArgs rewrites single-dash long flags such as -secret-name=x, which the
+// watcher took before it had commands, into the --secret-name=x form, and
+// runs watch when the arguments start with a flag.
+func cliArgs(args []string) []string {
+	out := make([]string, 0, len(args)+1)
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-h", "-help", "--help":
+		default:
+			out = append(out, "watch")
+		}
+	}
+	for i, arg := range args {
+		if arg == "--" {
+			return append(out, args[i:]...)
+		}
+		if len(arg) > 2 && arg[0] == '-' && arg[1] != '-' {
+			arg = "-" + arg
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// envPrefix starts the environment variable of every flag; see envName.
+const envPrefix = "CERT_WATCHER_"
+
+// envName returns the environment variable that sets the flag name, e.g.
+// CERT_WATCHER_SECRET_NAME for -secret-name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// flagsFromEnv sets every flag that was not given on the command line from
+// its environment variable, if set, so that flags take precedence.
+func flagsFromEnv(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || f.Name == "help" {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q of $%s: %w", value, envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// newClientset connects to the cluster the way buildConfig describes.
+func newClientset(insideCluster bool, kubeconfig, kubeContext string) (*kubernetes.Clientset, error) {
+	config, err := buildConfig(insideCluster, kubeconfig, kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
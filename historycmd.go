@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+	"github.com/andreistefanzx/cert-watcher/pkg/watcher"
+)
+
+// newHistoryCommand returns the history command, which prints the restart
+// history from the admin API of a running watcher, or from the ConfigMap or
+// file it persists the history to. With -follow, it keeps printing new
+// records from the admin API's event stream.
+func newHistoryCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "Print the restart history of a watcher",
+		Args:  cobra.NoArgs,
+	}
+	flags := cmd.Flags()
+	adminURL := flags.String("admin-url", "", "URL of a watcher's admin API to query, e.g. http://localhost:8081; reads the persisted history when empty")
+	tokenFile := flags.String("token-file", "", "File holding the bearer token for -admin-url")
+	historyConfigMap := flags.String("history-configmap", "", "ConfigMap in -namespace the watcher persists its history to")
+	historyFile := flags.String("history-file", "", "File the watcher persists its history to")
+	namespace := flags.String("namespace", "default", "Namespace of -history-configmap")
+	insideCluster := flags.Bool("inside-cluster", false, "Run from inside the cluster")
+	kubeconfig := flags.String("kubeconfig", "", "Path to a kubeconfig file; defaults to $KUBECONFIG or $HOME/.kube/config")
+	kubeContext := flags.String("context", "", "Kubeconfig context to use; defaults to the current context")
+	targetNamespace := flags.String("target-namespace", "", "Only show records of this namespace")
+	kind := flags.String("kind", "", "Only show records of targets of this kind")
+	name := flags.String("name", "", "Only show records of targets with this name")
+	source := flags.String("source", "", "Only show records of this source")
+	event := flags.String("event", "", "Only show records of this event; one of: Detected, Scheduled, Succeeded, Failed")
+	since := flags.String("since", "", "Only show records newer than this duration or RFC 3339 time")
+	limit := flags.Int("limit", 0, "Only show this many of the latest matching records; 0 shows all")
+	output := flags.String("output", "table", "Output format; one of: table, json")
+	follow := flags.Bool("follow", false, "Keep printing new records as they happen; needs -admin-url and prints JSON lines with -output=json")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		query := url.Values{}
+		for param, value := range map[string]string{"namespace": *targetNamespace, "kind": *kind, "name": *name, "source": *source, "event": *event, "since": *since} {
+			if value != "" {
+				query.Set(param, value)
+			}
+		}
+		if *limit > 0 {
+			query.Set("limit", fmt.Sprint(*limit))
+		}
+
+		if *output != "table" && *output != "json" {
+			fmt.Printf("unknown output format %q\n", *output)
+			os.Exit(1)
+		}
+		if *follow {
+			if *adminURL == "" {
+				fmt.Println("-follow needs -admin-url")
+				os.Exit(1)
+			}
+			if err := followHistory(*adminURL, *tokenFile, query, *output); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		var records []watcher.HistoryRecord
+		var err error
+		switch {
+		case *adminURL != "":
+			records, err = fetchHistory(*adminURL, *tokenFile, query)
+		case *historyConfigMap != "" || *historyFile != "":
+			records, err = readHistory(*historyConfigMap, *historyFile, *namespace, *insideCluster, *kubeconfig, *kubeContext, query)
+		default:
+			err = fmt.Errorf("one of -admin-url, -history-configmap or -history-file is required")
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if *output == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			_ = encoder.Encode(records)
+			return
+		}
+		tw := newHistoryTable()
+		for _, r := range records {
+			printHistoryRecord(tw, r)
+		}
+		_ = tw.Flush()
+	}
+	return cmd
+}
+
+// adminRequest builds a request for path on the admin API at adminURL, with
+// the bearer token in tokenFile.
+func adminRequest(method, adminURL, tokenFile, path string, query url.Values) (*http.Request, error) {
+	token, err := watcher.ReadPassword(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(adminURL, "/")+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// fetchHistory queries the history endpoint of the admin API at adminURL.
+func fetchHistory(adminURL, tokenFile string, query url.Values) ([]watcher.HistoryRecord, error) {
+	req, err := adminRequest(http.MethodGet, adminURL, tokenFile, "/api/v1/history", query)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := notify.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin API returned %s", resp.Status)
+	}
+	var records []watcher.HistoryRecord
+	return records, json.NewDecoder(resp.Body).Decode(&records)
+}
+
+// followHistory prints the records of the events endpoint of the admin API
+// at adminURL until the watcher closes the stream.
+func followHistory(adminURL, tokenFile string, query url.Values, output string) error {
+	req, err := adminRequest(http.MethodGet, adminURL, tokenFile, "/api/v1/events", query)
+	if err != nil {
+		return err
+	}
+	// No timeout, as the stream stays open.
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API returned %s", resp.Status)
+	}
+
+	tw := newHistoryTable()
+	_ = tw.Flush()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if output == "json" {
+			fmt.Println(data)
+			continue
+		}
+		var r watcher.HistoryRecord
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return err
+		}
+		printHistoryRecord(tw, r)
+		_ = tw.Flush()
+	}
+	return scanner.Err()
+}
+
+// readHistory loads the persisted history and filters it by query.
+func readHistory(configMap, file, namespace string, insideCluster bool, kubeconfig, kubeContext string, query url.Values) ([]watcher.HistoryRecord, error) {
+	filter, err := watcher.ParseHistoryFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	var store watcher.DocumentStore = &watcher.FileStore{Path: file}
+	if configMap != "" {
+		clientset, err := newClientset(insideCluster, kubeconfig, kubeContext)
+		if err != nil {
+			return nil, err
+		}
+		store = &watcher.StateStore{Clientset: clientset, Namespace: namespace, Name: configMap}
+	}
+	var records []watcher.HistoryRecord
+	if err := store.Load(context.Background(), watcher.StateHistory, &records); err != nil {
+		return nil, err
+	}
+	return filter.Apply(records), nil
+}
+
+// newHistoryTable returns a table of history records with its header
+// written.
+func newHistoryTable() *tabwriter.Writer {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tNAMESPACE\tTARGET\tSOURCE\tDETAILS")
+	return tw
+}
+
+func printHistoryRecord(tw *tabwriter.Writer, r watcher.HistoryRecord) {
+	target := "-"
+	if r.Kind != "" {
+		target = r.Kind + "/" + r.Name
+	}
+	var details []string
+	if r.Due != nil {
+		details = append(details, "due "+r.Due.Local().Format(time.RFC3339))
+	}
+	if r.Rollout != "" {
+		details = append(details, "rollout "+strings.ToLower(r.Rollout))
+	}
+	if r.Error != "" {
+		details = append(details, r.Error)
+	}
+	fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Local().Format(time.RFC3339), r.Event, r.Namespace, target, r.SourceKind+"/"+r.Source, strings.Join(details, "; "))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// runWithLeaderElection blocks while competing for the named Lease and calls
+// Run once this replica becomes the leader. Losing the lease exits the
+// process so a restarted replica starts again as a follower; cancelling ctx
+// releases the lease instead.
+func runWithLeaderElection(ctx context.Context, clientset kubernetes.Interface, namespace, name string, run func()) {
+	identity, err := os.Hostname()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				fmt.Printf("Acquired lease %s/%s as %s\n", namespace, name, identity)
+				run()
+			},
+			OnStoppedLeading: func() {
+				if ctx.Err() != nil {
+					fmt.Printf("Released lease %s/%s\n", namespace, name)
+					return
+				}
+				fmt.Printf("Lost lease %s/%s, exiting\n", namespace, name)
+				os.Exit(1)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					fmt.Printf("Current leader is %s\n", leader)
+				}
+			},
+		},
+	})
+}
@@ -2,133 +2,924 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/informers"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/retry"
 
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/cobra"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+	"github.com/andreistefanzx/cert-watcher/pkg/watcher"
 )
 
 const (
 	defaultDelay = 2 * time.Minute
 )
 
-var (
-	restartCounter = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "deployment_rollouts_total",
-			Help: "Total number of deployment rollouts",
-		},
-		[]string{"namespace", "secret", "deployment", "restarted"},
-	)
-)
+// newWatchCommand returns the watch command, which watches the configured
+// sources and restarts their targets until it is stopped.
+func newWatchCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Watch secrets and other sources and restart the workloads that use them",
+		Args:  cobra.NoArgs,
+	}
+	flags := cmd.Flags()
+	secretName := flags.String("secret-name", "", "Name of the secret to watch; a glob such as '*-tls', or a regular expression between slashes")
+	secretSelector := flags.String("secret-selector", "", "Label selector of the secrets to watch instead of -secret-name, e.g. cert-watcher.io/watch=true")
+	configMapName := flags.String("configmap-name", "", "Name of the ConfigMap to watch instead of a secret; accepts the same patterns as -secret-name")
+	deploymentName := flags.String("deployment-name", "", "Name of the deployment to restart")
+	workloadKind := flags.String("workload-kind", restarter.KindDeployment, "Kind of the workload named by -deployment-name; one of: Deployment, StatefulSet, DaemonSet, Rollout, DeploymentConfig")
+	namespace := flags.String("namespace", "default", "Namespace of the secret and deployment")
+	insideCluster := flags.Bool("inside-cluster", false, "Run from inside the cluster")
+	kubeconfig := flags.String("kubeconfig", "", "Path to a kubeconfig file; defaults to $KUBECONFIG or $HOME/.kube/config")
+	kubeContext := flags.String("context", "", "Kubeconfig context to use; defaults to the current context")
+	targetKubeconfig := flags.String("target-kubeconfig", "", "Kubeconfig of the cluster whose workloads are restarted, when it differs from the watched one")
+	targetContext := flags.String("target-context", "", "Kubeconfig context of the cluster whose workloads are restarted")
+	kubeAPIQPS := flags.Float32("kube-api-qps", rest.DefaultQPS, "Sustained rate of Kubernetes API requests per second, per cluster")
+	kubeAPIBurst := flags.Int("kube-api-burst", rest.DefaultBurst, "Kubernetes API requests allowed in a burst above -kube-api-qps, per cluster")
+	kubeAPIProtobuf := flags.Bool("kube-api-protobuf", false, "Talk to the Kubernetes API in protobuf rather than JSON for built-in resources")
+	requestTimeout := flags.Duration("request-timeout", 30*time.Second, "How long a Kubernetes API request, other than a watch, may take before it fails; 0 means no limit")
+	delay := flags.Duration("delay", defaultDelay, "Delay before restarting the deployment")
+	keys := flags.String("keys", "", "Comma-separated secret data keys whose changes trigger a restart; defaults to all keys")
+	restartStrategy := flags.String("restart-strategy", restarter.StrategyAnnotation, "How workloads are restarted unless a mapping says otherwise; one of: annotation, delete-pods, evict-pods, scale, checksum, delete-mounting-pods")
+	restartAnnotation := flags.String("restart-annotation", restarter.RestartedAtAnnotation, "Pod template annotation written by the annotation strategy")
+	restartAnnotationValue := flags.String("restart-annotation-value", restarter.DefaultAnnotationValue, "Go template of the value of -restart-annotation; may use {{.Secret}}, {{.Hash}} and {{.Timestamp}}")
+	restartPolicy := flags.String("restart-policy", "", "CEL expression that must be true for a change to restart a workload, e.g. \"hour >= 2 && hour < 5\"; defaults to always restarting")
+	opaURL := flags.String("opa-url", "", "OPA decision URL, e.g. http://opa:8181/v1/data/certwatcher/allow, that must allow every restart caused by a secret or ConfigMap; disabled when empty")
+	opaTokenFile := flags.String("opa-token-file", "", "File holding a bearer token for -opa-url")
+	opaFailOpen := flags.Bool("opa-fail-open", false, "Restart when -opa-url cannot be queried instead of holding the restart back")
+	restartWindows := flags.String("restart-windows", "", "Comma-separated local times restarts may run in, e.g. \"Mon-Fri 02:00-04:00,Sat-Sun 00:00-24:00\"; defaults to any time")
+	watchFiles := flags.String("watch-files", "", "Comma-separated certificate files or directories to watch on disk instead of a secret")
+	signalName := flags.String("signal", "", "With -watch-files, send this signal (e.g. SIGHUP) to -signal-process instead of restarting a workload")
+	signalProcess := flags.String("signal-process", "", "Name of the co-located process that receives -signal; requires shareProcessNamespace")
+	vaultPath := flags.String("vault-path", "", "Vault API path to poll instead of a secret, e.g. secret/data/api-tls or pki/cert/<serial>")
+	vaultAddress := flags.String("vault-address", os.Getenv("VAULT_ADDR"), "Address of the Vault server; defaults to $VAULT_ADDR")
+	vaultTokenFile := flags.String("vault-token-file", "", "File holding the Vault token, such as a Vault Agent sink; defaults to $VAULT_TOKEN")
+	awsSecret := flags.String("aws-secret", "", "Name or ARN of an AWS Secrets Manager secret to poll for rotations instead of a secret")
+	acmCertificate := flags.String("acm-certificate", "", "ARN of an ACM certificate to poll for renewals instead of a secret")
+	pollInterval := flags.Duration("poll-interval", time.Minute, "How often sources outside Kubernetes, such as Vault and AWS, are polled")
+	configPath := flags.String("config", "", "Path to a YAML file describing secret to deployment mappings")
+	reloadConfig := flags.Bool("reload-config", false, "Watch -config, such as a mounted ConfigMap, and apply changed mappings without restarting")
+	discoverKnative := flags.Bool("discover-knative", false, "Also discover Knative Services referencing a changed secret; requires -discovery")
+	discovery := flags.String("discovery", "", "Discover deployments to restart in -namespace, or everywhere with -all-namespaces; one of: annotation, podspec")
+	metadataOnly := flags.Bool("metadata-only", false, "Cache only the metadata of secrets and fetch the data of watched ones when they change, to save memory")
+	onCreate := flags.String("on-create", watcher.CreateActionIgnore, "What a watched secret created while the watcher runs does; one of: ignore, restart")
+	onDelete := flags.String("on-delete", "", "Comma-separated actions on the workloads of a deleted secret; any of: event, notify, scale-down; defaults to only logging")
+	resyncPeriod := flags.Duration("resync-period", 10*time.Minute, "How often informers resync their caches; resyncs never trigger restarts, and 0 disables them")
+	allNamespaces := flags.Bool("all-namespaces", false, "Watch secrets in every namespace with cluster-wide informers")
+	includeNamespaces := flags.String("include-namespaces", "", "Comma-separated namespaces to act on; defaults to all")
+	excludeNamespaces := flags.String("exclude-namespaces", "", "Comma-separated namespaces to ignore")
+	expiryThreshold := flags.Duration("expiry-threshold", 0, "Alert when a watched certificate expires within this duration; 0 disables the check")
+	expiryInterval := flags.Duration("expiry-check-interval", time.Hour, "How often to check watched certificates against -expiry-threshold")
+	expiryActions := flags.String("expiry-actions", "metric,event", "Comma-separated expiry alert actions; any of: metric, event, webhook, incident, renew")
+	probeInterval := flags.Duration("probe-interval", 0, "Check the certificate served at the probe of every mapping this often; 0 only probes after restarts")
+	probeAction := flags.String("probe-mismatch-action", watcher.EndpointActionAlert, "What to do when a probe serves a certificate other than the one in its secret; one of: alert, restart")
+	driftInterval := flags.Duration("drift-check-interval", 0, "Count the pods of every target that started before their secret last changed this often; 0 disables the check")
+	driftRemediate := flags.Bool("drift-remediate", false, "Evict the stale pods found by -drift-check-interval, unless their workload is being restarted")
+	expiryWebhookURL := flags.String("expiry-webhook-url", "", "URL that receives a JSON POST for the webhook expiry action")
+	validateCerts := flags.Bool("validate-certificates", false, "Only restart when the new tls.crt is currently valid and matches tls.key")
+	verifyChain := flags.Bool("verify-chain", false, "With -validate-certificates, also require tls.crt to chain to ca.crt when present")
+	changeDetection := flags.String("change-detection", watcher.ChangeDetectionData, "What makes a secret change a renewal; one of: data, serial, fingerprint")
+	slackWebhookURL := flags.String("slack-webhook-url", "", "Slack incoming webhook that is told about every restart")
+	notifyWebhookURL := flags.String("notify-webhook-url", "", "URL that receives a JSON POST describing every restart")
+	teamsWebhookURL := flags.String("teams-webhook-url", "", "Microsoft Teams incoming webhook or Workflows URL that receives a card for every restart")
+	notificationTemplateFile := flags.String("notification-template-file", "", "File of Go templates named webhook, slack, teams, discord, email-subject or email-body that replace the payloads of those notifications")
+	smtpAddress := flags.String("smtp-address", "", "host:port of an SMTP server to email restart notifications through; disabled when empty")
+	smtpUsername := flags.String("smtp-username", "", "User to authenticate to the SMTP server as")
+	smtpPasswordFile := flags.String("smtp-password-file", "", "File holding the password of -smtp-username")
+	smtpTLS := flags.String("smtp-tls", notify.SMTPTLSStartTLS, "How to secure the SMTP connection; one of: starttls, tls, none")
+	emailFrom := flags.String("email-from", "", "Sender address of notification emails")
+	emailTo := flags.String("email-to", "", "Comma-separated recipients of notification emails")
+	emailDigestInterval := flags.Duration("email-digest-interval", 0, "Send one email listing the restarts of each interval instead of one per restart; 0 sends one per restart")
+	discordWebhookURL := flags.String("discord-webhook-url", "", "Discord webhook that receives an embed for every restart")
+	notifierSpecs := flags.StringArray("notifier", nil, "Notification sink of the form name=spec, e.g. exec=/usr/local/bin/page or http=PUT https://example.com/restarts; repeatable. Sinks: "+strings.Join(notify.Registered(), ", ")+" and those of -notifier-plugin")
+	notifierPlugins := flags.String("notifier-plugin", "", "Comma-separated paths of Go plugins that register further -notifier sinks")
+	pagerDutyRoutingKeyFile := flags.String("pagerduty-routing-key-file", "", "File holding a PagerDuty Events API v2 routing key to open incidents with")
+	opsgenieAPIKeyFile := flags.String("opsgenie-api-key-file", "", "File holding an Opsgenie API key to open alerts with")
+	opsgenieAPIURL := flags.String("opsgenie-api-url", watcher.DefaultOpsgenieURL, "Opsgenie API URL; https://api.eu.opsgenie.com for the EU instance")
+	incidentFailureThreshold := flags.Int("incident-failure-threshold", 3, "Consecutive failed restarts of a workload that open an incident")
+	cloudEventsSink := flags.String("cloudevents-sink", "", "http(s) URL, kafka://broker/topic or nats://server/subject that receives a CloudEvent for every detected rotation, scheduled restart and restart outcome; disabled when empty")
+	cloudEventsSource := flags.String("cloudevents-source", "/cert-watcher", "source attribute of the emitted CloudEvents")
+	eventBusUsername := flags.String("event-bus-username", "", "User to authenticate to a kafka:// or nats:// -cloudevents-sink as; SASL on Kafka")
+	eventBusPasswordFile := flags.String("event-bus-password-file", "", "File holding the password of -event-bus-username, or a NATS token when no username is set")
+	eventBusSASLMechanism := flags.String("event-bus-sasl-mechanism", watcher.SASLPlain, "SASL mechanism for Kafka; one of: plain, scram-sha-256, scram-sha-512")
+	eventBusCredentialsFile := flags.String("event-bus-credentials-file", "", "NATS .creds file to authenticate with instead of a username")
+	eventBusTLS := flags.Bool("event-bus-tls", false, "Connect to the Kafka brokers or NATS servers over TLS")
+	eventBusDelivery := flags.String("event-bus-delivery", watcher.DeliveryAtLeastOnce, "Delivery guarantee of CloudEvents; one of: at-most-once, at-least-once")
+	delayJitter := flags.Duration("delay-jitter", 0, "Add a random duration up to this long to each restart delay, spreading out the restarts caused by one change")
+	minRestartInterval := flags.Duration("min-restart-interval", 0, "Minimum time between two restarts of the same workload; later changes wait and are coalesced")
+	retryInitialBackoff := flags.Duration("retry-initial-backoff", watcher.DefaultRetryPolicy.InitialBackoff, "How long to wait before retrying a failed restart the first time")
+	retryMaxBackoff := flags.Duration("retry-max-backoff", watcher.DefaultRetryPolicy.MaxBackoff, "Longest wait between two attempts of a failed restart")
+	retryBackoffFactor := flags.Float64("retry-backoff-factor", watcher.DefaultRetryPolicy.Factor, "Factor the wait grows by after every failed attempt of a restart")
+	retryMaxAttempts := flags.Int("retry-max-attempts", watcher.DefaultRetryPolicy.MaxAttempts, "Attempts of a restart, counting the first, before it is parked as a dead letter")
+	restartAttemptTimeout := flags.Duration("restart-attempt-timeout", 0, "How long the API calls of one restart attempt may take, not counting hooks and rollouts; 0 means no limit")
+	rolloutTimeout := flags.Duration("rollout-timeout", 10*time.Minute, "How long to follow a rollout after a restart before reporting it failed; 0 reports success once the restart is accepted")
+	rolloutFailureAction := flags.String("rollout-failure-action", "", "What to do with a Deployment whose rollout fails after a restart; one of: pause, rollback; defaults to only alerting")
+	maxConcurrentRestarts := flags.Int("max-concurrent-restarts", 0, "Maximum number of restarts, including the rollouts they wait for, in progress at once; 0 means no limit beyond -restart-workers")
+	restartWorkers := flags.Int("restart-workers", 4, "Number of workloads restarted in parallel")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 30*time.Second, "How long to wait for pending restarts and HTTP requests on SIGTERM")
+	metricsAddress := flags.String("metrics-address", ":8080", "Address to serve /metrics on, e.g. 10.0.0.5:8080 or [::1]:8080")
+	healthAddress := flags.String("health-address", "", "Address to serve /healthz and /readyz on, without TLS or authentication; defaults to -metrics-address")
+	metricsTLSCert := flags.String("metrics-tls-cert", "", "Certificate file to serve /metrics over TLS")
+	metricsTLSKey := flags.String("metrics-tls-key", "", "Private key file for -metrics-tls-cert")
+	metricsClientCA := flags.String("metrics-client-ca", "", "CA file that metrics clients must present a certificate from; requires -metrics-tls-cert")
+	metricsTokenAuth := flags.Bool("metrics-token-auth", false, "Require a bearer token on /metrics, verified with a Kubernetes TokenReview and SubjectAccessReview")
+	otlpEndpoint := flags.String("otlp-endpoint", "", "host:port of an OTLP/HTTP collector to export restart traces to; disabled when empty")
+	otlpInsecure := flags.Bool("otlp-insecure", false, "Export traces over plain HTTP instead of HTTPS")
+	receiverAddress := flags.String("receiver-address", "", "Address to accept rotation notifications on, e.g. :8082; disabled when empty")
+	receiverTokenFile := flags.String("receiver-token-file", "", "File holding the bearer token that rotation notifications must carry; required with -receiver-address")
+	adminAddress := flags.String("admin-address", "", "Address to serve the admin API on, e.g. :8081; requests need a bearer token whose user RBAC allows to use the endpoint; disabled when empty")
+	uiAddress := flags.String("ui-address", "", "Address to serve the read-only web UI on, e.g. localhost:8083; it has no authentication of its own; disabled when empty")
+	pprofAddress := flags.String("pprof-address", "", "Address to serve net/http/pprof on, e.g. localhost:6060; disabled when empty")
+	leaderElect := flags.Bool("leader-elect", false, "Only restart workloads while holding a coordination.k8s.io Lease, so several replicas can run")
+	leaderElectionNamespace := flags.String("leader-election-namespace", "", "Namespace of the leader election Lease; defaults to -namespace")
+	leaderElectionID := flags.String("leader-election-id", "cert-watcher", "Name of the leader election Lease")
+	certManager := flags.Bool("cert-manager", false, "Restart once per cert-manager Certificate issuance instead of on every change to its secret")
+	once := flags.Bool("once", false, "Restart the targets of sources that changed since the previous run and exit, for running as a CronJob")
+	pushgatewayURL := flags.String("pushgateway-url", "", "Pushgateway to push the metrics of a -once run to before exiting, e.g. http://pushgateway:9091")
+	remoteWriteURL := flags.String("remote-write-url", "", "Prometheus remote-write endpoint to send the metrics of a -once run to before exiting, e.g. http://prometheus:9090/api/v1/write")
+	remoteWriteTokenFile := flags.String("remote-write-token-file", "", "File holding a bearer token for -remote-write-url")
+	metricsJob := flags.String("metrics-job", "cert-watcher", "job label of the metrics pushed by -pushgateway-url and -remote-write-url")
+	stateConfigMap := flags.String("state-configmap", "cert-watcher-state", "ConfigMap in -namespace that holds the state kept by -once and -persist-state")
+	persistState := flags.Bool("persist-state", false, "Keep pending restarts and the hashes of watched sources in -state-configmap, so a rescheduled watcher resumes them and catches up on changes it missed")
+	auditLogPath := flags.String("audit-log", "", "File to append a JSON line to for every change received, restart skipped, scheduled, deferred, executed or failed; - for stdout; disabled when empty")
+	historySize := flags.Int("history-size", 1000, "Number of rotation and restart records kept for the admin API's history; 0 disables the history")
+	pauseConfigMap := flags.String("pause-configmap", "", "ConfigMap in -namespace whose "+watcher.PausedAnnotation+"=true annotation pauses every restart; disabled when empty")
+	historyConfigMap := flags.String("history-configmap", "", "ConfigMap in -namespace to persist the restart history to")
+	historyFile := flags.String("history-file", "", "File to persist the restart history to, such as one on a persistent volume")
+	catchUp := flags.Bool("catch-up", false, "Record the hash of each secret on the workloads it restarts, and on startup restart those whose secret changed while the watcher was down")
+	operator := flags.Bool("operator", false, "Also restart workloads declared by CertWatch resources in any namespace")
 
-func init() {
-	prometheus.MustRegister(restartCounter)
-}
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *reloadConfig && (*configPath == "" || *once) {
+			fmt.Println("reload-config requires config and cannot be combined with once")
+			os.Exit(1)
+		}
+		if (*pushgatewayURL != "" || *remoteWriteURL != "") && !*once {
+			fmt.Println("pushgateway-url and remote-write-url require once")
+			os.Exit(1)
+		}
+		if *remoteWriteTokenFile != "" && *remoteWriteURL == "" {
+			fmt.Println("remote-write-token-file requires remote-write-url")
+			os.Exit(1)
+		}
 
-func main() {
-	secretName := flag.String("secret-name", "", "Name of the secret to watch")
-	deploymentName := flag.String("deployment-name", "", "Name of the deployment to restart")
-	namespace := flag.String("namespace", "default", "Namespace of the secret and deployment")
-	insideCluster := flag.Bool("inside-cluster", false, "Run from inside the cluster")
-	delay := flag.Duration("delay", defaultDelay, "Delay before restarting the deployment")
+		if *discovery != "" && !watcher.ValidDiscovery(*discovery) {
+			fmt.Printf("unknown discovery mode %q\n", *discovery)
+			os.Exit(1)
+		}
 
-	flag.Parse()
+		multiCluster := *targetKubeconfig != "" || *targetContext != ""
+		if *discoverKnative && *discovery == "" {
+			fmt.Println("discover-knative requires discovery")
+			os.Exit(1)
+		}
 
-	if *secretName == "" || *deploymentName == "" {
-		fmt.Println("secret-name and deployment-name are required")
-		flag.Usage()
-		os.Exit(1)
-	}
+		if multiCluster && *discovery != "" {
+			fmt.Println("discovery looks for workloads in the watched cluster and cannot be combined with -target-kubeconfig or -target-context")
+			os.Exit(1)
+		}
 
-	var config *rest.Config
-	var err error
+		if *metricsAddress == "" {
+			fmt.Println("metrics-address must not be empty")
+			os.Exit(1)
+		}
+		for name, address := range map[string]string{
+			"metrics-address":  *metricsAddress,
+			"health-address":   *healthAddress,
+			"admin-address":    *adminAddress,
+			"receiver-address": *receiverAddress,
+			"ui-address":       *uiAddress,
+			"pprof-address":    *pprofAddress,
+		} {
+			if address == "" {
+				continue
+			}
+			if err := validListenAddress(address); err != nil {
+				fmt.Printf("invalid %s %q: %v\n", name, address, err)
+				os.Exit(1)
+			}
+		}
+		if *healthAddress != "" && *healthAddress == *metricsAddress {
+			fmt.Println("health-address must differ from metrics-address; leave it empty to serve health on the metrics port")
+			os.Exit(1)
+		}
 
-	if *insideCluster {
-		config, err = rest.InClusterConfig()
-	} else {
-		kubeconfig := filepath.Join(os.Getenv("HOME"), ".kube", "config")
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
-	}
+		if (*metricsTLSCert == "") != (*metricsTLSKey == "") || (*metricsClientCA != "" && *metricsTLSCert == "") {
+			fmt.Println("metrics-tls-cert and metrics-tls-key must be set together, and metrics-client-ca requires them")
+			os.Exit(1)
+		}
 
-	if err != nil {
-		panic(err.Error())
-	}
+		if *rolloutFailureAction != "" && !restarter.ValidRolloutAction(*rolloutFailureAction) {
+			fmt.Printf("unknown rollout failure action %q\n", *rolloutFailureAction)
+			os.Exit(1)
+		}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
-	}
+		if !watcher.ValidChangeDetection(*changeDetection) {
+			fmt.Printf("unknown change detection %q\n", *changeDetection)
+			os.Exit(1)
+		}
 
-	factory := informers.NewSharedInformerFactoryWithOptions(clientset, time.Minute*10, informers.WithNamespace(*namespace))
-	secretInformer := factory.Core().V1().Secrets().Informer()
+		if !watcher.ValidEndpointAction(*probeAction) {
+			fmt.Printf("unknown probe mismatch action %q\n", *probeAction)
+			os.Exit(1)
+		}
 
-	stopCh := make(chan struct{})
-	defer close(stopCh)
+		if err := watcher.ValidExpiryActions(watcher.SplitSet(*expiryActions)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
-	go secretInformer.Run(stopCh)
+		if !watcher.ValidCreateAction(*onCreate) {
+			fmt.Printf("unknown create action %q\n", *onCreate)
+			os.Exit(1)
+		}
+		if err := watcher.ValidDeleteActions(watcher.SplitSet(*onDelete)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
-	if !cache.WaitForCacheSync(stopCh, secretInformer.HasSynced) {
-		panic("Failed to sync cache")
+		defaults := watcher.Mapping{
+			Namespace: *namespace,
+			Kind:      *workloadKind,
+			Delay:     &metav1.Duration{Duration: *delay},
+			Keys:      watcher.SplitList(*keys),
+			Windows:   watcher.SplitList(*restartWindows),
+			Strategy:  *restartStrategy,
+			Policy:    *restartPolicy,
+		}
+		if !restarter.ValidStrategy(defaults.Strategy) {
+			fmt.Printf("unknown restart strategy %q\n", defaults.Strategy)
+			os.Exit(1)
+		}
+		if _, err := watcher.ParseWindows(defaults.Windows); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if defaults.Policy != "" {
+			if err := watcher.ValidPolicy(defaults.Policy); err != nil {
+				fmt.Printf("invalid restart-policy: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		retry := watcher.RetryPolicy{
+			InitialBackoff: *retryInitialBackoff,
+			MaxBackoff:     *retryMaxBackoff,
+			Factor:         *retryBackoffFactor,
+			MaxAttempts:    *retryMaxAttempts,
+			AttemptTimeout: *restartAttemptTimeout,
+		}
+		if err := retry.Validate(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if errs := validation.IsQualifiedName(*restartAnnotation); len(errs) > 0 {
+			fmt.Printf("invalid restart-annotation %q: %s\n", *restartAnnotation, strings.Join(errs, "; "))
+			os.Exit(1)
+		}
+		annotationValue, err := restarter.ParseAnnotationValue(*restartAnnotationValue)
+		if err != nil {
+			fmt.Printf("invalid restart-annotation-value: %v\n", err)
+			os.Exit(1)
+		}
+
+		watchConfig := &watcher.Config{}
+		var fileMapping watcher.Mapping
+		var signaler *watcher.ProcessSignaler
+		if *signalName != "" {
+			sig, err := watcher.ParseSignal(*signalName)
+			if err != nil || *watchFiles == "" || *signalProcess == "" {
+				fmt.Println("signal requires watch-files and signal-process, and one of: SIGHUP, SIGINT, SIGTERM, SIGUSR1, SIGUSR2")
+				os.Exit(1)
+			}
+			signaler = &watcher.ProcessSignaler{Process: *signalProcess, Signal: sig, Delay: *delay}
+		} else if *watchFiles != "" {
+			if *deploymentName == "" || !restarter.ValidKind(*workloadKind) || *workloadKind == restarter.KindJob || defaults.Strategy == restarter.StrategyChecksum {
+				fmt.Println("watch-files requires deployment-name and a supported workload-kind, and cannot use the checksum strategy")
+				os.Exit(1)
+			}
+			fileMapping = defaults
+			fileMapping.Deployment = *deploymentName
+			fileMapping.Files = *watchFiles
+		} else if *configPath != "" {
+			var err error
+			watchConfig, err = watcher.LoadConfig(*configPath, defaults)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		} else if watcher.CountSet(*secretName, *secretSelector, *configMapName, *vaultPath, *awsSecret, *acmCertificate, *deploymentName) > 0 || (*discovery == "" && !*operator) {
+			if watcher.CountSet(*secretName, *secretSelector, *configMapName, *vaultPath, *awsSecret, *acmCertificate) != 1 || *deploymentName == "" {
+				fmt.Println("deployment-name and one of secret-name, secret-selector, configmap-name, vault-path, aws-secret or acm-certificate are required unless -config, -discovery or -operator is set")
+				_ = cmd.Usage()
+				os.Exit(1)
+			}
+			m := defaults
+			m.Secret = *secretName
+			m.SecretSelector = *secretSelector
+			m.ConfigMap = *configMapName
+			m.Vault = *vaultPath
+			m.AWSSecret = *awsSecret
+			m.ACMCertificate = *acmCertificate
+			m.Deployment = *deploymentName
+			watchConfig.Mappings = []watcher.Mapping{m}
+			if err := watchConfig.Validate(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		config, err := buildConfig(*insideCluster, *kubeconfig, *kubeContext)
+		if err != nil {
+			panic(err.Error())
+		}
+
+		// Workloads are restarted in the watched cluster unless a target
+		// cluster is configured.
+		targetConfig := config
+		if multiCluster {
+			targetConfig, err = buildConfig(false, *targetKubeconfig, *targetContext)
+			if err != nil {
+				panic(err.Error())
+			}
+		}
+
+		if *kubeAPIQPS <= 0 || *kubeAPIBurst < 1 {
+			fmt.Println("kube-api-qps must be positive and kube-api-burst at least 1")
+			os.Exit(1)
+		}
+		for _, c := range []*rest.Config{config, targetConfig} {
+			c.QPS = *kubeAPIQPS
+			c.Burst = *kubeAPIBurst
+			if *kubeAPIProtobuf {
+				// The dynamic and metadata clients switch back to JSON, which
+				// custom resources require.
+				c.ContentType = runtime.ContentTypeProtobuf
+				c.AcceptContentTypes = runtime.ContentTypeProtobuf + "," + runtime.ContentTypeJSON
+			}
+		}
+
+		if *requestTimeout < 0 {
+			fmt.Println("request-timeout must not be negative")
+			os.Exit(1)
+		}
+		if *requestTimeout > 0 {
+			wrap := func(rt http.RoundTripper) http.RoundTripper {
+				return timeoutTransport{next: rt, timeout: *requestTimeout}
+			}
+			config.Wrap(wrap)
+			if multiCluster {
+				targetConfig.Wrap(wrap)
+			}
+		}
+
+		if *otlpEndpoint != "" {
+			shutdownTracing, err := setupTracing(context.Background(), *otlpEndpoint, *otlpInsecure)
+			if err != nil {
+				panic(err.Error())
+			}
+			defer shutdownTracing(context.Background())
+			wrap := func(rt http.RoundTripper) http.RoundTripper {
+				return tracingTransport{next: rt}
+			}
+			config.Wrap(wrap)
+			if multiCluster {
+				targetConfig.Wrap(wrap)
+			}
+		}
+
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			panic(err.Error())
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		stopCh := ctx.Done()
+
+		namespaces := watchConfig.Namespaces()
+		if *discovery != "" && !slices.Contains(namespaces, *namespace) {
+			namespaces = append(namespaces, *namespace)
+		}
+		if *allNamespaces {
+			namespaces = []string{metav1.NamespaceAll}
+		}
+
+		dynamicClient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			panic(err.Error())
+		}
+
+		recorder := restarter.NewEventRecorder(clientset)
+
+		r := restarter.New(clientset, dynamicClient, recorder)
+		if multiCluster {
+			targetClientset, err := kubernetes.NewForConfig(targetConfig)
+			if err != nil {
+				panic(err.Error())
+			}
+			targetDynamicClient, err := dynamic.NewForConfig(targetConfig)
+			if err != nil {
+				panic(err.Error())
+			}
+			r = restarter.New(targetClientset, targetDynamicClient, restarter.NewEventRecorder(targetClientset))
+		}
+		r.Config = targetConfig
+		r.Annotation = *restartAnnotation
+		r.AnnotationValue = annotationValue
+
+		w := watcher.New(clientset, r, watchConfig.Mappings, *discovery, defaults, stopCh)
+		w.AllNamespaces = *allNamespaces
+		w.Filter = watcher.NewNamespaceFilter(*includeNamespaces, *excludeNamespaces)
+		w.Validate = *validateCerts
+		w.VerifyChain = *verifyChain
+		w.Recorder = recorder
+		w.ChangeDetection = *changeDetection
+		w.MinRestartInterval = *minRestartInterval
+		w.DelayJitter = *delayJitter
+		w.MaxConcurrentRestarts = *maxConcurrentRestarts
+		w.CertManager = *certManager
+		w.Retry = retry
+		w.RolloutTimeout = *rolloutTimeout
+		w.RolloutFailureAction = *rolloutFailureAction
+		w.RecordChecksums = *catchUp
+		w.ScopeSecrets = !*operator
+		w.DiscoverKnative = *discoverKnative
+		w.ResyncPeriod = *resyncPeriod
+		w.OnCreate = *onCreate
+		w.OnDelete = watcher.SplitSet(*onDelete)
+		if *opaURL != "" {
+			w.OPA = &watcher.OPA{URL: *opaURL, TokenFile: *opaTokenFile, FailOpen: *opaFailOpen}
+		}
+		if *metadataOnly {
+			w.MetadataOnly = true
+			w.Metadata, err = metadata.NewForConfig(config)
+			if err != nil {
+				panic(err.Error())
+			}
+		}
+		var templates *notify.Templates
+		if *notificationTemplateFile != "" {
+			templates, err = notify.LoadTemplates(*notificationTemplateFile)
+			if err != nil {
+				fmt.Printf("Invalid -notification-template-file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if *slackWebhookURL != "" {
+			w.Notifiers = append(w.Notifiers, notify.SlackNotifier{URL: *slackWebhookURL, Templates: templates})
+		}
+		if *notifyWebhookURL != "" {
+			w.Notifiers = append(w.Notifiers, notify.WebhookNotifier{URL: *notifyWebhookURL, Templates: templates})
+		}
+		if *teamsWebhookURL != "" {
+			w.Notifiers = append(w.Notifiers, notify.TeamsNotifier{URL: *teamsWebhookURL, Templates: templates})
+		}
+		if *discordWebhookURL != "" {
+			w.Notifiers = append(w.Notifiers, notify.DiscordNotifier{URL: *discordWebhookURL, Templates: templates})
+		}
+		for _, path := range watcher.SplitList(*notifierPlugins) {
+			if err := notify.LoadPlugin(path); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		for _, spec := range *notifierSpecs {
+			sink, err := notify.Parse(spec, templates)
+			if err != nil {
+				fmt.Printf("Invalid -notifier: %v\n", err)
+				os.Exit(1)
+			}
+			w.Notifiers = append(w.Notifiers, sink)
+		}
+		var emailer *notify.EmailNotifier
+		if *smtpAddress != "" {
+			if !notify.ValidSMTPTLS(*smtpTLS) {
+				fmt.Print("-smtp-tls must be one of: starttls, tls, none\n")
+				os.Exit(1)
+			}
+			if *emailFrom == "" || *emailTo == "" {
+				fmt.Print("-smtp-address requires -email-from and -email-to\n")
+				os.Exit(1)
+			}
+			password, err := watcher.ReadPassword(*smtpPasswordFile)
+			if err != nil {
+				fmt.Printf("Failed to read -smtp-password-file: %v\n", err)
+				os.Exit(1)
+			}
+			emailer = &notify.EmailNotifier{
+				Address:   *smtpAddress,
+				Username:  *smtpUsername,
+				Password:  password,
+				From:      *emailFrom,
+				To:        watcher.SplitList(*emailTo),
+				TLSMode:   *smtpTLS,
+				Digest:    *emailDigestInterval,
+				Templates: templates,
+			}
+			w.Notifiers = append(w.Notifiers, emailer)
+			if emailer.Digest > 0 {
+				go emailer.Run(stopCh)
+			}
+		}
+		var incidentSinks []watcher.IncidentSink
+		if *pagerDutyRoutingKeyFile != "" {
+			routingKey, err := watcher.ReadPassword(*pagerDutyRoutingKeyFile)
+			if err != nil {
+				fmt.Printf("Failed to read -pagerduty-routing-key-file: %v\n", err)
+				os.Exit(1)
+			}
+			incidentSinks = append(incidentSinks, watcher.PagerDutySink{RoutingKey: routingKey})
+		}
+		if *opsgenieAPIKeyFile != "" {
+			apiKey, err := watcher.ReadPassword(*opsgenieAPIKeyFile)
+			if err != nil {
+				fmt.Printf("Failed to read -opsgenie-api-key-file: %v\n", err)
+				os.Exit(1)
+			}
+			incidentSinks = append(incidentSinks, watcher.OpsgenieSink{APIURL: strings.TrimSuffix(*opsgenieAPIURL, "/"), APIKey: apiKey})
+		}
+		if len(incidentSinks) > 0 {
+			w.Incidents = watcher.NewIncidents(incidentSinks, *incidentFailureThreshold)
+		}
+		if *cloudEventsSink != "" {
+			if !watcher.ValidDelivery(*eventBusDelivery) {
+				fmt.Print("-event-bus-delivery must be one of: at-most-once, at-least-once\n")
+				os.Exit(1)
+			}
+			password, err := watcher.ReadPassword(*eventBusPasswordFile)
+			if err != nil {
+				fmt.Printf("Failed to read -event-bus-password-file: %v\n", err)
+				os.Exit(1)
+			}
+			sink, err := watcher.NewEventSink(*cloudEventsSink, watcher.EventBusOptions{
+				Username:        *eventBusUsername,
+				Password:        password,
+				SASLMechanism:   *eventBusSASLMechanism,
+				CredentialsFile: *eventBusCredentialsFile,
+				TLS:             *eventBusTLS,
+				Delivery:        *eventBusDelivery,
+			})
+			if err != nil {
+				fmt.Printf("Invalid -cloudevents-sink: %v\n", err)
+				os.Exit(1)
+			}
+			w.CloudEvents = watcher.NewCloudEvents(sink, *cloudEventsSource, *eventBusDelivery == watcher.DeliveryAtLeastOnce)
+		}
+		if *auditLogPath != "" {
+			w.Audit, err = watcher.NewAuditLog(*auditLogPath)
+			if err != nil {
+				fmt.Printf("Failed to open -audit-log: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if *once {
+			store := &watcher.StateStore{Clientset: clientset, Namespace: *namespace, Name: *stateConfigMap}
+			if *pauseConfigMap != "" {
+				if err := w.ReadPauseConfigMap(ctx, *namespace, *pauseConfigMap); err != nil {
+					fmt.Printf("Failed to read -pause-configmap: %v\n", err)
+					os.Exit(1)
+				}
+			}
+			err := w.RunOnce(ctx, store)
+			pushMetrics(*pushgatewayURL, *remoteWriteURL, *remoteWriteTokenFile, *metricsJob)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+		if *historySize > 0 {
+			var store watcher.DocumentStore
+			switch {
+			case *historyConfigMap != "":
+				store = &watcher.StateStore{Clientset: clientset, Namespace: *namespace, Name: *historyConfigMap}
+			case *historyFile != "":
+				store = &watcher.FileStore{Path: *historyFile}
+			}
+			w.History = watcher.NewRestartHistory(*historySize, store)
+		}
+		w.Stream = watcher.NewEventStream()
+		if *pauseConfigMap != "" {
+			w.WatchPauseConfigMap(*namespace, *pauseConfigMap)
+		}
+		if *persistState {
+			w.State = &watcher.StateStore{Clientset: clientset, Namespace: *namespace, Name: *stateConfigMap}
+		}
+		// Followers refuse the admin API's restarts, and start no restart
+		// workers, until they lead.
+		w.SetStandby(*leaderElect)
+		run := func() {
+			w.SetStandby(false)
+			w.RunWorkers(*restartWorkers)
+			if w.State != nil {
+				if err := w.RestoreState(ctx); err != nil {
+					fmt.Printf("Failed to restore state: %v\n", err)
+				}
+				go w.RunStateSync()
+			}
+			if err := w.History.Load(ctx); err != nil {
+				fmt.Printf("Failed to load the restart history: %v\n", err)
+			}
+			go w.History.RunSync(stopCh)
+			for _, ns := range namespaces {
+				w.WatchNamespace(ns)
+			}
+			if *catchUp {
+				w.CatchUp()
+			}
+
+			if *watchFiles != "" {
+				files := &watcher.FileWatcher{
+					Paths: watcher.SplitList(*watchFiles),
+					OnChange: func() {
+						if signaler != nil {
+							signaler.Schedule()
+							return
+						}
+						w.Trigger(nil, []watcher.Mapping{fileMapping})
+					},
+				}
+				go func() {
+					if err := files.Run(stopCh); err != nil {
+						panic(err.Error())
+					}
+				}()
+			}
+
+			if *operator {
+				watcher.NewCertWatchController(w, dynamicClient).Run(stopCh)
+			}
+
+			if *certManager {
+				certificates := watcher.NewCertManagerController(w, dynamicClient)
+				for _, ns := range namespaces {
+					certificates.Run(ns, stopCh)
+				}
+			}
+
+			pollers := &watcher.PollerSet{Watcher: w, Interval: *pollInterval, StopCh: stopCh, NewSource: func(m watcher.Mapping) watcher.ExternalSource {
+				switch {
+				case m.AWSSecret != "":
+					return watcher.AWSSecretSource{Client: secretsmanager.NewFromConfig(awsConfig()), ID: m.AWSSecret}
+				case m.ACMCertificate != "":
+					return watcher.ACMSource{Client: acm.NewFromConfig(awsConfig()), ARN: m.ACMCertificate}
+				}
+				return watcher.VaultSource{Address: *vaultAddress, TokenFile: *vaultTokenFile, Path: m.Vault}
+			}}
+			pollers.Sync(watchConfig.Mappings)
+
+			if *reloadConfig {
+				files := &watcher.FileWatcher{
+					Paths: []string{*configPath},
+					OnChange: func() {
+						w.ReloadConfig(*configPath, pollers)
+					},
+				}
+				go func() {
+					if err := files.Run(stopCh); err != nil {
+						fmt.Printf("Failed to watch config %s: %v\n", *configPath, err)
+					}
+				}()
+			}
+
+			if *expiryThreshold > 0 {
+				scanner := watcher.NewExpiryScanner(w, *expiryThreshold, *expiryInterval, watcher.SplitSet(*expiryActions), *expiryWebhookURL, recorder)
+				scanner.Dynamic = dynamicClient
+				go scanner.Run(stopCh)
+			}
+
+			if *driftInterval > 0 {
+				go (&watcher.DriftScanner{Watcher: w, Interval: *driftInterval, Remediate: *driftRemediate}).Run(stopCh)
+			}
+
+			if *probeInterval > 0 {
+				go watcher.NewEndpointMonitor(w, *probeInterval, *probeAction).Run(stopCh)
+			}
+		}
+
+		// Start Prometheus metrics and health server
+		health := watcher.NewHealthChecker(clientset, w)
+		metricsHandler := promhttp.InstrumentMetricHandler(metrics.Registry, promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+		if *metricsTokenAuth {
+			metricsHandler = watcher.TokenReviewAuth(clientset, metricsHandler)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler)
+		healthMux := mux
+		if *healthAddress != "" {
+			healthMux = http.NewServeMux()
+		}
+		healthMux.HandleFunc("/healthz", health.Healthz)
+		healthMux.HandleFunc("/readyz", health.Readyz)
+		server := &http.Server{Addr: *metricsAddress, Handler: mux}
+		if *metricsTLSCert != "" {
+			server.TLSConfig, err = metricsTLSConfig(*metricsClientCA)
+			if err != nil {
+				panic(err.Error())
+			}
+		}
+		go func() {
+			var err error
+			if *metricsTLSCert != "" {
+				err = server.ListenAndServeTLS(*metricsTLSCert, *metricsTLSKey)
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				fmt.Printf("Metrics server failed: %v\n", err)
+			}
+		}()
+
+		var healthServer *http.Server
+		if *healthAddress != "" {
+			healthServer = &http.Server{Addr: *healthAddress, Handler: healthMux}
+			go func() {
+				fmt.Printf("Serving health probes on %s\n", *healthAddress)
+				if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					fmt.Printf("Health server failed: %v\n", err)
+				}
+			}()
+		}
+
+		var adminServer *http.Server
+		if *adminAddress != "" {
+			adminServer = &http.Server{Addr: *adminAddress, Handler: (&watcher.AdminAPI{Watcher: w}).Handler(clientset)}
+			go func() {
+				fmt.Printf("Serving the admin API on %s\n", *adminAddress)
+				if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					fmt.Printf("Admin server failed: %v\n", err)
+				}
+			}()
+		}
+
+		var receiverServer *http.Server
+		if *receiverAddress != "" {
+			receiver, err := watcher.NewRotationReceiver(w, *receiverTokenFile)
+			if err != nil {
+				fmt.Printf("Failed to read the receiver token: %v\n", err)
+				os.Exit(1)
+			}
+			receiverServer = &http.Server{Addr: *receiverAddress, Handler: receiver.Handler()}
+			go func() {
+				fmt.Printf("Accepting rotation notifications on %s\n", *receiverAddress)
+				if err := receiverServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					fmt.Printf("Receiver server failed: %v\n", err)
+				}
+			}()
+		}
+
+		var uiServer *http.Server
+		if *uiAddress != "" {
+			uiServer = &http.Server{Addr: *uiAddress, Handler: w.UIHandler()}
+			go func() {
+				fmt.Printf("Serving the web UI on %s\n", *uiAddress)
+				if err := uiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					fmt.Printf("UI server failed: %v\n", err)
+				}
+			}()
+		}
+
+		if *pprofAddress != "" {
+			go servePprof(*pprofAddress)
+		}
+
+		if *leaderElect {
+			if *leaderElectionNamespace == "" {
+				*leaderElectionNamespace = *namespace
+			}
+			health.MarkStarted()
+			go runWithLeaderElection(ctx, clientset, *leaderElectionNamespace, *leaderElectionID, run)
+		} else {
+			run()
+			health.MarkStarted()
+		}
+
+		<-stopCh
+		fmt.Println("Shutting down")
+		w.Shutdown(*shutdownTimeout)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		w.CloudEvents.Close(*shutdownTimeout)
+		w.Stream.Close()
+		if emailer != nil {
+			emailer.Flush()
+		}
+		if w.State != nil {
+			if err := w.SaveState(shutdownCtx); err != nil {
+				fmt.Printf("Failed to save state: %v\n", err)
+			}
+		}
+		if err := w.History.Save(shutdownCtx); err != nil {
+			fmt.Printf("Failed to save the restart history: %v\n", err)
+		}
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			fmt.Printf("Failed to shut down metrics server: %v\n", err)
+		}
+		if healthServer != nil {
+			if err := healthServer.Shutdown(shutdownCtx); err != nil {
+				fmt.Printf("Failed to shut down health server: %v\n", err)
+			}
+		}
+		if adminServer != nil {
+			if err := adminServer.Shutdown(shutdownCtx); err != nil {
+				fmt.Printf("Failed to shut down admin server: %v\n", err)
+			}
+		}
+		if receiverServer != nil {
+			if err := receiverServer.Shutdown(shutdownCtx); err != nil {
+				fmt.Printf("Failed to shut down receiver server: %v\n", err)
+			}
+		}
+		if uiServer != nil {
+			if err := uiServer.Shutdown(shutdownCtx); err != nil {
+				fmt.Printf("Failed to shut down UI server: %v\n", err)
+			}
+		}
 	}
+	return cmd
+}
 
-	secretInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			fmt.Printf("Secret %s changed, waiting for %s before restarting deployment %s\n", *secretName, delay, *deploymentName)
-			restartDeployment(clientset, *namespace, *secretName, *deploymentName, *delay)
-		},
-	})
-
-	// Start Prometheus metrics server
-	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		http.ListenAndServe(":8080", nil)
-	}()
-
-	fmt.Printf("Watching secret %s in namespace %s\n", *secretName, *namespace)
-	<-stopCh
+// pushMetrics sends the metrics of a -once run to the Pushgateway and the
+// remote-write endpoint that are set. Failures are logged but do not fail
+// the run, whose restarts are done by then.
+func pushMetrics(pushgatewayURL, remoteWriteURL, remoteWriteTokenFile, job string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if pushgatewayURL != "" {
+		if err := metrics.Push(ctx, pushgatewayURL, job); err != nil {
+			fmt.Printf("Failed to push metrics to %s: %v\n", pushgatewayURL, err)
+		}
+	}
+	if remoteWriteURL != "" {
+		if err := metrics.RemoteWrite(ctx, remoteWriteURL, remoteWriteTokenFile, job); err != nil {
+			fmt.Printf("Failed to remote-write metrics to %s: %v\n", remoteWriteURL, err)
+		}
+	}
+}
+
+// validListenAddress returns why address cannot be listened on, if it
+// cannot. IPv6 hosts must be bracketed, as in [::1]:8080.
+func validListenAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return err
+	}
+	if strings.Contains(host, ":") {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildConfig returns the in-cluster config, or loads a kubeconfig from path,
+// $KUBECONFIG or $HOME/.kube/config in that order of precedence and selects
+// kubeContext, or the current context when empty.
+func buildConfig(insideCluster bool, path, kubeContext string) (*rest.Config, error) {
+	if insideCluster {
+		return rest.InClusterConfig()
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = path
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
 }
 
-func restartDeployment(clientset *kubernetes.Clientset, namespace, secretName, deploymentName string, delay time.Duration) {
-	time.Sleep(delay)
-
-	deploymentsClient := clientset.AppsV1().Deployments(namespace)
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// Retrieve the latest version of the deployment
-		deployment, getErr := deploymentsClient.Get(context.TODO(), deploymentName, metav1.GetOptions{})
-		if getErr != nil {
-			fmt.Printf("Failed to get latest version of Deployment: %v\n", getErr)
-			restartCounter.WithLabelValues(namespace, secretName, deploymentName, "false").Inc()
-			return getErr
-		}
-
-		// Increment the annotation to force the deployment to rollout
-		if deployment.Spec.Template.Annotations == nil {
-			deployment.Spec.Template.Annotations = map[string]string{}
-		}
-		deployment.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = time.Now().Format(time.RFC3339)
-
-		_, updateErr := deploymentsClient.Update(context.TODO(), deployment, metav1.UpdateOptions{})
-		return updateErr
-	})
-	if retryErr != nil {
-		fmt.Printf("Failed to update Deployment: %v\n", retryErr)
-		restartCounter.WithLabelValues(namespace, secretName, deploymentName, "false").Inc()
-	} else {
-		fmt.Printf("Deployment %s restarted successfully\n", deploymentName)
-		restartCounter.WithLabelValues(namespace, secretName, deploymentName, "true").Inc()
+// awsConfig loads the AWS SDK configuration from the environment, shared
+// config files or the pod's IAM role.
+func awsConfig() aws.Config {
+	config, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err.Error())
 	}
+	return config
 }
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmetrics "k8s.io/client-go/tools/metrics"
+)
+
+// The metrics of the Kubernetes API requests made through client-go, such
+// as the watcher's restarts and informers.
+var (
+	KubeAPIRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cert_watcher_kube_api_request_duration_seconds",
+			Help:    "Latency of Kubernetes API requests, by verb and API server host",
+			Buckets: []float64{0.005, 0.025, 0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30, 60},
+		},
+		[]string{"verb", "host"},
+	)
+
+	KubeAPIRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_kube_api_requests_total",
+			Help: "Kubernetes API requests, by HTTP status code, method and API server host; code is <error> when no response came back",
+		},
+		[]string{"code", "method", "host"},
+	)
+
+	KubeAPIRequestRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_kube_api_request_retries_total",
+			Help: "Kubernetes API requests retried by client-go, by HTTP status code, method and API server host",
+		},
+		[]string{"code", "method", "host"},
+	)
+
+	KubeAPIRateLimiterDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cert_watcher_kube_api_rate_limiter_duration_seconds",
+			Help:    "Time Kubernetes API requests waited for the client-side rate limiter, by verb and API server host",
+			Buckets: []float64{0.005, 0.025, 0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30, 60},
+		},
+		[]string{"verb", "host"},
+	)
+)
+
+type latencyAdapter struct {
+	histogram *prometheus.HistogramVec
+}
+
+func (a latencyAdapter) Observe(ctx context.Context, verb string, u url.URL, latency time.Duration) {
+	a.histogram.WithLabelValues(verb, u.Host).Observe(latency.Seconds())
+}
+
+type resultAdapter struct {
+	counter *prometheus.CounterVec
+}
+
+func (a resultAdapter) Increment(ctx context.Context, code, method, host string) {
+	a.counter.WithLabelValues(code, method, host).Inc()
+}
+
+type retryAdapter struct {
+	counter *prometheus.CounterVec
+}
+
+func (a retryAdapter) IncrementRetry(ctx context.Context, code, method, host string) {
+	a.counter.WithLabelValues(code, method, host).Inc()
+}
+
+func init() {
+	Registry.MustRegister(KubeAPIRequestDuration)
+	Registry.MustRegister(KubeAPIRequests)
+	Registry.MustRegister(KubeAPIRequestRetries)
+	Registry.MustRegister(KubeAPIRateLimiterDuration)
+
+	// client-go takes the first adapters registered and ignores the rest.
+	clientmetrics.Register(clientmetrics.RegisterOpts{
+		RequestLatency:     latencyAdapter{KubeAPIRequestDuration},
+		RequestResult:      resultAdapter{KubeAPIRequests},
+		RequestRetry:       retryAdapter{KubeAPIRequestRetries},
+		RateLimiterLatency: latencyAdapter{KubeAPIRateLimiterDuration},
+	})
+}
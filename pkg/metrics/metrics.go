@@ -0,0 +1,328 @@
+// Package metrics defines the Prometheus collectors cert-watcher registers
+// with Registry.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Reasons reported by cert_watcher_restarts_skipped_total.
+const (
+	SkipDataUnchanged        = "data_unchanged"
+	SkipCertificateUnchanged = "certificate_unchanged"
+	SkipKeysUnchanged        = "keys_unchanged"
+	SkipValidationFailed     = "validation_failed"
+	SkipSuperseded           = "superseded"
+	SkipShutdown             = "shutdown"
+	SkipCertificateManaged   = "certificate_managed"
+	SkipPolicyDenied         = "policy_denied"
+	SkipOPADenied            = "opa_denied"
+	SkipOPAFailed            = "opa_failed"
+	SkipUnreadable           = "unreadable"
+)
+
+// Reasons reported by cert_watcher_restarts_deferred_total.
+const (
+	DeferPaused     = "paused"
+	DeferAnnotated  = "annotated_paused"
+	DeferRollingOut = "rolling_out"
+)
+
+// Registry holds the cert-watcher metrics along with the Go runtime and
+// process collectors. It is served on /metrics instead of the default
+// registry, so that nothing else a dependency registers there is exposed.
+var Registry = prometheus.NewRegistry()
+
+var (
+	RestartCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_restarts_total",
+			Help: "Restarts attempted, by whether they were accepted",
+		},
+		[]string{"namespace", "secret", "deployment", "restarted"},
+	)
+
+	CertificateExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_certificate_expiry_seconds",
+			Help: "NotAfter of the tls.crt leaf certificate in a watched secret, as a Unix timestamp",
+		},
+		[]string{"namespace", "secret"},
+	)
+
+	CertificateNotBefore = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_certificate_not_before",
+			Help: "NotBefore of the tls.crt leaf certificate in a watched secret, as a Unix timestamp",
+		},
+		[]string{"namespace", "secret"},
+	)
+
+	CertificateExpiring = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_certificate_expiring",
+			Help: "1 if the tls.crt leaf certificate in a watched secret expires within the expiry threshold, 0 otherwise",
+		},
+		[]string{"namespace", "secret"},
+	)
+
+	SourceUpdates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_source_updates_total",
+			Help: "Updates observed on watched secrets and ConfigMaps, excluding informer resyncs",
+		},
+		[]string{"namespace", "kind", "source"},
+	)
+
+	RestartsSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_restarts_skipped_total",
+			Help: "Updates of watched sources that did not schedule a restart, by reason",
+		},
+		[]string{"namespace", "source", "reason"},
+	)
+
+	PendingRestarts = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_pending_restarts",
+			Help: "Restarts waiting out their delay",
+		},
+	)
+
+	RestartDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cert_watcher_restart_duration_seconds",
+			Help:    "Time spent in the Kubernetes API calls of a restart",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"kind", "restarted"},
+	)
+
+	LastRestartSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_last_restart_success_timestamp_seconds",
+			Help: "Unix timestamp of the last successful restart of a workload",
+		},
+		[]string{"namespace", "kind", "name"},
+	)
+
+	RestartsSuppressed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_restarts_suppressed_total",
+			Help: "Restarts held back because the target was restarted within -min-restart-interval",
+		},
+		[]string{"namespace", "kind", "name"},
+	)
+
+	RestartsDeferred = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_restarts_deferred_total",
+			Help: "Due restarts held back because of the state of the target, by reason",
+		},
+		[]string{"namespace", "kind", "name", "reason"},
+	)
+
+	ProbeResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_probe_results_total",
+			Help: "TLS probes of restarted workloads, by whether they served the new certificate",
+		},
+		[]string{"namespace", "kind", "name", "result"},
+	)
+
+	EndpointStale = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_endpoint_stale",
+			Help: "1 if the probe of a workload served a certificate other than the one in its secret at the last check",
+		},
+		[]string{"namespace", "kind", "name", "endpoint"},
+	)
+
+	StalePods = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_stale_pods",
+			Help: "Pods of a target that started before the data of its secret was last written",
+		},
+		[]string{"namespace", "kind", "name", "secret"},
+	)
+
+	StalePodsEvicted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_stale_pods_evicted_total",
+			Help: "Stale pods evicted by -drift-remediate",
+		},
+		[]string{"namespace", "kind", "name"},
+	)
+
+	HookFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_hook_failures_total",
+			Help: "Failed pre- and post-restart hooks, by phase",
+		},
+		[]string{"namespace", "kind", "name", "phase"},
+	)
+
+	EvictionsBlocked = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_evictions_blocked_total",
+			Help: "Pod evictions refused by a PodDisruptionBudget during evict-pods restarts",
+		},
+		[]string{"namespace", "kind", "name"},
+	)
+
+	RolloutsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_rollouts_total",
+			Help: "Rollouts followed to completion after a restart, by result",
+		},
+		[]string{"namespace", "kind", "name", "result"},
+	)
+
+	RolloutDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cert_watcher_rollout_duration_seconds",
+			Help:    "Time from a restart until its rollout completed or failed",
+			Buckets: []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800},
+		},
+		[]string{"kind", "result"},
+	)
+
+	SignalsSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_signals_sent_total",
+			Help: "Signals sent to co-located processes in signal mode",
+		},
+		[]string{"process", "sent"},
+	)
+
+	SourcePollFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_source_poll_failures_total",
+			Help: "Failed polls of certificate sources outside Kubernetes",
+		},
+		[]string{"kind", "source"},
+	)
+
+	InformerResyncs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_informer_resyncs_total",
+			Help: "Periodic informer resyncs delivered as updates with an unchanged resourceVersion",
+		},
+		[]string{"kind"},
+	)
+
+	CloudEventsPublished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_cloudevents_total",
+			Help: "CloudEvents emitted to -cloudevents-sink, by type and whether they were sent, failed or dropped",
+		},
+		[]string{"type", "result"},
+	)
+
+	ConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_config_reloads_total",
+			Help: "Reloads of -config after it changed, by whether it was applied or kept the previous mappings",
+		},
+		[]string{"result"},
+	)
+
+	PolicyDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_policy_decisions_total",
+			Help: "Restart decisions of mapping policies and OPA, by engine (cel or opa) and decision (allow, deny or error)",
+		},
+		[]string{"engine", "decision"},
+	)
+
+	BuildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_build_info",
+			Help: "Always 1, labelled with the version, commit, build date and Go version of the running binary",
+		},
+		[]string{"version", "commit", "date", "goversion"},
+	)
+
+	PausedTargets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_paused_targets",
+			Help: "1 for every target whose due restart is held back by the cert-watcher.io/paused annotation on it or its source",
+		},
+		[]string{"namespace", "kind", "name"},
+	)
+
+	DeadLetters = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_dead_letters",
+			Help: "1 for every target whose restart failed every attempt and is parked as a dead letter",
+		},
+		[]string{"namespace", "kind", "name"},
+	)
+
+	GloballyPaused = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_paused",
+			Help: "1 while every restart is paused through the admin API or the pause ConfigMap",
+		},
+	)
+
+	StreamSubscribers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cert_watcher_event_stream_subscribers",
+			Help: "Clients connected to the event stream endpoints",
+		},
+	)
+
+	StreamRecordsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_event_stream_dropped_total",
+			Help: "Records not sent to an event stream client because it fell behind",
+		},
+	)
+
+	ValidationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cert_watcher_certificate_validation_failures_total",
+			Help: "Secret changes whose certificate failed validation and did not trigger a restart",
+		},
+		[]string{"namespace", "secret"},
+	)
+)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector())
+	Registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	Registry.MustRegister(RestartCounter)
+	Registry.MustRegister(CertificateExpiry)
+	Registry.MustRegister(CertificateNotBefore)
+	Registry.MustRegister(CertificateExpiring)
+	Registry.MustRegister(ValidationFailures)
+	Registry.MustRegister(SourceUpdates)
+	Registry.MustRegister(RestartsSkipped)
+	Registry.MustRegister(PendingRestarts)
+	Registry.MustRegister(RestartDuration)
+	Registry.MustRegister(LastRestartSuccess)
+	Registry.MustRegister(InformerResyncs)
+	Registry.MustRegister(RestartsSuppressed)
+	Registry.MustRegister(RestartsDeferred)
+	Registry.MustRegister(ProbeResults)
+	Registry.MustRegister(EndpointStale)
+	Registry.MustRegister(StalePods)
+	Registry.MustRegister(StalePodsEvicted)
+	Registry.MustRegister(HookFailures)
+	Registry.MustRegister(EvictionsBlocked)
+	Registry.MustRegister(RolloutsTotal)
+	Registry.MustRegister(RolloutDuration)
+	Registry.MustRegister(SignalsSent)
+	Registry.MustRegister(SourcePollFailures)
+	Registry.MustRegister(CloudEventsPublished)
+	Registry.MustRegister(ConfigReloads)
+	Registry.MustRegister(PolicyDecisions)
+	Registry.MustRegister(BuildInfo)
+	Registry.MustRegister(GloballyPaused)
+	Registry.MustRegister(PausedTargets)
+	Registry.MustRegister(DeadLetters)
+	Registry.MustRegister(StreamSubscribers)
+	Registry.MustRegister(StreamRecordsDropped)
+}
@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Push replaces the metrics of job on the Pushgateway at url with the
+// current contents of Registry. Short-lived runs, such as -once, push
+// before they exit since they are gone before Prometheus could scrape them.
+func Push(ctx context.Context, url, job string) error {
+	return push.New(url, job).Gatherer(Registry).PushContext(ctx)
+}
+
+// RemoteWrite sends the current contents of Registry to a Prometheus
+// remote-write endpoint at url, with a job label set to job on every series.
+// tokenFile holds a bearer token to authenticate with; none is sent when it
+// is empty.
+func RemoteWrite(ctx context.Context, url, tokenFile, job string) error {
+	families, err := Registry.Gather()
+	if err != nil {
+		return err
+	}
+	body := snappy.Encode(nil, writeRequest(families, job, time.Now()))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("remote write to %s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// series is one time series of a remote-write request, with a single
+// sample.
+type series struct {
+	labels map[string]string
+	value  float64
+}
+
+// writeRequest encodes families as a remote-write WriteRequest protobuf,
+// with every sample taken at now. Histograms and summaries are split into
+// their _bucket or quantile, _sum and _count series, as a scrape would.
+func writeRequest(families []*dto.MetricFamily, job string, now time.Time) []byte {
+	var all []series
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			base := map[string]string{"job": job}
+			for _, label := range metric.GetLabel() {
+				base[label.GetName()] = label.GetValue()
+			}
+			add := func(suffix string, value float64, extra ...string) {
+				labels := map[string]string{"__name__": name + suffix}
+				for k, v := range base {
+					labels[k] = v
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					labels[extra[i]] = extra[i+1]
+				}
+				all = append(all, series{labels: labels, value: value})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", metric.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				infinite := false
+				for _, bucket := range histogram.GetBucket() {
+					add("_bucket", float64(bucket.GetCumulativeCount()), "le", formatFloat(bucket.GetUpperBound()))
+					infinite = math.IsInf(bucket.GetUpperBound(), 1)
+				}
+				if !infinite {
+					add("_bucket", float64(histogram.GetSampleCount()), "le", "+Inf")
+				}
+				add("_sum", histogram.GetSampleSum())
+				add("_count", float64(histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.GetQuantile() {
+					add("", quantile.GetValue(), "quantile", formatFloat(quantile.GetQuantile()))
+				}
+				add("_sum", summary.GetSampleSum())
+				add("_count", float64(summary.GetSampleCount()))
+			default:
+				add("", metric.GetUntyped().GetValue())
+			}
+		}
+	}
+
+	timestamp := now.UnixMilli()
+	var request []byte
+	for _, s := range all {
+		names := make([]string, 0, len(s.labels))
+		for name := range s.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var timeSeries []byte
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, s.labels[name])
+			timeSeries = protowire.AppendTag(timeSeries, 1, protowire.BytesType)
+			timeSeries = protowire.AppendBytes(timeSeries, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestamp))
+		timeSeries = protowire.AppendTag(timeSeries, 2, protowire.BytesType)
+		timeSeries = protowire.AppendBytes(timeSeries, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, timeSeries)
+	}
+	return request
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,180 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// TLS modes of -smtp-tls.
+	SMTPTLSStartTLS = "starttls"
+	SMTPTLSImplicit = "tls"
+	SMTPTLSNone     = "none"
+
+	smtpTimeout = 30 * time.Second
+)
+
+// ValidSMTPTLS reports whether mode is a known -smtp-tls mode.
+func ValidSMTPTLS(mode string) bool {
+	return mode == SMTPTLSStartTLS || mode == SMTPTLSImplicit || mode == SMTPTLSNone
+}
+
+// EmailNotifier mails notifications through an SMTP server, one message per
+// restart or, with a digest interval, one message listing every restart
+// since the last one.
+type EmailNotifier struct {
+	Address  string
+	Username string
+	Password string
+	From     string
+	To       []string
+	TLSMode  string
+
+	Templates *Templates
+
+	// Digest batches notifications when positive.
+	Digest  time.Duration
+	mu      sync.Mutex
+	pending []Notification
+}
+
+func (e *EmailNotifier) Notify(n Notification) error {
+	if e.Digest > 0 {
+		e.mu.Lock()
+		e.pending = append(e.pending, n)
+		e.mu.Unlock()
+		return nil
+	}
+	subject := "[cert-watcher] " + n.title()
+	if rendered, ok, err := e.Templates.render(templateEmailSubject, n); ok {
+		if err != nil {
+			return err
+		}
+		subject = strings.TrimSpace(string(rendered))
+	}
+	body := emailBody([]Notification{n})
+	if rendered, ok, err := e.Templates.render(templateEmailBody, n); ok {
+		if err != nil {
+			return err
+		}
+		body = string(rendered)
+	}
+	return e.send(subject, body)
+}
+
+// Run sends a digest every digest interval until stopCh is closed. The
+// restarts run at shutdown are left to a final flush.
+func (e *EmailNotifier) Run(stopCh <-chan struct{}) {
+	wait.Until(e.Flush, e.Digest, stopCh)
+}
+
+// Flush mails the pending notifications, if any.
+func (e *EmailNotifier) Flush() {
+	e.mu.Lock()
+	pending := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	failed := 0
+	for _, n := range pending {
+		if n.failed() {
+			failed++
+		}
+	}
+	subject := fmt.Sprintf("[cert-watcher] %d restarts, %d failed", len(pending), failed)
+	if err := e.send(subject, emailBody(pending)); err != nil {
+		fmt.Printf("Failed to send the notification digest of %d restarts: %v\n", len(pending), err)
+	}
+}
+
+// emailBody renders notifications as a plain text list.
+func emailBody(notifications []Notification) string {
+	var b strings.Builder
+	for i, n := range notifications {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "%s\r\n", n.title())
+		fmt.Fprintf(&b, "  %-20s %s\r\n", "Time", n.Timestamp.Format(time.RFC3339))
+		for _, f := range n.facts() {
+			fmt.Fprintf(&b, "  %-20s %s\r\n", f.name, f.value)
+		}
+	}
+	return b.String()
+}
+
+// send delivers one message to every recipient.
+func (e *EmailNotifier) send(subject, body string) error {
+	host, _, err := net.SplitHostPort(e.Address)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	if e.TLSMode == SMTPTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.Address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", e.Address)
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if e.TLSMode == SMTPTLSStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if e.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", e.Username, e.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(e.From); err != nil {
+		return err
+	}
+	for _, to := range e.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body)
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,52 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// execTimeout bounds how long an ExecNotifier command may run.
+const execTimeout = 30 * time.Second
+
+// ExecNotifier runs a command for every notification, with the notification
+// as JSON on its standard input, or the exec template when there is one. A
+// non-zero exit fails the notification.
+type ExecNotifier struct {
+	Command   []string
+	Templates *Templates
+}
+
+// NewExecNotifier builds an ExecNotifier from a spec holding a command and
+// its arguments separated by spaces.
+func NewExecNotifier(spec string, templates *Templates) (Notifier, error) {
+	command := strings.Fields(spec)
+	if len(command) == 0 {
+		return nil, fmt.Errorf("exec notifier: empty command")
+	}
+	return ExecNotifier{Command: command, Templates: templates}, nil
+}
+
+func (e ExecNotifier) Notify(n Notification) error {
+	input, ok, err := e.Templates.render(templateExec, n)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if input, err = json.Marshal(n); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", e.Command[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTTPNotifier sends the notification as JSON to URL with Method and
+// Header, for endpoints that take something other than the POST of
+// WebhookNotifier. An http template replaces the JSON body.
+type HTTPNotifier struct {
+	Method    string
+	URL       string
+	Header    http.Header
+	Templates *Templates
+}
+
+// NewHTTPNotifier builds an HTTPNotifier from a spec of the form "[METHOD]
+// URL", where METHOD defaults to POST.
+func NewHTTPNotifier(spec string, templates *Templates) (Notifier, error) {
+	h := HTTPNotifier{Method: http.MethodPost, URL: spec, Templates: templates}
+	if method, rest, ok := strings.Cut(spec, " "); ok {
+		h.Method, h.URL = strings.ToUpper(method), strings.TrimSpace(rest)
+	}
+	if u, err := url.Parse(h.URL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("http notifier: invalid URL %q", h.URL)
+	}
+	return h, nil
+}
+
+func (h HTTPNotifier) Notify(n Notification) error {
+	body, ok, err := h.Templates.render(templateHTTP, n)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if body, err = json.Marshal(n); err != nil {
+			return err
+		}
+	}
+	return send(h.Method, h.URL, h.Header, body)
+}
@@ -0,0 +1,209 @@
+// Package notify delivers restart notifications to webhooks, chat services,
+// email and commands. Further sinks are added to its registry with Register.
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Notification describes the outcome of a single restart. It is the
+// JSON payload of the generic webhook sink.
+type Notification struct {
+	Namespace  string `json:"namespace"`
+	SourceKind string `json:"sourceKind"`
+	Source     string `json:"source"`
+	Kind       string `json:"kind"`
+	Deployment string `json:"deployment"`
+	Outcome    string `json:"outcome"`
+	Error      string `json:"error,omitempty"`
+	// Rollout is the result of the rollout that followed the restart, when
+	// it was tracked.
+	Rollout string `json:"rollout,omitempty"`
+	// NotAfter is the expiry of the certificate in the secret that caused
+	// the restart, when it holds one.
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+	Timestamp time.Time  `json:"timestamp"`
+
+	// Secret and Certificate describe the secret that caused the restart
+	// to notification templates.
+	Secret      *SecretInfo      `json:"-"`
+	Certificate *CertificateInfo `json:"-"`
+}
+
+// Outcomes of a Notification.
+const (
+	Succeeded = "Succeeded"
+	Failed    = "Failed"
+	// SourceDeleted is the outcome of the notification sent for a deleted
+	// secret.
+	SourceDeleted = "SourceDeleted"
+)
+
+// text renders the notification as a single human readable line.
+func (n Notification) text() string {
+	if n.Outcome == SourceDeleted {
+		return fmt.Sprintf("%s %s/%s used by %s %s was deleted", n.SourceKind, n.Namespace, n.Source, n.Kind, n.Deployment)
+	}
+	text := fmt.Sprintf("%s %s/%s restart %s after %s %s changed", n.Kind, n.Namespace, n.Deployment, n.Outcome, n.SourceKind, n.Source)
+	if n.Error != "" {
+		text += ": " + n.Error
+	}
+	return text
+}
+
+// title summarises the notification for the heading of a card.
+func (n Notification) title() string {
+	if n.Outcome == SourceDeleted {
+		return fmt.Sprintf("%s %s/%s was deleted", n.SourceKind, n.Namespace, n.Source)
+	}
+	return fmt.Sprintf("%s %s/%s restart %s", n.Kind, n.Namespace, n.Deployment, strings.ToLower(n.Outcome))
+}
+
+// fact is one labelled value of a card.
+type fact struct {
+	name  string
+	value string
+}
+
+// facts lists the details shown on Teams and Discord cards.
+func (n Notification) facts() []fact {
+	facts := []fact{
+		{"Namespace", n.Namespace},
+		{n.SourceKind, n.Source},
+		{"Target", n.Kind + " " + n.Deployment},
+		{"Outcome", n.Outcome},
+	}
+	if n.Rollout != "" {
+		facts = append(facts, fact{"Rollout", n.Rollout})
+	}
+	if n.NotAfter != nil {
+		facts = append(facts, fact{"Certificate expires", n.NotAfter.Format(time.RFC3339)})
+	}
+	if n.Error != "" {
+		facts = append(facts, fact{"Error", n.Error})
+	}
+	return facts
+}
+
+// failed reports whether the notification is about a failure.
+func (n Notification) failed() bool {
+	return n.Outcome == Failed || n.Outcome == SourceDeleted
+}
+
+// Notifier delivers restart notifications to one sink.
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// WebhookNotifier POSTs the notification as JSON to an arbitrary URL.
+type WebhookNotifier struct {
+	URL       string
+	Templates *Templates
+}
+
+func (w WebhookNotifier) Notify(n Notification) error {
+	if body, ok, err := w.Templates.render(templateWebhook, n); ok {
+		return postTemplated(w.URL, body, err)
+	}
+	return PostJSON(w.URL, n)
+}
+
+// SlackNotifier posts to a Slack incoming webhook.
+type SlackNotifier struct {
+	URL       string
+	Templates *Templates
+}
+
+func (s SlackNotifier) Notify(n Notification) error {
+	if body, ok, err := s.Templates.render(templateSlack, n); ok {
+		return postTemplated(s.URL, body, err)
+	}
+	return PostJSON(s.URL, map[string]string{"text": n.text()})
+}
+
+// postTemplated posts a payload rendered by a notification template, unless
+// rendering it failed.
+func postTemplated(url string, body []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	return PostBody(url, nil, body)
+}
+
+// TeamsNotifier posts an Adaptive Card to a Microsoft Teams incoming
+// webhook or Workflows trigger.
+type TeamsNotifier struct {
+	URL       string
+	Templates *Templates
+}
+
+func (t TeamsNotifier) Notify(n Notification) error {
+	if body, ok, err := t.Templates.render(templateTeams, n); ok {
+		return postTemplated(t.URL, body, err)
+	}
+	var facts []map[string]string
+	for _, f := range n.facts() {
+		facts = append(facts, map[string]string{"title": f.name, "value": f.value})
+	}
+	color := "Good"
+	if n.failed() {
+		color = "Attention"
+	}
+	return PostJSON(t.URL, map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]interface{}{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body": []map[string]interface{}{
+					{"type": "TextBlock", "text": n.title(), "weight": "Bolder", "size": "Medium", "color": color, "wrap": true},
+					{"type": "FactSet", "facts": facts},
+				},
+			},
+		}},
+	})
+}
+
+// DiscordNotifier posts an embed to a Discord webhook.
+type DiscordNotifier struct {
+	URL       string
+	Templates *Templates
+}
+
+func (d DiscordNotifier) Notify(n Notification) error {
+	if body, ok, err := d.Templates.render(templateDiscord, n); ok {
+		return postTemplated(d.URL, body, err)
+	}
+	var fields []map[string]interface{}
+	for _, f := range n.facts() {
+		fields = append(fields, map[string]interface{}{"name": f.name, "value": f.value, "inline": f.name != "Error"})
+	}
+	color := 0x2eb67d
+	if n.failed() {
+		color = 0xe01e5a
+	}
+	return PostJSON(d.URL, map[string]interface{}{
+		"username": "cert-watcher",
+		"embeds": []map[string]interface{}{{
+			"title":     n.title(),
+			"color":     color,
+			"fields":    fields,
+			"timestamp": n.Timestamp.Format(time.RFC3339),
+		}},
+	})
+}
+
+// Notifiers fans a notification out to every configured sink.
+type Notifiers []Notifier
+
+func (ns Notifiers) Send(n Notification) {
+	for _, sink := range ns {
+		if err := sink.Notify(n); err != nil {
+			fmt.Printf("Failed to send notification for %s %s/%s: %v\n", n.Kind, n.Namespace, n.Deployment, err)
+		}
+	}
+}
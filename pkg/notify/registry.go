@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"fmt"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory builds a Notifier from the spec given after the name of its sink
+// in -notifier, such as the URL of a webhook. templates is nil unless a
+// notification template file was loaded.
+type Factory func(spec string, templates *Templates) (Notifier, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+func init() {
+	Register("webhook", func(spec string, templates *Templates) (Notifier, error) {
+		return WebhookNotifier{URL: spec, Templates: templates}, nil
+	})
+	Register("slack", func(spec string, templates *Templates) (Notifier, error) {
+		return SlackNotifier{URL: spec, Templates: templates}, nil
+	})
+	Register("teams", func(spec string, templates *Templates) (Notifier, error) {
+		return TeamsNotifier{URL: spec, Templates: templates}, nil
+	})
+	Register("discord", func(spec string, templates *Templates) (Notifier, error) {
+		return DiscordNotifier{URL: spec, Templates: templates}, nil
+	})
+	Register("http", NewHTTPNotifier)
+	Register("exec", NewExecNotifier)
+}
+
+// Register makes the sink name available to New and -notifier. Sinks
+// compiled into a program or loaded with LoadPlugin call it from init.
+// Registering a name twice panics, like registering a Prometheus collector
+// twice.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("notify: sink %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Registered returns the names of the registered sinks, sorted.
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New builds a Notifier of the registered sink name.
+func New(name, spec string, templates *Templates) (Notifier, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown notification sink %q; one of: %s", name, strings.Join(Registered(), ", "))
+	}
+	if spec == "" {
+		return nil, fmt.Errorf("notification sink %s needs a spec", name)
+	}
+	return factory(spec, templates)
+}
+
+// Parse builds a Notifier from a -notifier value of the form name=spec.
+func Parse(value string, templates *Templates) (Notifier, error) {
+	name, spec, ok := strings.Cut(value, "=")
+	if !ok {
+		return nil, fmt.Errorf("notifier %q is not of the form name=spec", value)
+	}
+	return New(strings.TrimSpace(name), strings.TrimSpace(spec), templates)
+}
+
+// LoadPlugin opens the Go plugin at path, whose init functions Register the
+// sinks it provides. The plugin must be built with the same Go version and
+// module versions as cert-watcher.
+func LoadPlugin(path string) error {
+	if _, err := plugin.Open(path); err != nil {
+		return fmt.Errorf("loading notifier plugin %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Names of the templates a notification template file may define. Each
+// replaces the whole payload of its sink; sinks without one keep their
+// built-in format.
+const (
+	templateWebhook      = "webhook"
+	templateSlack        = "slack"
+	templateTeams        = "teams"
+	templateDiscord      = "discord"
+	templateHTTP         = "http"
+	templateExec         = "exec"
+	templateEmailSubject = "email-subject"
+	templateEmailBody    = "email-body"
+)
+
+// SecretInfo is the metadata of the secret behind a notification.
+type SecretInfo struct {
+	Namespace   string
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// CertificateInfo is the leaf certificate of the secret behind a
+// notification, of a secret on the dashboard or of one in a report.
+type CertificateInfo struct {
+	Subject        string    `json:"subject"`
+	CommonName     string    `json:"commonName"`
+	DNSNames       []string  `json:"dnsNames,omitempty"`
+	IPAddresses    []string  `json:"ipAddresses,omitempty"`
+	EmailAddresses []string  `json:"emailAddresses,omitempty"`
+	Issuer         string    `json:"issuer"`
+	SerialNumber   string    `json:"serialNumber"`
+	NotBefore      time.Time `json:"notBefore"`
+	NotAfter       time.Time `json:"notAfter"`
+}
+
+// NewCertificateInfo describes cert.
+func NewCertificateInfo(cert *x509.Certificate) *CertificateInfo {
+	info := &CertificateInfo{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Issuer:         cert.Issuer.String(),
+		SerialNumber:   cert.SerialNumber.String(),
+		NotBefore:      cert.NotBefore.UTC(),
+		NotAfter:       cert.NotAfter.UTC(),
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info
+}
+
+// SANs returns the DNS names, IP addresses and email addresses of cert.
+func (cert *CertificateInfo) SANs() []string {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.IPAddresses...)
+	return append(sans, cert.EmailAddresses...)
+}
+
+// Templates renders notification payloads from user supplied
+// Go templates. A nil *Templates renders nothing.
+type Templates struct {
+	t *template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	// json encodes a value, so that strings can be embedded in JSON
+	// payloads safely.
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": strings.Join,
+	// until is the time left until t, rounded to the minute.
+	"until": func(t time.Time) time.Duration {
+		return time.Until(t).Round(time.Minute)
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// LoadTemplates parses the template definitions in path.
+func LoadTemplates(path string) (*Templates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New(path).Funcs(templateFuncs).Option("missingkey=zero").Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{templateWebhook: true, templateSlack: true, templateTeams: true, templateDiscord: true, templateHTTP: true, templateExec: true, templateEmailSubject: true, templateEmailBody: true, path: true}
+	for _, defined := range t.Templates() {
+		if !known[defined.Name()] {
+			return nil, fmt.Errorf("unknown notification template %q", defined.Name())
+		}
+	}
+	return &Templates{t: t}, nil
+}
+
+// render executes the template name on n. ok is false when no such
+// template is defined.
+func (nt *Templates) render(name string, n Notification) (out []byte, ok bool, err error) {
+	if nt == nil {
+		return nil, false, nil
+	}
+	t := nt.t.Lookup(name)
+	if t == nil {
+		return nil, false, nil
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, n); err != nil {
+		return nil, true, fmt.Errorf("rendering the %s template: %w", name, err)
+	}
+	return b.Bytes(), true, nil
+}
@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Client sends notifications, and every other request cert-watcher makes
+// to a service outside the cluster.
+var Client = &http.Client{Timeout: 10 * time.Second}
+
+// PostJSON sends payload to url as a JSON document and treats any non-2xx
+// response as an error.
+func PostJSON(url string, payload interface{}) error {
+	return PostJSONHeader(url, nil, payload)
+}
+
+// PostJSONHeader is PostJSON with extra request headers, such as
+// credentials.
+func PostJSONHeader(url string, header http.Header, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return PostBody(url, header, body)
+}
+
+// PostBody sends body, a JSON document, to url.
+func PostBody(url string, header http.Header, body []byte) error {
+	return send(http.MethodPost, url, header, body)
+}
+
+// send sends body, a JSON document, to url with method.
+func send(method, url string, header http.Header, body []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package restarter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// checksumsAnnotation records on a workload the dataHash of every secret
+// that restarted it, as a JSON object keyed by secret name. It sits on the
+// workload's own metadata rather than its pod template, so writing it never
+// rolls the pods.
+const checksumsAnnotation = "cert-watcher.io/checksums"
+
+// Checksums returns the checksumsAnnotation of a workload.
+func (r *Restarter) Checksums(ctx context.Context, namespace, kind, name string) (map[string]string, error) {
+	obj, err := r.Workload(ctx, namespace, kind, name)
+	if err != nil {
+		return nil, err
+	}
+	checksums := map[string]string{}
+	if value, ok := obj.GetAnnotations()[checksumsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &checksums); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", checksumsAnnotation, err)
+		}
+	}
+	return checksums, nil
+}
+
+// RecordChecksum stores hash as the checksum of secret in the
+// checksumsAnnotation of a workload. The patch carries the resourceVersion
+// it was computed from, so that two concurrent writers cannot drop each
+// other's checksums.
+func (r *Restarter) RecordChecksum(ctx context.Context, namespace, kind, name, secret, hash string) error {
+	gvr, err := r.Resource(kind)
+	if err != nil {
+		return err
+	}
+	client := r.Dynamic.Resource(gvr).Namespace(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := client.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		checksums := map[string]string{}
+		// A malformed annotation is replaced.
+		_ = json.Unmarshal([]byte(obj.GetAnnotations()[checksumsAnnotation]), &checksums)
+		checksums[secret] = hash
+		value, err := json.Marshal(checksums)
+		if err != nil {
+			return err
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": obj.GetResourceVersion(),
+				"annotations":     map[string]string{checksumsAnnotation: string(value)},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = client.Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+		return err
+	})
+}
@@ -0,0 +1,40 @@
+package restarter
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// EventSource is the component of the Events cert-watcher records, and
+// names it to the services it reports to.
+const EventSource = "cert-watcher"
+
+// Reasons of the Events cert-watcher records.
+const (
+	ReasonRestartScheduled  = "RestartScheduled"
+	ReasonRestarted         = "Restarted"
+	ReasonRestartFailed     = "RestartFailed"
+	ReasonEvictionBlocked   = "EvictionBlocked"
+	ReasonRolloutComplete   = "RolloutComplete"
+	ReasonRolloutFailed     = "RolloutFailed"
+	ReasonRolloutPaused     = "RolloutPaused"
+	ReasonRolledBack        = "RolledBack"
+	ReasonSourceDeleted     = "SourceDeleted"
+	ReasonScaledDown        = "ScaledDown"
+	ReasonRestartDeferred   = "RestartDeferred"
+	ReasonCertificateServed = "CertificateServed"
+	ReasonStaleCertificate  = "StaleCertificate"
+	ReasonHookFailed        = "HookFailed"
+	ReasonRestartDenied     = "RestartDenied"
+)
+
+// NewEventRecorder returns a recorder that writes Kubernetes Events as
+// cert-watcher.
+func NewEventRecorder(clientset kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: EventSource})
+}
@@ -0,0 +1,75 @@
+package restarter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// hookFailedAnnotation is set on a workload whose last hook with the
+// annotate policy failed, and removed once one succeeds.
+const hookFailedAnnotation = "cert-watcher.io/hook-failed"
+
+// Exec runs command in every running pod of the named workload, in
+// container or else the pod's first container, stopping at the first
+// failure.
+func (r *Restarter) Exec(ctx context.Context, namespace, kind, name, container string, command []string) error {
+	pods, err := r.Pods(ctx, namespace, kind, name)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		podContainer := container
+		if podContainer == "" {
+			podContainer = pod.Spec.Containers[0].Name
+		}
+		request := r.Clientset.CoreV1().RESTClient().Post().
+			Resource("pods").Namespace(pod.Namespace).Name(pod.Name).SubResource("exec").
+			VersionedParams(&corev1.PodExecOptions{
+				Container: podContainer,
+				Command:   command,
+				Stdout:    true,
+				Stderr:    true,
+			}, scheme.ParameterCodec)
+		executor, err := remotecommand.NewSPDYExecutor(r.Config, "POST", request.URL())
+		if err != nil {
+			return err
+		}
+		var output bytes.Buffer
+		if err := executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdout: &output, Stderr: &output}); err != nil {
+			return fmt.Errorf("pod %s: %w: %s", pod.Name, err, bytes.TrimSpace(output.Bytes()))
+		}
+	}
+	return nil
+}
+
+// SetHookFailed records err in the hookFailedAnnotation of the named
+// workload, or removes the annotation when err is nil.
+func (r *Restarter) SetHookFailed(ctx context.Context, namespace, kind, name string, err error) {
+	var value interface{}
+	if err != nil {
+		value = err.Error()
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{hookFailedAnnotation: value},
+		},
+	})
+	gvr, resourceErr := r.Resource(kind)
+	if resourceErr != nil {
+		return
+	}
+	if _, patchErr := r.Dynamic.Resource(gvr).Namespace(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager}); patchErr != nil {
+		fmt.Printf("Failed to annotate %s %s: %v\n", kind, name, patchErr)
+	}
+}
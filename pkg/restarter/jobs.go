@@ -0,0 +1,59 @@
+package restarter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// KindJob targets run a Job from the mapping's job template on every
+// rotation, instead of restarting a workload. The mapping's deployment is
+// the prefix of the Jobs' generated names.
+const KindJob = "Job"
+
+// sourceAnnotation records on a hook Job the secret or ConfigMap whose
+// change created it.
+const sourceAnnotation = "cert-watcher.io/source"
+
+// CreateJob creates a Job in namespace from template, with a name generated
+// from prefix, after the source of kind sourceKind changed; checksum is the
+// hash of its data, or empty. The returned error has already been logged and
+// counted, as by Restart.
+func (r *Restarter) CreateJob(ctx context.Context, namespace, prefix string, template *batchv1.JobTemplateSpec, sourceKind, source, checksum string) error {
+	ctx, span := tracer.Start(ctx, "create Job")
+	start := time.Now()
+
+	job := &batchv1.Job{
+		ObjectMeta: *template.ObjectMeta.DeepCopy(),
+		Spec:       *template.Spec.DeepCopy(),
+	}
+	job.Namespace = namespace
+	job.Name = ""
+	job.GenerateName = prefix + "-"
+	if job.Annotations == nil {
+		job.Annotations = map[string]string{}
+	}
+	job.Annotations[sourceAnnotation] = sourceKind + "/" + source
+	if checksum != "" {
+		job.Annotations[checksumAnnotationPrefix+source] = checksum
+	}
+
+	created, err := r.Clientset.BatchV1().Jobs(namespace).Create(ctx, job, metav1.CreateOptions{FieldManager: fieldManager})
+	if err != nil {
+		fmt.Printf("Failed to create Job %s: %v\n", job.GenerateName, err)
+		metrics.RestartCounter.WithLabelValues(namespace, source, prefix, "false").Inc()
+		metrics.RestartDuration.WithLabelValues(KindJob, "false").Observe(time.Since(start).Seconds())
+	} else {
+		fmt.Printf("Job %s/%s created\n", created.Namespace, created.Name)
+		metrics.RestartCounter.WithLabelValues(namespace, source, prefix, "true").Inc()
+		metrics.RestartDuration.WithLabelValues(KindJob, "true").Observe(time.Since(start).Seconds())
+		metrics.LastRestartSuccess.WithLabelValues(namespace, KindJob, prefix).SetToCurrentTime()
+	}
+	endSpan(span, err)
+	return err
+}
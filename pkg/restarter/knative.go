@@ -0,0 +1,16 @@
+package restarter
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// KindKnativeService is a Knative Serving Service. Knative does not roll a
+// revision when a secret it mounts changes, so the watcher stamps the
+// Service's template, which creates a new revision.
+const KindKnativeService = "KnativeService"
+
+// knativeServiceLabel is set by Knative on every pod of a Service.
+const knativeServiceLabel = "serving.knative.dev/service"
+
+// KnativeServicesResource is the API resource of KindKnativeService.
+var KnativeServicesResource = schema.GroupVersionResource{Group: "serving.knative.dev", Version: "v1", Resource: "services"}
@@ -0,0 +1,314 @@
+// Package restarter restarts Kubernetes workloads so that their pods pick up
+// changed secrets and ConfigMaps, and follows the rollouts that follow.
+package restarter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// Workload kinds with built-in support. Other kinds are CustomKinds.
+const (
+	KindDeployment  = "Deployment"
+	KindStatefulSet = "StatefulSet"
+	KindDaemonSet   = "DaemonSet"
+	KindRollout     = "Rollout"
+
+	KindDeploymentConfig = "DeploymentConfig"
+
+	RestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+	// DelayAnnotation lets a workload override the delay of its mappings
+	// with a duration such as 10m.
+	DelayAnnotation = "cert-watcher.io/delay"
+
+	// fieldManager identifies the watcher's writes in managedFields.
+	fieldManager = "cert-watcher"
+)
+
+var (
+	rolloutsResource          = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+	deploymentConfigsResource = schema.GroupVersionResource{Group: "apps.openshift.io", Version: "v1", Resource: "deploymentconfigs"}
+
+	// workloadResources maps every supported kind to its API resource.
+	workloadResources = map[string]schema.GroupVersionResource{
+		KindDeployment:       {Group: "apps", Version: "v1", Resource: "deployments"},
+		KindStatefulSet:      {Group: "apps", Version: "v1", Resource: "statefulsets"},
+		KindDaemonSet:        {Group: "apps", Version: "v1", Resource: "daemonsets"},
+		KindRollout:          rolloutsResource,
+		KindDeploymentConfig: deploymentConfigsResource,
+		KindKnativeService:   KnativeServicesResource,
+		KindJob:              {Group: "batch", Version: "v1", Resource: "jobs"},
+	}
+)
+
+// Restarter rolls workloads through the typed client for built-in kinds and
+// the dynamic client for Argo Rollouts, OpenShift DeploymentConfigs and
+// custom kinds.
+type Restarter struct {
+	Clientset kubernetes.Interface
+	Dynamic   dynamic.Interface
+	// Recorder records Events on restarted workloads.
+	Recorder record.EventRecorder
+	// Config is used to exec into pods for hooks.
+	Config *rest.Config
+
+	// Annotation is the pod template annotation written by the annotation
+	// strategy, and AnnotationValue renders its value from an
+	// annotationData.
+	Annotation      string
+	AnnotationValue *template.Template
+
+	// mapper resolves custom kinds to their API resources.
+	mapper meta.RESTMapper
+}
+
+// New returns a Restarter that writes the default restartedAt annotation.
+// recorder may be nil when no Events are recorded.
+func New(clientset kubernetes.Interface, dynamicClient dynamic.Interface, recorder record.EventRecorder) *Restarter {
+	return &Restarter{
+		Clientset:       clientset,
+		Dynamic:         dynamicClient,
+		Recorder:        recorder,
+		Annotation:      RestartedAtAnnotation,
+		AnnotationValue: template.Must(ParseAnnotationValue(DefaultAnnotationValue)),
+		mapper:          restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(clientset.Discovery())),
+	}
+}
+
+// ValidKind reports whether kind is a workload kind the watcher can restart:
+// a built-in one or a CustomKind.
+func ValidKind(kind string) bool {
+	if _, ok := workloadResources[kind]; ok {
+		return true
+	}
+	_, ok := parseCustomKind(kind)
+	return ok
+}
+
+// CustomKind returns the kind of a mapping that names its workload by
+// apiVersion and kind, in the Kind.version.group form used throughout the
+// watcher. Its group must not be empty.
+func CustomKind(apiVersion, kind string) string {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return kind + "." + apiVersion
+	}
+	return kind + "." + gv.Version + "." + gv.Group
+}
+
+// parseCustomKind is the inverse of CustomKind.
+func parseCustomKind(kind string) (schema.GroupVersionKind, bool) {
+	name, rest, ok := strings.Cut(kind, ".")
+	if !ok {
+		return schema.GroupVersionKind{}, false
+	}
+	version, group, ok := strings.Cut(rest, ".")
+	if !ok || name == "" || version == "" || group == "" {
+		return schema.GroupVersionKind{}, false
+	}
+	return schema.GroupVersionKind{Group: group, Version: version, Kind: name}, true
+}
+
+// kindName returns the Kubernetes kind of a workload kind, without the
+// version and group of a CustomKind.
+func kindName(kind string) string {
+	if kind == KindKnativeService {
+		return "Service"
+	}
+	name, _, _ := strings.Cut(kind, ".")
+	return name
+}
+
+// Resource returns the API resource of a workload kind, looking custom kinds
+// up through API discovery.
+func (r *Restarter) Resource(kind string) (schema.GroupVersionResource, error) {
+	if gvr, ok := workloadResources[kind]; ok {
+		return gvr, nil
+	}
+	gvk, ok := parseCustomKind(kind)
+	if !ok {
+		return schema.GroupVersionResource{}, fmt.Errorf("unsupported kind %q", kind)
+	}
+	mapping, err := r.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	return mapping.Resource, nil
+}
+
+// Workload returns a workload through the dynamic client.
+func (r *Restarter) Workload(ctx context.Context, namespace, kind, name string) (*unstructured.Unstructured, error) {
+	gvr, err := r.Resource(kind)
+	if err != nil {
+		return nil, err
+	}
+	return r.Dynamic.Resource(gvr).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// Reference returns an ObjectReference to a workload. The UID is looked up
+// so that Events recorded against it show up in kubectl describe; if the
+// lookup fails the reference is returned without one.
+func (r *Restarter) Reference(ctx context.Context, namespace, kind, name string) *corev1.ObjectReference {
+	gvr, _ := r.Resource(kind)
+	ref := &corev1.ObjectReference{
+		APIVersion: gvr.GroupVersion().String(),
+		Kind:       kindName(kind),
+		Namespace:  namespace,
+		Name:       name,
+	}
+
+	obj, err := r.Workload(ctx, namespace, kind, name)
+	if err == nil {
+		ref.UID = obj.GetUID()
+		ref.ResourceVersion = obj.GetResourceVersion()
+	}
+	return ref
+}
+
+// AnnotatedDelay returns the delay set by the DelayAnnotation of a workload.
+// A missing workload, annotation or malformed value reports false.
+func (r *Restarter) AnnotatedDelay(ctx context.Context, namespace, kind, name string) (time.Duration, bool) {
+	obj, err := r.Workload(ctx, namespace, kind, name)
+	if err != nil {
+		return 0, false
+	}
+	value, ok := obj.GetAnnotations()[DelayAnnotation]
+	if !ok {
+		return 0, false
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil || delay < 0 {
+		fmt.Printf("Ignoring %s=%q on %s %s/%s: not a non-negative duration\n", DelayAnnotation, value, kind, namespace, name)
+		return 0, false
+	}
+	return delay, true
+}
+
+// Restart replaces the pods of the named workload with the given strategy,
+// which defaults to stamping its pod template with the current time.
+// checksum is passed on to the strategy; see restartStrategy. The returned
+// error has already been logged and counted.
+func (r *Restarter) Restart(ctx context.Context, namespace, secretName, kind, name, strategy, checksum string) error {
+	if strategy == "" {
+		strategy = StrategyAnnotation
+	}
+	ctx, span := tracer.Start(ctx, "restart "+kind, trace.WithAttributes(attribute.String("strategy", strategy)))
+	start := time.Now()
+	retryErr := restartStrategies[strategy].restart(ctx, r, namespace, kind, name, secretName, checksum)
+	if retryErr != nil {
+		fmt.Printf("Failed to update %s %s: %v\n", kind, name, retryErr)
+		metrics.RestartCounter.WithLabelValues(namespace, secretName, name, "false").Inc()
+		metrics.RestartDuration.WithLabelValues(kind, "false").Observe(time.Since(start).Seconds())
+	} else {
+		fmt.Printf("%s %s restarted successfully\n", kind, name)
+		metrics.RestartCounter.WithLabelValues(namespace, secretName, name, "true").Inc()
+		metrics.RestartDuration.WithLabelValues(kind, "true").Observe(time.Since(start).Seconds())
+		metrics.LastRestartSuccess.WithLabelValues(namespace, kind, name).SetToCurrentTime()
+	}
+	endSpan(span, retryErr)
+	return retryErr
+}
+
+// patchTemplateAnnotation sets one annotation on the pod template of a
+// Workload with a strategic merge patch, so that nothing else in the
+// Workload is touched and concurrent writers never conflict.
+func (r *Restarter) patchTemplateAnnotation(ctx context.Context, namespace, kind, name, key, value string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{key: value},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	options := metav1.PatchOptions{FieldManager: fieldManager}
+	switch kind {
+	case KindDeployment:
+		_, err = r.Clientset.AppsV1().Deployments(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, options)
+	case KindStatefulSet:
+		_, err = r.Clientset.AppsV1().StatefulSets(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, options)
+	case KindDaemonSet:
+		_, err = r.Clientset.AppsV1().DaemonSets(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, options)
+	case KindRollout, KindDeploymentConfig:
+		return fmt.Errorf("unsupported kind %q", kind)
+	default:
+		// Custom resources only accept JSON merge patches, which merge
+		// the annotation into the template just the same.
+		var gvr schema.GroupVersionResource
+		if gvr, err = r.Resource(kind); err != nil {
+			return err
+		}
+		_, err = r.Dynamic.Resource(gvr).Namespace(namespace).Patch(ctx, name, types.MergePatchType, patch, options)
+	}
+	return err
+}
+
+// restartRollout sets spec.restartAt on an Argo Rollout, which makes the
+// rollout controller replace its pods while honouring the rollout strategy.
+// Rollouts are custom resources, so a JSON merge patch is used.
+func (r *Restarter) restartRollout(ctx context.Context, namespace, name string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{"restartAt": time.Now().UTC().Format(time.RFC3339)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.Dynamic.Resource(rolloutsResource).Namespace(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+	return err
+}
+
+// instantiateDeploymentConfig asks OpenShift for a new, forced rollout of a
+// DeploymentConfig, the API equivalent of `oc rollout latest`.
+func (r *Restarter) instantiateDeploymentConfig(ctx context.Context, namespace, name string) error {
+	request := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps.openshift.io/v1",
+		"kind":       "DeploymentRequest",
+		"name":       name,
+		"latest":     true,
+		"force":      true,
+	}}
+	_, err := r.Dynamic.Resource(deploymentConfigsResource).Namespace(namespace).Create(ctx, request, metav1.CreateOptions{}, "instantiate")
+	return err
+}
+
+// ScaleDown sets the replicas of a workload to zero through its scale
+// subresource.
+func (r *Restarter) ScaleDown(ctx context.Context, namespace, kind, name string) error {
+	if kind == KindDaemonSet || kind == KindDeploymentConfig || kind == KindKnativeService || kind == KindJob {
+		return fmt.Errorf("%s cannot be scaled", kind)
+	}
+	gvr, err := r.Resource(kind)
+	if err != nil {
+		return err
+	}
+	patch := []byte(`{"spec":{"replicas":0}}`)
+	_, err = r.Dynamic.Resource(gvr).Namespace(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager}, "scale")
+	return err
+}
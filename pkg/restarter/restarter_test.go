@@ -0,0 +1,68 @@
+package restarter
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func newTestRestarter(objects ...runtime.Object) *Restarter {
+	clientset := fake.NewSimpleClientset(objects...)
+	return New(clientset, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), record.NewFakeRecorder(100))
+}
+
+func deployment(namespace, name string) *appsv1.Deployment {
+	return &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+}
+
+func TestRestartAnnotation(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRestarter(deployment("default", "web"))
+
+	if err := r.Restart(ctx, "default", "tls", KindDeployment, "web", "", ""); err != nil {
+		t.Fatalf("Restart: %v", err)
+	}
+
+	d, err := r.Clientset.AppsV1().Deployments("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Spec.Template.Annotations[RestartedAtAnnotation] == "" {
+		t.Errorf("pod template annotations = %v, want %s set", d.Spec.Template.Annotations, RestartedAtAnnotation)
+	}
+}
+
+func TestRestartChecksum(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRestarter(deployment("default", "web"))
+
+	if err := r.Restart(ctx, "default", "tls", KindDeployment, "web", StrategyChecksum, "abc"); err != nil {
+		t.Fatalf("Restart: %v", err)
+	}
+
+	d, err := r.Clientset.AppsV1().Deployments("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Spec.Template.Annotations[checksumAnnotationPrefix+"tls"]; got != "abc" {
+		t.Errorf("checksum annotation = %q, want %q", got, "abc")
+	}
+
+	if err := r.Restart(ctx, "default", "tls", KindDeployment, "web", StrategyChecksum, ""); err == nil {
+		t.Error("Restart without a checksum succeeded")
+	}
+}
+
+func TestRestartMissingWorkload(t *testing.T) {
+	r := newTestRestarter()
+
+	if err := r.Restart(context.Background(), "default", "tls", KindStatefulSet, "db", "", ""); err == nil {
+		t.Error("Restart of a missing StatefulSet succeeded")
+	}
+}
@@ -0,0 +1,206 @@
+package restarter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// RolloutPollInterval is how often WaitForRollout checks workload
+	// status.
+	RolloutPollInterval = 5 * time.Second
+
+	// Actions taken on a Deployment whose rollout failed.
+	RolloutActionPause    = "pause"
+	RolloutActionRollback = "rollback"
+
+	revisionAnnotation = "deployment.kubernetes.io/revision"
+)
+
+// ValidRolloutAction reports whether action is a known rollout failure
+// action.
+func ValidRolloutAction(action string) bool {
+	return action == RolloutActionPause || action == RolloutActionRollback
+}
+
+// RolloutTracked reports whether WaitForRollout can follow rollouts of kind.
+// Argo Rollouts and DeploymentConfigs are left to their own controllers.
+func RolloutTracked(kind string) bool {
+	return kind == KindDeployment || kind == KindStatefulSet || kind == KindDaemonSet
+}
+
+// PauseDeployment stops the Deployment controller from progressing the
+// current rollout any further.
+func (r *Restarter) PauseDeployment(ctx context.Context, namespace, name string) error {
+	patch := []byte(`{"spec":{"paused":true}}`)
+	_, err := r.Clientset.AppsV1().Deployments(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+	return err
+}
+
+// RollbackDeployment restores the pod template of the Deployment's previous
+// revision, like `kubectl rollout undo`, and returns that revision.
+func (r *Restarter) RollbackDeployment(ctx context.Context, namespace, name string) (int64, error) {
+	var revision int64
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		client := r.Clientset.AppsV1().Deployments(namespace)
+		deployment, err := client.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current, _ := strconv.ParseInt(deployment.Annotations[revisionAnnotation], 10, 64)
+
+		selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+		if err != nil {
+			return err
+		}
+		replicaSets, err := r.Clientset.AppsV1().ReplicaSets(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return err
+		}
+		var previous *appsv1.ReplicaSet
+		revision = 0
+		for i := range replicaSets.Items {
+			rs := &replicaSets.Items[i]
+			if !metav1.IsControlledBy(rs, deployment) {
+				continue
+			}
+			v, err := strconv.ParseInt(rs.Annotations[revisionAnnotation], 10, 64)
+			if err == nil && v < current && v > revision {
+				previous, revision = rs, v
+			}
+		}
+		if previous == nil {
+			return fmt.Errorf("no previous revision of Deployment %s", name)
+		}
+
+		template := previous.Spec.Template.DeepCopy()
+		delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+		deployment.Spec.Template = *template
+		_, err = client.Update(ctx, deployment, metav1.UpdateOptions{})
+		return err
+	})
+	return revision, err
+}
+
+// WaitForRollout blocks until the workload has replaced all of its pods with
+// available ones, the rollout fails, or timeout passes. A pod created since
+// the restart started that is in CrashLoopBackOff fails the rollout. Kinds
+// that are not RolloutTracked return immediately.
+func (r *Restarter) WaitForRollout(ctx context.Context, namespace, kind, name string, since time.Time, timeout time.Duration) error {
+	var done func(context.Context) (bool, error)
+	switch kind {
+	case KindDeployment:
+		done = func(ctx context.Context) (bool, error) {
+			deployment, err := r.Clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return DeploymentComplete(deployment)
+		}
+	case KindStatefulSet:
+		done = func(ctx context.Context) (bool, error) {
+			statefulSet, err := r.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return statefulSetComplete(statefulSet), nil
+		}
+	case KindDaemonSet:
+		done = func(ctx context.Context) (bool, error) {
+			daemonSet, err := r.Clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return daemonSetComplete(daemonSet), nil
+		}
+	default:
+		return nil
+	}
+
+	err := wait.PollUntilContextTimeout(ctx, RolloutPollInterval, timeout, false, func(ctx context.Context) (bool, error) {
+		if err := r.crashLooping(ctx, namespace, kind, name, since); err != nil {
+			return false, err
+		}
+		return done(ctx)
+	})
+	if wait.Interrupted(err) {
+		return fmt.Errorf("%s %s did not finish rolling out within %s", kind, name, timeout)
+	}
+	return err
+}
+
+// crashLooping returns an error naming the first pod of the workload created
+// at or after since that has a container in CrashLoopBackOff.
+func (r *Restarter) crashLooping(ctx context.Context, namespace, kind, name string, since time.Time) error {
+	pods, err := r.Pods(ctx, namespace, kind, name)
+	if err != nil {
+		return err
+	}
+	// Creation timestamps have second precision.
+	since = since.Truncate(time.Second)
+	for _, pod := range pods {
+		if pod.CreationTimestamp.Time.Before(since) {
+			continue
+		}
+		for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			if status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff" {
+				return fmt.Errorf("container %s of pod %s is in CrashLoopBackOff", status.Name, pod.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// DeploymentComplete mirrors `kubectl rollout status`: every replica is
+// updated and available, and the controller has seen the latest spec. A
+// rollout that exceeded its progress deadline is a failure.
+func DeploymentComplete(deployment *appsv1.Deployment) (bool, error) {
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		return false, nil
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Status == corev1.ConditionFalse && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, fmt.Errorf("deployment %s exceeded its progress deadline", deployment.Name)
+		}
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	return status.UpdatedReplicas == replicas && status.Replicas == replicas && status.AvailableReplicas == replicas, nil
+}
+
+func statefulSetComplete(statefulSet *appsv1.StatefulSet) bool {
+	if statefulSet.Status.ObservedGeneration < statefulSet.Generation {
+		return false
+	}
+	replicas := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		replicas = *statefulSet.Spec.Replicas
+	}
+	status := statefulSet.Status
+	if status.ReadyReplicas != replicas {
+		return false
+	}
+	if statefulSet.Spec.UpdateStrategy.Type == appsv1.RollingUpdateStatefulSetStrategyType {
+		return status.UpdatedReplicas == replicas && status.UpdateRevision == status.CurrentRevision
+	}
+	return true
+}
+
+func daemonSetComplete(daemonSet *appsv1.DaemonSet) bool {
+	status := daemonSet.Status
+	return status.ObservedGeneration >= daemonSet.Generation &&
+		status.UpdatedNumberScheduled == status.DesiredNumberScheduled &&
+		status.NumberAvailable == status.DesiredNumberScheduled
+}
@@ -0,0 +1,399 @@
+package restarter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// Names of the restart strategies.
+const (
+	StrategyAnnotation = "annotation"
+	StrategyDeletePods = "delete-pods"
+	StrategyEvictPods  = "evict-pods"
+	StrategyScale      = "scale"
+	StrategyChecksum   = "checksum"
+	// StrategyDeleteMountingPods only deletes the pods that consume the
+	// changed source.
+	StrategyDeleteMountingPods = "delete-mounting-pods"
+
+	// DefaultAnnotationValue is the template of the value written by the
+	// annotation strategy unless -restart-annotation-value says otherwise.
+	DefaultAnnotationValue = "{{.Timestamp}}"
+
+	// checksumAnnotationPrefix prefixes the name of the source in the pod
+	// template annotation written by the checksum strategy.
+	checksumAnnotationPrefix = "checksum/"
+
+	// evictionTimeout bounds how long a PodDisruptionBudget may block the
+	// eviction of a single pod before the restart fails.
+	evictionTimeout = 10 * time.Minute
+
+	// scaleDownTimeout bounds how long the scale strategy waits for a
+	// workload to reach zero replicas before scaling it back up.
+	scaleDownTimeout = 5 * time.Minute
+)
+
+// restartStrategy replaces the pods of a workload so that they pick up a
+// changed secret or ConfigMap. source names that secret or ConfigMap and
+// checksum is the dataHash of its watched keys, or empty when it is not
+// known.
+type restartStrategy interface {
+	restart(ctx context.Context, r *Restarter, namespace, kind, name, source, checksum string) error
+}
+
+// restartStrategies maps every strategy name accepted in mappings,
+// CertWatch resources and -restart-strategy to its implementation.
+var restartStrategies = map[string]restartStrategy{
+	StrategyAnnotation: annotationStrategy{},
+	StrategyDeletePods: deletePodsStrategy{},
+	StrategyEvictPods:  evictPodsStrategy{},
+	StrategyScale:      scaleStrategy{},
+	StrategyChecksum:   checksumStrategy{},
+
+	StrategyDeleteMountingPods: deleteMountingPodsStrategy{},
+}
+
+// ValidStrategy reports whether name is a known restart strategy.
+func ValidStrategy(name string) bool {
+	_, ok := restartStrategies[name]
+	return ok
+}
+
+// annotationStrategy stamps the pod template with the current time, like
+// `kubectl rollout restart`, so the workload controller rolls its pods
+// according to its own update strategy. Argo Rollouts and DeploymentConfigs
+// are restarted through their own APIs instead.
+type annotationStrategy struct{}
+
+func (annotationStrategy) restart(ctx context.Context, r *Restarter, namespace, kind, name, source, checksum string) error {
+	var value strings.Builder
+	data := annotationData{Secret: source, Hash: checksum, Timestamp: time.Now().Format(time.RFC3339)}
+	if err := r.AnnotationValue.Execute(&value, data); err != nil {
+		return fmt.Errorf("rendering the %s annotation: %w", r.Annotation, err)
+	}
+
+	switch kind {
+	case KindRollout:
+		return r.restartRollout(ctx, namespace, name)
+	case KindDeploymentConfig:
+		return r.instantiateDeploymentConfig(ctx, namespace, name)
+	}
+	// Change the annotation to force the workload to rollout
+	return r.patchTemplateAnnotation(ctx, namespace, kind, name, r.Annotation, value.String())
+}
+
+// annotationData is what the -restart-annotation-value template can refer
+// to.
+type annotationData struct {
+	// Secret is the name of the changed secret or ConfigMap.
+	Secret string
+	// Hash is the dataHash of its watched keys, if known.
+	Hash string
+	// Timestamp is the time of the restart in RFC 3339 format.
+	Timestamp string
+}
+
+// ParseAnnotationValue parses a template for the value of the annotation
+// strategy's annotation and checks that it renders.
+func ParseAnnotationValue(text string) (*template.Template, error) {
+	tmpl, err := template.New("annotation").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, annotationData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// checksumStrategy writes the checksum of the changed source into the pod
+// template as checksum/<source>, like the checksum annotations of Helm
+// charts. Unlike a timestamp it is idempotent: applying the same checksum
+// again leaves the template unchanged and rolls nothing. Only kinds with a
+// plain pod template are supported.
+type checksumStrategy struct{}
+
+func (checksumStrategy) restart(ctx context.Context, r *Restarter, namespace, kind, name, source, checksum string) error {
+	if checksum == "" {
+		return fmt.Errorf("the %s strategy found no checksum for %s", StrategyChecksum, source)
+	}
+	if kind == KindRollout || kind == KindDeploymentConfig {
+		return fmt.Errorf("the %s strategy does not support %s", StrategyChecksum, kind)
+	}
+	return r.patchTemplateAnnotation(ctx, namespace, kind, name, checksumAnnotationPrefix+source, checksum)
+}
+
+// deletePodsStrategy deletes the workload's pods one by one and leaves it
+// to the controller to recreate them. The pod template is left untouched.
+type deletePodsStrategy struct{}
+
+func (deletePodsStrategy) restart(ctx context.Context, r *Restarter, namespace, kind, name, source, checksum string) error {
+	pods, err := r.Pods(ctx, namespace, kind, name)
+	if err != nil {
+		return err
+	}
+	return r.deletePods(ctx, namespace, pods)
+}
+
+// deleteMountingPodsStrategy is deletePodsStrategy limited to the pods whose
+// own spec consumes the changed secret or ConfigMap. Pods of the workload
+// that do not, such as ones created from another template while a rollout
+// or a canary is in progress, keep running.
+type deleteMountingPodsStrategy struct{}
+
+func (deleteMountingPodsStrategy) restart(ctx context.Context, r *Restarter, namespace, kind, name, source, checksum string) error {
+	pods, err := r.Pods(ctx, namespace, kind, name)
+	if err != nil {
+		return err
+	}
+	var mounting []corev1.Pod
+	for _, pod := range pods {
+		if PodSpecReferences(&pod.Spec, source) || PodSpecReferencesConfigMap(&pod.Spec, source) {
+			mounting = append(mounting, pod)
+		}
+	}
+	if len(mounting) == 0 {
+		fmt.Printf("No pod of %s %s consumes %s, nothing to restart\n", kind, name, source)
+		return nil
+	}
+	return r.deletePods(ctx, namespace, mounting)
+}
+
+// deletePods deletes pods one by one; pods that are already gone are
+// skipped.
+func (r *Restarter) deletePods(ctx context.Context, namespace string, pods []corev1.Pod) error {
+	for _, pod := range pods {
+		err := r.Clientset.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting pod %s: %w", pod.Name, err)
+		}
+	}
+	return nil
+}
+
+// evictPodsStrategy evicts the workload's pods one at a time through the
+// Eviction API, so that PodDisruptionBudgets are honoured. An eviction
+// refused by a budget is retried until evictionTimeout; every refusal is
+// counted and the first one per pod is recorded as an Event.
+type evictPodsStrategy struct{}
+
+func (evictPodsStrategy) restart(ctx context.Context, r *Restarter, namespace, kind, name, source, checksum string) error {
+	pods, err := r.Pods(ctx, namespace, kind, name)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		eviction := &policyv1.Eviction{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: pod.Name}}
+		blocked := false
+		err := wait.PollUntilContextTimeout(ctx, 5*time.Second, evictionTimeout, true, func(ctx context.Context) (bool, error) {
+			err := r.Clientset.CoreV1().Pods(namespace).EvictV1(ctx, eviction)
+			switch {
+			case err == nil, apierrors.IsNotFound(err):
+				return true, nil
+			case apierrors.IsTooManyRequests(err):
+				metrics.EvictionsBlocked.WithLabelValues(namespace, kind, name).Inc()
+				if !blocked {
+					blocked = true
+					fmt.Printf("Eviction of pod %s/%s blocked by a disruption budget, retrying: %v\n", namespace, pod.Name, err)
+					r.Recorder.Eventf(r.Reference(ctx, namespace, kind, name), corev1.EventTypeWarning, ReasonEvictionBlocked, "Eviction of pod %s blocked: %v", pod.Name, err)
+				}
+				return false, nil
+			}
+			return false, err
+		})
+		if err != nil {
+			return fmt.Errorf("evicting pod %s: %w", pod.Name, err)
+		}
+	}
+	return nil
+}
+
+// scaleStrategy scales the workload to zero, waits for its pods to go away
+// and scales it back to its previous size. It causes downtime and suits
+// workloads that cannot run old and new pods side by side. Only kinds with
+// a scale subresource are supported.
+type scaleStrategy struct{}
+
+func (scaleStrategy) restart(ctx context.Context, r *Restarter, namespace, kind, name, source, checksum string) error {
+	if kind == KindDaemonSet || kind == KindDeploymentConfig || kind == KindKnativeService {
+		return fmt.Errorf("the %s strategy does not support %s", StrategyScale, kind)
+	}
+	gvr, err := r.Resource(kind)
+	if err != nil {
+		return err
+	}
+	client := r.Dynamic.Resource(gvr).Namespace(namespace)
+
+	var replicas int64
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		scale, err := client.Get(ctx, name, metav1.GetOptions{}, "scale")
+		if err != nil {
+			return err
+		}
+		replicas, _, _ = unstructured.NestedInt64(scale.Object, "spec", "replicas")
+		if err := unstructured.SetNestedField(scale.Object, int64(0), "spec", "replicas"); err != nil {
+			return err
+		}
+		_, err = client.Update(ctx, scale, metav1.UpdateOptions{}, "scale")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("scaling down: %w", err)
+	}
+	if replicas == 0 {
+		return nil
+	}
+
+	waitErr := wait.PollUntilContextTimeout(ctx, 2*time.Second, scaleDownTimeout, true, func(ctx context.Context) (bool, error) {
+		scale, err := client.Get(ctx, name, metav1.GetOptions{}, "scale")
+		if err != nil {
+			return false, err
+		}
+		current, _, _ := unstructured.NestedInt64(scale.Object, "status", "replicas")
+		return current == 0, nil
+	})
+
+	// Scale back up even if waiting failed or ctx was cancelled, so a slow
+	// shutdown never leaves the workload at zero.
+	upCtx := context.WithoutCancel(ctx)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		scale, err := client.Get(upCtx, name, metav1.GetOptions{}, "scale")
+		if err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedField(scale.Object, replicas, "spec", "replicas"); err != nil {
+			return err
+		}
+		_, err = client.Update(upCtx, scale, metav1.UpdateOptions{}, "scale")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("scaling back to %d replicas: %w", replicas, err)
+	}
+	if waitErr != nil {
+		return fmt.Errorf("waiting for pods to terminate: %w", waitErr)
+	}
+	return nil
+}
+
+// Pods returns the pods selected by a workload's spec.selector, which is a
+// label selector for every kind but DeploymentConfig, where it is a plain
+// label map. Knative Services have no selector; their pods carry the
+// knativeServiceLabel.
+func (r *Restarter) Pods(ctx context.Context, namespace, kind, name string) ([]corev1.Pod, error) {
+	obj, err := r.Workload(ctx, namespace, kind, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var selector labels.Selector
+	if kind == KindKnativeService {
+		selector = labels.SelectorFromSet(labels.Set{knativeServiceLabel: name})
+	} else if kind == KindDeploymentConfig {
+		set, _, err := unstructured.NestedStringMap(obj.Object, "spec", "selector")
+		if err != nil {
+			return nil, err
+		}
+		selector = labels.SelectorFromSet(set)
+	} else {
+		raw, _, err := unstructured.NestedMap(obj.Object, "spec", "selector")
+		if err != nil {
+			return nil, err
+		}
+		var labelSelector metav1.LabelSelector
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &labelSelector); err != nil {
+			return nil, err
+		}
+		if selector, err = metav1.LabelSelectorAsSelector(&labelSelector); err != nil {
+			return nil, err
+		}
+	}
+	if selector.Empty() {
+		return nil, fmt.Errorf("%s %s has no pod selector", kind, name)
+	}
+
+	list, err := r.Clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// PodSpecReferences reports whether spec consumes the named secret through a
+// volume, envFrom or an env var in any of its containers.
+func PodSpecReferences(spec *corev1.PodSpec, name string) bool {
+	for _, v := range spec.Volumes {
+		if v.Secret != nil && v.Secret.SecretName == name {
+			return true
+		}
+		if v.Projected != nil {
+			for _, source := range v.Projected.Sources {
+				if source.Secret != nil && source.Secret.Name == name {
+					return true
+				}
+			}
+		}
+	}
+
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, from := range c.EnvFrom {
+			if from.SecretRef != nil && from.SecretRef.Name == name {
+				return true
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PodSpecReferencesConfigMap is PodSpecReferences for ConfigMaps.
+func PodSpecReferencesConfigMap(spec *corev1.PodSpec, name string) bool {
+	for _, v := range spec.Volumes {
+		if v.ConfigMap != nil && v.ConfigMap.Name == name {
+			return true
+		}
+		if v.Projected != nil {
+			for _, source := range v.Projected.Sources {
+				if source.ConfigMap != nil && source.ConfigMap.Name == name {
+					return true
+				}
+			}
+		}
+	}
+
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, from := range c.EnvFrom {
+			if from.ConfigMapRef != nil && from.ConfigMapRef.Name == name {
+				return true
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.ConfigMapKeyRef != nil && env.ValueFrom.ConfigMapKeyRef.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
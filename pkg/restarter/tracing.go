@@ -0,0 +1,19 @@
+package restarter
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is the tracer of cert-watcher, whose spans the restarter adds to.
+var tracer = otel.Tracer("github.com/andreistefanzx/cert-watcher")
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,227 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// restartResult is the outcome of the latest restart of a target, including
+// its rollout.
+type restartResult struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// targetStatus describes a mapping's target for the admin API.
+type targetStatus struct {
+	Mapping Mapping `json:"mapping"`
+	Paused  bool    `json:"paused"`
+	// PendingUntil is when a scheduled restart is due.
+	PendingUntil *time.Time `json:"pendingUntil,omitempty"`
+	// Deferred is why a due restart is held back; see deferral.
+	Deferred    string         `json:"deferred,omitempty"`
+	LastRestart *time.Time     `json:"lastRestart,omitempty"`
+	LastResult  *restartResult `json:"lastResult,omitempty"`
+}
+
+// AdminAPI serves the admin endpoints, which list the watched mappings and
+// the state of their targets, pause and resume targets, or every restart,
+// restart targets on demand, and retry or discard dead letters. Every request
+// must carry a bearer token of a user that RBAC allows to use the endpoint;
+// see TokenReviewAuth. Requests that change anything are refused with 503 on
+// leader election followers.
+type AdminAPI struct {
+	Watcher *Watcher
+}
+
+func (a *AdminAPI) Handler(clientset kubernetes.Interface) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/mappings", a.mappings)
+	mux.HandleFunc("GET /api/v1/targets", a.targets)
+	mux.HandleFunc("GET /api/v1/history", a.history)
+	mux.HandleFunc("GET /api/v1/events", a.events)
+	mux.HandleFunc("GET /api/v1/pause", a.globalPause)
+	mux.HandleFunc("POST /api/v1/pause", a.Watcher.leaderOnly(a.pauseAll))
+	mux.HandleFunc("POST /api/v1/resume", a.Watcher.leaderOnly(a.resumeAll))
+	mux.HandleFunc("POST /api/v1/targets/{namespace}/{kind}/{name}/pause", a.Watcher.leaderOnly(a.pause))
+	mux.HandleFunc("POST /api/v1/targets/{namespace}/{kind}/{name}/resume", a.Watcher.leaderOnly(a.resume))
+	mux.HandleFunc("POST /api/v1/targets/{namespace}/{kind}/{name}/restart", a.Watcher.leaderOnly(a.restart))
+	mux.HandleFunc("GET /api/v1/dead-letters", a.deadLetters)
+	mux.HandleFunc("POST /api/v1/dead-letters/{namespace}/{kind}/{name}/retry", a.Watcher.leaderOnly(a.retryDeadLetter))
+	mux.HandleFunc("DELETE /api/v1/dead-letters/{namespace}/{kind}/{name}", a.Watcher.leaderOnly(a.discardDeadLetter))
+	return TokenReviewAuth(clientset, mux)
+}
+
+func (a *AdminAPI) mappings(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, a.Watcher.currentMappings())
+}
+
+func (a *AdminAPI) targets(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, a.Watcher.targetStatuses())
+}
+
+// history returns the restart history, filtered as ParseHistoryFilter
+// describes.
+func (a *AdminAPI) history(rw http.ResponseWriter, r *http.Request) {
+	filter, err := ParseHistoryFilter(r.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(rw, http.StatusOK, a.Watcher.History.query(filter))
+}
+
+// events streams rotation and restart records as Server-Sent Events; see
+// EventStream.serve.
+func (a *AdminAPI) events(rw http.ResponseWriter, r *http.Request) {
+	a.Watcher.Stream.serve(rw, r, a.Watcher.History)
+}
+
+// globalPause reports whether every restart is paused, and by whom.
+func (a *AdminAPI) globalPause(rw http.ResponseWriter, r *http.Request) {
+	by := a.Watcher.pausedBy()
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"paused": len(by) > 0, "pausedBy": by})
+}
+
+// pauseAll pauses every restart until resumeAll. A pause held by the pause
+// ConfigMap is not lifted by resumeAll.
+func (a *AdminAPI) pauseAll(rw http.ResponseWriter, r *http.Request) {
+	a.Watcher.SetGlobalPause(pauseByAdminAPI, true)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) resumeAll(rw http.ResponseWriter, r *http.Request) {
+	a.Watcher.SetGlobalPause(pauseByAdminAPI, false)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) pause(rw http.ResponseWriter, r *http.Request) {
+	a.setPaused(rw, r, true)
+}
+
+func (a *AdminAPI) resume(rw http.ResponseWriter, r *http.Request) {
+	a.setPaused(rw, r, false)
+}
+
+func (a *AdminAPI) setPaused(rw http.ResponseWriter, r *http.Request, paused bool) {
+	m, ok := a.mapping(rw, r)
+	if !ok {
+		return
+	}
+	a.Watcher.setPaused(m.targetKey(), paused)
+	if paused {
+		fmt.Printf("Paused restarts of %s %s %s\n", m.Namespace, m.Kind, m.Deployment)
+	} else {
+		fmt.Printf("Resumed restarts of %s %s %s\n", m.Namespace, m.Kind, m.Deployment)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// restart schedules an immediate restart of the target. Cooldowns, restart
+// windows and pauses still apply.
+func (a *AdminAPI) restart(rw http.ResponseWriter, r *http.Request) {
+	m, ok := a.mapping(rw, r)
+	if !ok {
+		return
+	}
+	fmt.Printf("Restart of %s %s %s requested through the admin API\n", m.Namespace, m.Kind, m.Deployment)
+	m.Delay = &metav1.Duration{}
+	m.fixedDelay = true
+	a.Watcher.Trigger(nil, []Mapping{m})
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func (a *AdminAPI) deadLetters(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, a.Watcher.deadLetterList())
+}
+
+// retryDeadLetter schedules the parked restart of the target again, right
+// away; cooldowns, restart windows and pauses still apply.
+func (a *AdminAPI) retryDeadLetter(rw http.ResponseWriter, r *http.Request) {
+	key := requestTargetKey(r)
+	if !a.Watcher.retryDeadLetter(key) {
+		http.Error(rw, fmt.Sprintf("no dead letter for %s", key), http.StatusNotFound)
+		return
+	}
+	fmt.Printf("Retrying the dead letter of %s through the admin API\n", key)
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func (a *AdminAPI) discardDeadLetter(rw http.ResponseWriter, r *http.Request) {
+	key := requestTargetKey(r)
+	if !a.Watcher.discardDeadLetter(key) {
+		http.Error(rw, fmt.Sprintf("no dead letter for %s", key), http.StatusNotFound)
+		return
+	}
+	fmt.Printf("Discarded the dead letter of %s through the admin API\n", key)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// mapping returns the first mapping whose target the request names, or
+// responds with 404.
+func (a *AdminAPI) mapping(rw http.ResponseWriter, r *http.Request) (Mapping, bool) {
+	key := requestTargetKey(r)
+	for _, m := range a.Watcher.currentMappings() {
+		if m.targetKey() == key {
+			return m, true
+		}
+	}
+	http.Error(rw, fmt.Sprintf("no mapping targets %s", key), http.StatusNotFound)
+	return Mapping{}, false
+}
+
+// requestTargetKey returns the key of the target the request names.
+func requestTargetKey(r *http.Request) string {
+	return r.PathValue("namespace") + "/" + r.PathValue("kind") + "/" + r.PathValue("name")
+}
+
+func writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(value); err != nil {
+		fmt.Printf("Failed to write response: %v\n", err)
+	}
+}
+
+// setPaused pauses or resumes restarts of the target with key. Changes to a
+// paused target's sources are still scheduled, and run once it is resumed.
+func (w *Watcher) setPaused(key string, paused bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if paused {
+		w.paused[key] = true
+	} else {
+		delete(w.paused, key)
+	}
+}
+
+// targetStatuses returns the state of the target of every current mapping.
+func (w *Watcher) targetStatuses() []targetStatus {
+	mappings := w.currentMappings()
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	var statuses []targetStatus
+	for _, m := range mappings {
+		key := m.targetKey()
+		status := targetStatus{Mapping: m, Paused: w.paused[key]}
+		if p, ok := w.pending[key]; ok {
+			due := p.due
+			status.PendingUntil = &due
+			status.Deferred = p.deferred
+		}
+		if last, ok := w.lastRestart[key]; ok {
+			status.LastRestart = &last
+		}
+		if result, ok := w.results[key]; ok {
+			status.LastResult = &result
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,118 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+)
+
+// Decisions recorded in the audit log.
+const (
+	auditReceived  = "received"
+	auditSkipped   = "skipped"
+	auditScheduled = "scheduled"
+	auditDeferred  = "deferred"
+	auditExecuted  = "executed"
+	auditFailed    = "failed"
+)
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time       time.Time  `json:"time"`
+	Decision   string     `json:"decision"`
+	Namespace  string     `json:"namespace"`
+	SourceKind string     `json:"sourceKind"`
+	Source     string     `json:"source"`
+	Kind       string     `json:"kind,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	Due        *time.Time `json:"due,omitempty"`
+	Rollout    string     `json:"rollout,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// AuditLog appends a JSON line for every decision the watcher takes about a
+// source change to a file or stdout. A nil *AuditLog records nothing.
+type AuditLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewAuditLog opens path for appending, or writes to stdout when path is
+// "-".
+func NewAuditLog(path string) (*AuditLog, error) {
+	if path == "-" {
+		return &AuditLog{out: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{out: file}, nil
+}
+
+func (a *AuditLog) write(r auditRecord) {
+	if a == nil {
+		return
+	}
+	r.Time = time.Now().UTC()
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// One write per record, so that lines never interleave.
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		fmt.Printf("Failed to write the audit log: %v\n", err)
+	}
+}
+
+// received records a change to a watched source.
+func (a *AuditLog) received(namespace, sourceKind, source string) {
+	a.write(auditRecord{Decision: auditReceived, Namespace: namespace, SourceKind: sourceKind, Source: source})
+}
+
+// skipped records a change that restarts none of the source's targets.
+func (a *AuditLog) skipped(namespace, sourceKind, source, reason string) {
+	a.write(auditRecord{Decision: auditSkipped, Namespace: namespace, SourceKind: sourceKind, Source: source, Reason: reason})
+}
+
+// targetSkipped records a restart of m that will not run.
+func (a *AuditLog) targetSkipped(m Mapping, reason string) {
+	a.write(auditRecord{Decision: auditSkipped, Namespace: m.Namespace, SourceKind: m.sourceKind(), Source: m.sourceName(), Kind: m.Kind, Name: m.Deployment, Reason: reason})
+}
+
+// scheduled records a restart of m due at due.
+func (a *AuditLog) scheduled(m Mapping, due time.Time) {
+	due = due.UTC()
+	a.write(auditRecord{Decision: auditScheduled, Namespace: m.Namespace, SourceKind: m.sourceKind(), Source: m.sourceName(), Kind: m.Kind, Name: m.Deployment, Due: &due})
+}
+
+// deferred records a due restart of m held back for reason.
+func (a *AuditLog) deferred(m Mapping, reason string) {
+	a.write(auditRecord{Decision: auditDeferred, Namespace: m.Namespace, SourceKind: m.sourceKind(), Source: m.sourceName(), Kind: m.Kind, Name: m.Deployment, Reason: reason})
+}
+
+// restarted records n, the outcome of a restart.
+func (a *AuditLog) restarted(n notify.Notification) {
+	decision := auditExecuted
+	if n.Outcome == notify.Failed {
+		decision = auditFailed
+	}
+	a.write(auditRecord{
+		Decision:   decision,
+		Namespace:  n.Namespace,
+		SourceKind: n.SourceKind,
+		Source:     n.Source,
+		Kind:       n.Kind,
+		Name:       n.Deployment,
+		Rollout:    n.Rollout,
+		Error:      n.Error,
+	})
+}
@@ -0,0 +1,85 @@
+package watcher
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// TokenReviewAuth only lets requests through whose bearer token the API
+// server accepts in a TokenReview, and whose user a SubjectAccessReview then
+// allows to use the request's path with the verb of its method, as
+// kube-rbac-proxy does for non-resource URLs. Access is therefore granted
+// with RBAC nonResourceURLs rules, such as get on /metrics.
+func TokenReviewAuth(clientset kubernetes.Interface, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			http.Error(rw, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		review, err := clientset.AuthenticationV1().TokenReviews().Create(r.Context(), &authenticationv1.TokenReview{
+			Spec: authenticationv1.TokenReviewSpec{Token: token},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			fmt.Printf("TokenReview failed: %v\n", err)
+			http.Error(rw, "token review failed", http.StatusInternalServerError)
+			return
+		}
+		if !review.Status.Authenticated {
+			http.Error(rw, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		user := review.Status.User
+		extra := map[string]authorizationv1.ExtraValue{}
+		for key, values := range user.Extra {
+			extra[key] = authorizationv1.ExtraValue(values)
+		}
+		access, err := clientset.AuthorizationV1().SubjectAccessReviews().Create(r.Context(), &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:   user.Username,
+				UID:    user.UID,
+				Groups: user.Groups,
+				Extra:  extra,
+				NonResourceAttributes: &authorizationv1.NonResourceAttributes{
+					Path: r.URL.Path,
+					Verb: requestVerb(r.Method),
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			fmt.Printf("SubjectAccessReview failed: %v\n", err)
+			http.Error(rw, "access review failed", http.StatusInternalServerError)
+			return
+		}
+		if !access.Status.Allowed {
+			http.Error(rw, fmt.Sprintf("%s may not %s %s", user.Username, requestVerb(r.Method), r.URL.Path), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// requestVerb maps an HTTP method to the Kubernetes verb the API server
+// authorizes it as.
+func requestVerb(method string) string {
+	switch method {
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut:
+		return "update"
+	case http.MethodPatch:
+		return "patch"
+	case http.MethodDelete:
+		return "delete"
+	default:
+		return "get"
+	}
+}
@@ -0,0 +1,61 @@
+package watcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestTokenReviewAuth(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		switch review.Spec.Token {
+		case "admin":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "admin"}}
+		case "pod":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "system:serviceaccount:default:default"}}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attributes := review.Spec.NonResourceAttributes
+		review.Status.Allowed = review.Spec.User == "admin" && attributes.Path == "/api/v1/pause" && attributes.Verb == "create"
+		return true, review, nil
+	})
+	handler := TokenReviewAuth(clientset, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, test := range []struct {
+		name   string
+		token  string
+		method string
+		want   int
+	}{
+		{"no token", "", http.MethodPost, http.StatusUnauthorized},
+		{"unauthenticated", "forged", http.MethodPost, http.StatusUnauthorized},
+		{"authenticated but not authorized", "pod", http.MethodPost, http.StatusForbidden},
+		{"authorized", "admin", http.MethodPost, http.StatusNoContent},
+		{"other verb", "admin", http.MethodGet, http.StatusForbidden},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/api/v1/pause", nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, r)
+			if rw.Code != test.want {
+				t.Errorf("status = %d, want %d", rw.Code, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// AWSSecretSource polls an AWS Secrets Manager secret, given by name or ARN,
+// for a new AWSCURRENT version.
+type AWSSecretSource struct {
+	Client *secretsmanager.Client
+	ID     string
+}
+
+// version returns the id of the version currently staged as AWSCURRENT,
+// which changes on every rotation.
+func (s AWSSecretSource) version(ctx context.Context) (string, error) {
+	out, err := s.Client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(s.ID)})
+	if err != nil {
+		return "", err
+	}
+	for version, stages := range out.VersionIdsToStages {
+		if slices.Contains(stages, "AWSCURRENT") {
+			return version, nil
+		}
+	}
+	return "", fmt.Errorf("secret %s has no AWSCURRENT version", s.ID)
+}
+
+// ACMSource polls an ACM certificate, given by ARN, for renewal or
+// re-import.
+type ACMSource struct {
+	Client *acm.Client
+	ARN    string
+}
+
+// version returns the certificate's serial number, which changes when ACM
+// renews it or a new certificate is imported under the same ARN.
+func (s ACMSource) version(ctx context.Context) (string, error) {
+	out, err := s.Client.DescribeCertificate(ctx, &acm.DescribeCertificateInput{CertificateArn: aws.String(s.ARN)})
+	if err != nil {
+		return "", err
+	}
+	if out.Certificate == nil || out.Certificate.Serial == nil {
+		return "", fmt.Errorf("certificate %s has not been issued", s.ARN)
+	}
+	return *out.Certificate.Serial, nil
+}
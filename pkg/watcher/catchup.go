@@ -0,0 +1,57 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// CatchUp restarts the targets of every watched secret whose hash differs
+// from the one recorded on the target by its last restart, which means the
+// secret changed while the watcher was down. Targets with no recorded hash
+// only have the current one recorded.
+func (w *Watcher) CatchUp() {
+	for _, secret := range w.watchedSecrets() {
+		_, deployments := w.cachedSecret(secret.Namespace, secret.Name)
+		hash := dataHash(secret.Data)
+
+		var changed []Mapping
+		for _, m := range w.targetsFor(secret, deployments) {
+			if m.Job != nil {
+				continue
+			}
+			checksums, err := w.restarter.Checksums(w.ctx, m.Namespace, m.Kind, m.Deployment)
+			if err != nil {
+				fmt.Printf("Failed to read the checksums of %s %s: %v\n", m.Kind, m.Deployment, err)
+				continue
+			}
+			recorded, ok := checksums[secret.Name]
+			switch {
+			case !ok:
+				if err := w.restarter.RecordChecksum(w.ctx, m.Namespace, m.Kind, m.Deployment, secret.Name, hash); err != nil {
+					fmt.Printf("Failed to record the checksum of secret %s on %s %s: %v\n", secret.Name, m.Kind, m.Deployment, err)
+				}
+			case recorded != hash:
+				changed = append(changed, m)
+			}
+		}
+		if len(changed) > 0 {
+			fmt.Printf("Secret %s/%s changed since its workloads were last restarted, catching up\n", secret.Namespace, secret.Name)
+			w.triggerValid(secret, w.policyAllowed(secret, nil, secret.Data, changed))
+		}
+	}
+}
+
+// recordRestartChecksum records the hash of the secret that caused a
+// successful restart on the restarted workload.
+func (w *Watcher) recordRestartChecksum(ctx context.Context, m Mapping, source runtime.Object) {
+	secret, ok := source.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	if err := w.restarter.RecordChecksum(ctx, m.Namespace, m.Kind, m.Deployment, secret.Name, dataHash(secret.Data)); err != nil {
+		fmt.Printf("Failed to record the checksum of secret %s on %s %s: %v\n", secret.Name, m.Kind, m.Deployment, err)
+	}
+}
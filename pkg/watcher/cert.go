@@ -0,0 +1,154 @@
+package watcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// caCertKey is the data key cert-manager uses for the issuing CA.
+const caCertKey = "ca.crt"
+
+// What makes a change of a secret a renewal, as -change-detection says: any
+// change of its data, or a new serial number or fingerprint of its leaf
+// certificate.
+const (
+	ChangeDetectionData        = "data"
+	ChangeDetectionSerial      = "serial"
+	ChangeDetectionFingerprint = "fingerprint"
+)
+
+// ValidChangeDetection reports whether mode is a known -change-detection
+// mode.
+func ValidChangeDetection(mode string) bool {
+	switch mode {
+	case ChangeDetectionData, ChangeDetectionSerial, ChangeDetectionFingerprint:
+		return true
+	}
+	return false
+}
+
+// ParseCertificate returns the first certificate in a PEM bundle, which for
+// kubernetes.io/tls secrets is the leaf.
+func ParseCertificate(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM encoded certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// observeCertificate exports the validity window of the secret's tls.crt.
+// Secrets without a parseable certificate have their series removed.
+func observeCertificate(secret *corev1.Secret) {
+	data, ok := secret.Data[corev1.TLSCertKey]
+	if !ok {
+		forgetCertificate(secret.Namespace, secret.Name)
+		return
+	}
+
+	cert, err := ParseCertificate(data)
+	if err != nil {
+		fmt.Printf("Failed to parse %s in secret %s/%s: %v\n", corev1.TLSCertKey, secret.Namespace, secret.Name, err)
+		forgetCertificate(secret.Namespace, secret.Name)
+		return
+	}
+
+	metrics.CertificateExpiry.WithLabelValues(secret.Namespace, secret.Name).Set(float64(cert.NotAfter.Unix()))
+	metrics.CertificateNotBefore.WithLabelValues(secret.Namespace, secret.Name).Set(float64(cert.NotBefore.Unix()))
+}
+
+func forgetCertificate(namespace, name string) {
+	metrics.CertificateExpiry.DeleteLabelValues(namespace, name)
+	metrics.CertificateNotBefore.DeleteLabelValues(namespace, name)
+	metrics.CertificateExpiring.DeleteLabelValues(namespace, name)
+}
+
+// ValidateCertificate checks that a secret holds a certificate that is valid
+// right now and matches its private key. With verifyChain it also requires
+// the certificate to chain to the secret's ca.crt, when one is present.
+func ValidateCertificate(secret *corev1.Secret, verifyChain bool) error {
+	certPEM, ok := secret.Data[corev1.TLSCertKey]
+	if !ok {
+		return fmt.Errorf("missing %s", corev1.TLSCertKey)
+	}
+	keyPEM, ok := secret.Data[corev1.TLSPrivateKeyKey]
+	if !ok {
+		return fmt.Errorf("missing %s", corev1.TLSPrivateKeyKey)
+	}
+
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate is not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return fmt.Errorf("%s does not match %s: %w", corev1.TLSCertKey, corev1.TLSPrivateKeyKey, err)
+	}
+
+	caPEM, ok := secret.Data[caCertKey]
+	if !verifyChain || !ok {
+		return nil
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in %s", caCertKey)
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM(certPEM)
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate does not chain to %s: %w", caCertKey, err)
+	}
+	return nil
+}
+
+// certificateChanged reports whether the tls.crt leaf differs between two
+// versions of a secret by serial number or SHA-256 fingerprint. If either
+// version cannot be parsed the change is assumed to be genuine, since the
+// secret data already differs.
+func certificateChanged(oldSecret, secret *corev1.Secret, mode string) bool {
+	if mode == ChangeDetectionData {
+		return true
+	}
+
+	oldCert, err := ParseCertificate(oldSecret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return true
+	}
+	cert, err := ParseCertificate(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return true
+	}
+
+	if mode == ChangeDetectionSerial {
+		return oldCert.SerialNumber.Cmp(cert.SerialNumber) != 0
+	}
+	oldFingerprint := sha256.Sum256(oldCert.Raw)
+	fingerprint := sha256.Sum256(cert.Raw)
+	return !bytes.Equal(oldFingerprint[:], fingerprint[:])
+}
@@ -0,0 +1,185 @@
+package watcher
+
+import (
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// certificateNameAnnotation is set by cert-manager on every secret it
+// issues into.
+const certificateNameAnnotation = "cert-manager.io/certificate-name"
+
+var certificatesResource = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+
+// CertManagerController restarts the targets of a cert-manager managed
+// secret once per issuance of its Certificate, rather than on every write
+// to the secret. An issuance is a status.revision the controller has not
+// triggered on yet, reached while the Certificate is Ready.
+type CertManagerController struct {
+	watcher *Watcher
+	dynamic dynamic.Interface
+
+	mu sync.Mutex
+	// revisions holds the last revision seen for each Certificate.
+	revisions map[string]int64
+}
+
+func NewCertManagerController(w *Watcher, dynamicClient dynamic.Interface) *CertManagerController {
+	return &CertManagerController{watcher: w, dynamic: dynamicClient, revisions: map[string]int64{}}
+}
+
+// Run starts a Certificate informer in namespace, which may be
+// metav1.NamespaceAll, and blocks until its cache has synced.
+func (c *CertManagerController) Run(namespace string, stopCh <-chan struct{}) {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.dynamic, c.watcher.ResyncPeriod, namespace, nil)
+	informer := factory.ForResource(certificatesResource).Informer()
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				c.observe(u)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, ok := oldObj.(*unstructured.Unstructured)
+			if !ok {
+				return
+			}
+			u, ok := newObj.(*unstructured.Unstructured)
+			if !ok {
+				return
+			}
+			if old.GetResourceVersion() == u.GetResourceVersion() {
+				metrics.InformerResyncs.WithLabelValues("Certificate").Inc()
+				return
+			}
+			if c.observe(u) {
+				c.renewed(u)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+				c.mu.Lock()
+				delete(c.revisions, key)
+				c.mu.Unlock()
+			}
+		},
+	})
+
+	factory.Start(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		return
+	}
+	fmt.Printf("Watching cert-manager Certificates in namespace %q\n", namespace)
+}
+
+// observe records the revision of a Ready Certificate and reports whether
+// it is newer than the last one recorded.
+func (c *CertManagerController) observe(u *unstructured.Unstructured) bool {
+	if !certificateReady(u) {
+		return false
+	}
+	revision, _, _ := unstructured.NestedInt64(u.Object, "status", "revision")
+	key := u.GetNamespace() + "/" + u.GetName()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, seen := c.revisions[key]
+	c.revisions[key] = revision
+	return seen && revision > last
+}
+
+// renewed restarts the targets of the Certificate's secret, recording
+// Events against the Certificate. A secret the informers have not cached
+// yet is looked up from the API server; with Validate set, a secret that
+// cannot be read is not restarted for, since it cannot be validated.
+func (c *CertManagerController) renewed(u *unstructured.Unstructured) {
+	w := c.watcher
+	if !w.Filter.allows(u.GetNamespace()) {
+		return
+	}
+	secretName, _, _ := unstructured.NestedString(u.Object, "spec", "secretName")
+	notAfter, _, _ := unstructured.NestedString(u.Object, "status", "notAfter")
+	revision, _, _ := unstructured.NestedInt64(u.Object, "status", "revision")
+
+	secret, deployments := w.cachedSecret(u.GetNamespace(), secretName)
+	targets := w.targetsFor(secret, deployments)
+	if len(targets) == 0 {
+		return
+	}
+	fmt.Printf("Certificate %s/%s issued revision %d, valid until %s\n", u.GetNamespace(), u.GetName(), revision, notAfter)
+	metrics.SourceUpdates.WithLabelValues(u.GetNamespace(), "Certificate", u.GetName()).Inc()
+	w.Audit.received(u.GetNamespace(), "Certificate", u.GetName())
+
+	if secret.Data == nil {
+		fetched, err := w.clientset.CoreV1().Secrets(u.GetNamespace()).Get(w.ctx, secretName, metav1.GetOptions{})
+		switch {
+		case err == nil:
+			secret = fetched
+		case w.Validate:
+			fmt.Printf("Failed to get secret %s/%s for validation, not restarting: %v\n", u.GetNamespace(), secretName, err)
+			metrics.RestartsSkipped.WithLabelValues(u.GetNamespace(), secretName, metrics.SkipUnreadable).Inc()
+			w.Audit.skipped(u.GetNamespace(), "Secret", secretName, metrics.SkipUnreadable)
+			w.Recorder.Eventf(u, corev1.EventTypeWarning, "CertificateInvalid", "Not restarting workloads: secret %s could not be read for validation: %v", secretName, err)
+			return
+		default:
+			fmt.Printf("Failed to get secret %s/%s: %v\n", u.GetNamespace(), secretName, err)
+		}
+	}
+	if w.Validate {
+		if err := ValidateCertificate(secret, w.VerifyChain); err != nil {
+			fmt.Printf("Secret %s/%s failed validation, not restarting: %v\n", secret.Namespace, secret.Name, err)
+			metrics.ValidationFailures.WithLabelValues(secret.Namespace, secret.Name).Inc()
+			metrics.RestartsSkipped.WithLabelValues(secret.Namespace, secret.Name, metrics.SkipValidationFailed).Inc()
+			w.Audit.skipped(secret.Namespace, "Secret", secret.Name, metrics.SkipValidationFailed)
+			w.Recorder.Eventf(u, corev1.EventTypeWarning, "CertificateInvalid", "Not restarting workloads: %v", err)
+			return
+		}
+	}
+	w.Trigger(u, w.policyAllowed(secret, nil, secret.Data, targets))
+}
+
+// certificateReady reports whether the Certificate's Ready condition is
+// True.
+func certificateReady(u *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+	for _, raw := range conditions {
+		condition, ok := raw.(map[string]interface{})
+		if ok && condition["type"] == "Ready" {
+			return condition["status"] == string(metav1.ConditionTrue)
+		}
+	}
+	return false
+}
+
+// cachedSecret returns the named secret from the informer caches together
+// with the deployment lister of its namespace. A secret that is not cached
+// yet is returned as a stub carrying only its name.
+func (w *Watcher) cachedSecret(namespace, name string) (*corev1.Secret, appslisters.DeploymentLister) {
+	w.mu.RLock()
+	caches := append([]namespaceCache{}, w.caches...)
+	w.mu.RUnlock()
+
+	for _, c := range caches {
+		if c.namespace != namespace && c.namespace != metav1.NamespaceAll {
+			continue
+		}
+		if secret, err := c.secrets.Secrets(namespace).Get(name); err == nil {
+			return secret, c.deployments
+		}
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}, c.deployments
+	}
+	return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}, nil
+}
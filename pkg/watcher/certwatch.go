@@ -0,0 +1,340 @@
+package watcher
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+var certWatchesResource = schema.GroupVersionResource{Group: "cert-watcher.io", Version: "v1alpha1", Resource: "certwatches"}
+
+// maxCertWatchRetries bounds how often a CertWatch whose sync fails on the
+// API server is retried before it waits for its next change.
+const maxCertWatchRetries = 10
+
+// CertWatch declares a secret and the workloads in the same namespace that
+// are restarted when it changes.
+type CertWatch struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CertWatchSpec   `json:"spec"`
+	Status CertWatchStatus `json:"status,omitempty"`
+}
+
+// CertWatchSpec is the desired state of a CertWatch.
+type CertWatchSpec struct {
+	SecretRef CertWatchSecretRef `json:"secretRef"`
+	Targets   []CertWatchTarget  `json:"targets"`
+	Delay     *metav1.Duration   `json:"delay,omitempty"`
+	Strategy  string             `json:"strategy,omitempty"`
+	Keys      []string           `json:"keys,omitempty"`
+	Windows   []string           `json:"windows,omitempty"`
+	Policy    string             `json:"policy,omitempty"`
+}
+
+// CertWatchSecretRef names the watched secret.
+type CertWatchSecretRef struct {
+	Name string `json:"name"`
+}
+
+// CertWatchTarget is a workload restarted when the secret changes. Kind
+// defaults to Deployment; APIVersion, Order and Probe are as in Mapping.
+type CertWatchTarget struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Name       string `json:"name"`
+	Order      int    `json:"order,omitempty"`
+	Probe      string `json:"probe,omitempty"`
+}
+
+// CertWatchStatus is reported back by the watcher. Message describes the
+// spec, or what is wrong with it, and LastRestartError why the last restart
+// failed, if it did.
+type CertWatchStatus struct {
+	ObservedGeneration int64        `json:"observedGeneration,omitempty"`
+	Message            string       `json:"message,omitempty"`
+	LastRestartTime    *metav1.Time `json:"lastRestartTime,omitempty"`
+	LastRestartTarget  string       `json:"lastRestartTarget,omitempty"`
+	LastRestartResult  string       `json:"lastRestartResult,omitempty"`
+	LastRestartError   string       `json:"lastRestartError,omitempty"`
+}
+
+// CertWatchController keeps the watcher's managed mappings in sync with the
+// CertWatch resources in the cluster and reports restarts on their status.
+// Changed resources are queued by key, and a failed sync is retried with
+// exponential backoff.
+type CertWatchController struct {
+	watcher *Watcher
+	dynamic dynamic.Interface
+	client  dynamic.NamespaceableResourceInterface
+	queue   workqueue.RateLimitingInterface
+	indexer cache.Indexer
+}
+
+// NewCertWatchController returns a controller that manages the mappings of
+// w declared by CertWatch resources, which it reads through dynamicClient,
+// and reports the restarts of w on their status.
+func NewCertWatchController(w *Watcher, dynamicClient dynamic.Interface) *CertWatchController {
+	c := &CertWatchController{
+		watcher: w,
+		dynamic: dynamicClient,
+		client:  dynamicClient.Resource(certWatchesResource),
+		queue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "certwatches"),
+	}
+	w.certWatches = c
+	return c
+}
+
+// Run starts an informer for CertWatch resources in every namespace and
+// blocks until its cache has synced, then syncs queued resources in the
+// background until stopCh is closed.
+func (c *CertWatchController) Run(stopCh <-chan struct{}) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(c.dynamic, c.watcher.ResyncPeriod)
+	informer := factory.ForResource(certWatchesResource).Informer()
+	c.indexer = informer.GetIndexer()
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, ok := oldObj.(*unstructured.Unstructured)
+			if !ok {
+				return
+			}
+			u, ok := newObj.(*unstructured.Unstructured)
+			if !ok {
+				return
+			}
+			// Resyncs, and writes that leave the spec alone such as our
+			// own status updates, cannot change the mappings.
+			if old.GetResourceVersion() == u.GetResourceVersion() {
+				metrics.InformerResyncs.WithLabelValues("CertWatch").Inc()
+				return
+			}
+			if old.GetGeneration() == u.GetGeneration() {
+				return
+			}
+			c.enqueue(u)
+		},
+		DeleteFunc: c.enqueue,
+	})
+
+	go func() {
+		<-stopCh
+		c.queue.ShutDown()
+	}()
+	factory.Start(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		return
+	}
+	go func() {
+		for c.processNext() {
+		}
+	}()
+	fmt.Println("Watching CertWatch resources in all namespaces")
+}
+
+// enqueue queues the key of an added, changed or deleted CertWatch.
+func (c *CertWatchController) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	c.queue.Add(key)
+}
+
+// processNext syncs the next CertWatch taken off the queue, retrying it
+// with backoff up to maxCertWatchRetries times when the sync fails.
+func (c *CertWatchController) processNext() bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	err := c.sync(key)
+	switch {
+	case err == nil:
+		c.queue.Forget(key)
+	case c.queue.NumRequeues(key) < maxCertWatchRetries:
+		fmt.Printf("Failed to sync CertWatch %s, retrying: %v\n", key, err)
+		c.queue.AddRateLimited(key)
+	default:
+		fmt.Printf("Failed to sync CertWatch %s, giving up until it changes: %v\n", key, err)
+		c.queue.Forget(key)
+	}
+	return true
+}
+
+// sync reconciles the CertWatch with the given key into watcher mappings,
+// dropping them when it no longer exists or cannot be decoded. Only errors
+// of the API server, which may pass, are returned.
+func (c *CertWatchController) sync(key string) error {
+	obj, exists, err := c.indexer.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		c.watcher.setManagedMappings(key, nil)
+		fmt.Printf("CertWatch %s deleted\n", key)
+		return nil
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("unexpected object of type %T", obj)
+	}
+
+	var certWatch CertWatch
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &certWatch); err != nil {
+		// Decoding fails the same way until the resource changes, so
+		// the error is reported rather than retried.
+		fmt.Printf("Failed to decode CertWatch %s: %v\n", key, err)
+		c.watcher.setManagedMappings(key, nil)
+		message := fmt.Sprintf("invalid CertWatch: %v", err)
+		if old, _, _ := unstructured.NestedString(u.Object, "status", "message"); old == message {
+			return nil
+		}
+		return c.updateStatus(u.GetNamespace(), u.GetName(), func(status *CertWatchStatus) {
+			status.ObservedGeneration = u.GetGeneration()
+			status.Message = message
+		})
+	}
+
+	message := fmt.Sprintf("Watching secret %s for %d targets", certWatch.Spec.SecretRef.Name, len(certWatch.Spec.Targets))
+	mappings, err := c.mappingsFor(&certWatch)
+	if err != nil {
+		message = err.Error()
+	}
+	c.watcher.setManagedMappings(key, mappings)
+	if err == nil {
+		c.watcher.WatchNamespace(certWatch.Namespace)
+	}
+
+	if certWatch.Status.ObservedGeneration == certWatch.Generation && certWatch.Status.Message == message {
+		return nil
+	}
+	return c.updateStatus(certWatch.Namespace, certWatch.Name, func(status *CertWatchStatus) {
+		status.ObservedGeneration = certWatch.Generation
+		status.Message = message
+	})
+}
+
+// mappingsFor converts the spec of a CertWatch into validated mappings.
+func (c *CertWatchController) mappingsFor(certWatch *CertWatch) ([]Mapping, error) {
+	delay := certWatch.Spec.Delay
+	if delay == nil {
+		delay = c.watcher.defaults.Delay
+	}
+	keys := certWatch.Spec.Keys
+	if keys == nil {
+		keys = c.watcher.defaults.Keys
+	}
+	windows := certWatch.Spec.Windows
+	if windows == nil {
+		windows = c.watcher.defaults.Windows
+	}
+	strategy := certWatch.Spec.Strategy
+	if strategy == "" {
+		strategy = c.watcher.defaults.Strategy
+	}
+	policy := certWatch.Spec.Policy
+	if policy == "" {
+		policy = c.watcher.defaults.Policy
+	}
+
+	config := &Config{}
+	for _, target := range certWatch.Spec.Targets {
+		kind := target.Kind
+		if kind == "" {
+			kind = restarter.KindDeployment
+		}
+		if target.APIVersion != "" {
+			kind = restarter.CustomKind(target.APIVersion, kind)
+		}
+		config.Mappings = append(config.Mappings, Mapping{
+			Namespace:  certWatch.Namespace,
+			Secret:     certWatch.Spec.SecretRef.Name,
+			Kind:       kind,
+			Deployment: target.Name,
+			Delay:      delay,
+			Keys:       keys,
+			Windows:    windows,
+			Strategy:   strategy,
+			Policy:     policy,
+			Order:      target.Order,
+			Probe:      target.Probe,
+			certWatch:  certWatch.Namespace + "/" + certWatch.Name,
+		})
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config.Mappings, nil
+}
+
+// recordRestart writes the outcome of a restart to the status of the
+// CertWatch that declared the mapping.
+func (c *CertWatchController) recordRestart(m Mapping, restartErr error) {
+	namespace, name, _ := strings.Cut(m.certWatch, "/")
+	now := metav1.Now()
+
+	err := c.updateStatus(namespace, name, func(status *CertWatchStatus) {
+		status.LastRestartTime = &now
+		status.LastRestartTarget = m.Kind + "/" + m.Deployment
+		status.LastRestartResult = notify.Succeeded
+		status.LastRestartError = ""
+		if restartErr != nil {
+			status.LastRestartResult = notify.Failed
+			status.LastRestartError = restartErr.Error()
+		}
+	})
+	if err != nil {
+		fmt.Printf("Failed to update status of CertWatch %s/%s: %v\n", namespace, name, err)
+	}
+}
+
+// updateStatus applies mutate to the latest status of a CertWatch and
+// writes it through the status subresource. Only the status is decoded, so
+// that the status of a CertWatch with an invalid spec can still be written,
+// and a status that cannot be decoded is replaced.
+func (c *CertWatchController) updateStatus(namespace, name string, mutate func(*CertWatchStatus)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		u, err := c.client.Namespace(namespace).Get(c.watcher.ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		var certWatchStatus CertWatchStatus
+		if old, ok, _ := unstructured.NestedMap(u.Object, "status"); ok {
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(old, &certWatchStatus); err != nil {
+				certWatchStatus = CertWatchStatus{}
+			}
+		}
+		mutate(&certWatchStatus)
+
+		status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&certWatchStatus)
+		if err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedMap(u.Object, status, "status"); err != nil {
+			return err
+		}
+		_, err = c.client.Namespace(namespace).UpdateStatus(c.watcher.ctx, u, metav1.UpdateOptions{})
+		return err
+	})
+}
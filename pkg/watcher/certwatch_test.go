@@ -0,0 +1,159 @@
+package watcher
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func certWatchObject(spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cert-watcher.io/v1alpha1",
+		"kind":       "CertWatch",
+		"metadata":   map[string]interface{}{"namespace": "default", "name": "web", "generation": int64(1)},
+		"spec":       spec,
+	}}
+}
+
+// newTestCertWatchController returns a CertWatchController whose cache and
+// fake dynamic client hold certWatch.
+func newTestCertWatchController(t *testing.T, certWatch *unstructured.Unstructured) (*CertWatchController, *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{certWatchesResource: "CertWatchList"})
+	// Objects passed to the constructor are stored under a guessed
+	// resource, certwatchs.
+	if err := dynamicClient.Tracker().Create(certWatchesResource, certWatch, "default"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, _ := newTestWatcher(nil)
+	t.Cleanup(w.cancel)
+	c := NewCertWatchController(w, dynamicClient)
+	c.indexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := c.indexer.Add(certWatch); err != nil {
+		t.Fatal(err)
+	}
+	return c, dynamicClient
+}
+
+// certWatchStatus returns the status written to the CertWatch.
+func certWatchStatus(t *testing.T, c *CertWatchController) map[string]interface{} {
+	t.Helper()
+	u, err := c.client.Namespace("default").Get(c.watcher.ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _, _ := unstructured.NestedMap(u.Object, "status")
+	return status
+}
+
+func TestCertWatchSyncRetriesStatusUpdates(t *testing.T) {
+	c, dynamicClient := newTestCertWatchController(t, certWatchObject(map[string]interface{}{
+		"secretRef": map[string]interface{}{"name": "tls"},
+		"targets":   []interface{}{map[string]interface{}{"name": "web"}},
+	}))
+	failing := true
+	dynamicClient.PrependReactor("update", "certwatches", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "status" && failing {
+			return true, nil, errors.New("API server unavailable")
+		}
+		return false, nil, nil
+	})
+
+	if err := c.sync("default/web"); err == nil {
+		t.Fatal("sync succeeded although the status update failed")
+	}
+
+	failing = false
+	if err := c.sync("default/web"); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if generation := certWatchStatus(t, c)["observedGeneration"]; generation != int64(1) {
+		t.Errorf("status.observedGeneration = %v, want 1", generation)
+	}
+	if len(c.watcher.currentMappings()) != 1 {
+		t.Errorf("mappings = %v, want the CertWatch's target", c.watcher.currentMappings())
+	}
+}
+
+func TestCertWatchSyncReportsDecodeErrors(t *testing.T) {
+	c, _ := newTestCertWatchController(t, certWatchObject(map[string]interface{}{
+		"secretRef": map[string]interface{}{"name": "tls"},
+		"targets":   "web",
+	}))
+
+	if err := c.sync("default/web"); err != nil {
+		t.Fatalf("sync returned %v for an invalid spec, which retrying cannot fix", err)
+	}
+	if message, _ := certWatchStatus(t, c)["message"].(string); !strings.HasPrefix(message, "invalid CertWatch") {
+		t.Errorf("status.message = %q, want the decode error", message)
+	}
+	if len(c.watcher.currentMappings()) != 0 {
+		t.Errorf("mappings = %v, want none", c.watcher.currentMappings())
+	}
+}
+
+func TestCertWatchRetriesAreCapped(t *testing.T) {
+	c, dynamicClient := newTestCertWatchController(t, certWatchObject(map[string]interface{}{
+		"secretRef": map[string]interface{}{"name": "tls"},
+		"targets":   []interface{}{map[string]interface{}{"name": "web"}},
+	}))
+	var attempts atomic.Int32
+	dynamicClient.PrependReactor("get", "certwatches", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		attempts.Add(1)
+		return true, nil, errors.New("API server unavailable")
+	})
+	c.queue = workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Microsecond, time.Millisecond))
+	defer c.queue.ShutDown()
+
+	c.queue.Add("default/web")
+	for i := 0; i <= maxCertWatchRetries; i++ {
+		c.processNext()
+	}
+	if got := attempts.Load(); got != maxCertWatchRetries+1 {
+		t.Errorf("synced %d times, want %d", got, maxCertWatchRetries+1)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if c.queue.Len() != 0 {
+		t.Error("CertWatch still queued after running out of retries")
+	}
+}
+
+func TestCertWatchRecordRestart(t *testing.T) {
+	c, _ := newTestCertWatchController(t, certWatchObject(map[string]interface{}{
+		"secretRef": map[string]interface{}{"name": "tls"},
+		"targets":   []interface{}{map[string]interface{}{"name": "web"}},
+	}))
+	if err := c.sync("default/web"); err != nil {
+		t.Fatal(err)
+	}
+	message := certWatchStatus(t, c)["message"]
+	m := Mapping{Namespace: "default", Secret: "tls", Kind: "Deployment", Deployment: "web", certWatch: "default/web"}
+
+	c.recordRestart(m, errors.New("deployments.apps \"web\" not found"))
+	status := certWatchStatus(t, c)
+	if status["lastRestartResult"] != "Failed" || status["lastRestartError"] == nil {
+		t.Errorf("status after a failed restart = %v", status)
+	}
+	if status["message"] != message {
+		t.Errorf("status.message = %v after a failed restart, want %v", status["message"], message)
+	}
+
+	c.recordRestart(m, nil)
+	status = certWatchStatus(t, c)
+	if status["lastRestartResult"] != "Succeeded" || status["lastRestartError"] != nil {
+		t.Errorf("status after a successful restart = %v", status)
+	}
+}
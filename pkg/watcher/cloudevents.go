@@ -0,0 +1,249 @@
+package watcher
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+)
+
+const (
+	// CloudEvents types emitted over the life of a rotation.
+	eventRotationDetected = "io.cert-watcher.rotation.detected"
+	eventRestartScheduled = "io.cert-watcher.restart.scheduled"
+	eventRestartSucceeded = "io.cert-watcher.restart.succeeded"
+	eventRestartFailed    = "io.cert-watcher.restart.failed"
+
+	// cloudEventBuffer is how many events wait for the sink before new
+	// ones are dropped.
+	cloudEventBuffer = 256
+
+	// eventPublishAttempts is how often an event is tried with
+	// DeliveryAtLeastOnce; the backoff between attempts doubles from a
+	// second.
+	eventPublishAttempts = 5
+)
+
+// cloudEvent is a CloudEvents 1.0 event in the structured JSON format.
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// rotationEventData is the data of eventRotationDetected.
+type rotationEventData struct {
+	Namespace  string      `json:"namespace"`
+	SourceKind string      `json:"sourceKind"`
+	Source     string      `json:"source"`
+	Targets    []targetRef `json:"targets"`
+}
+
+type targetRef struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+}
+
+// scheduledEventData is the data of eventRestartScheduled.
+type scheduledEventData struct {
+	Namespace  string    `json:"namespace"`
+	SourceKind string    `json:"sourceKind"`
+	Source     string    `json:"source"`
+	Kind       string    `json:"kind"`
+	Deployment string    `json:"deployment"`
+	Due        time.Time `json:"due"`
+}
+
+// EventSink delivers CloudEvents to one transport.
+type EventSink interface {
+	publish(e cloudEvent) error
+	// close flushes and releases the transport.
+	Close() error
+}
+
+// httpEventSink POSTs every event in structured mode to a URL.
+type httpEventSink struct {
+	url string
+}
+
+func (s httpEventSink) publish(e cloudEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := notify.Client.Post(s.url, cloudEventsContentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sink %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s httpEventSink) Close() error {
+	return nil
+}
+
+// NewEventSink returns the sink for address: an http or https URL, a
+// kafka://broker[,broker...]/topic or a nats://server[,server...]/subject.
+func NewEventSink(address string, opts EventBusOptions) (EventSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return httpEventSink{url: address}, nil
+	case "kafka":
+		return newKafkaEventSink(u, opts)
+	case "nats":
+		return newNATSEventSink(u, opts)
+	default:
+		return nil, fmt.Errorf("unsupported CloudEvents sink scheme %q", u.Scheme)
+	}
+}
+
+// CloudEvents publishes events to a sink from a background goroutine, so
+// that a slow sink never holds up the informers or restarts. Events that
+// find the buffer full are dropped. A nil *CloudEvents publishes nothing.
+type CloudEvents struct {
+	sink   EventSink
+	source string
+	// retry retries failed publishes up to eventPublishAttempts times.
+	retry  bool
+	events chan cloudEvent
+	done   chan struct{}
+
+	// mu guards closed, which is set once events has been closed.
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewCloudEvents(sink EventSink, source string, retry bool) *CloudEvents {
+	c := &CloudEvents{sink: sink, source: source, retry: retry, events: make(chan cloudEvent, cloudEventBuffer), done: make(chan struct{})}
+	go c.Run()
+	return c
+}
+
+func (c *CloudEvents) Run() {
+	defer close(c.done)
+	for e := range c.events {
+		err := c.sink.publish(e)
+		for attempt, backoff := 1, time.Second; err != nil && c.retry && attempt < eventPublishAttempts; attempt, backoff = attempt+1, backoff*2 {
+			time.Sleep(backoff)
+			err = c.sink.publish(e)
+		}
+		if err != nil {
+			fmt.Printf("Failed to publish CloudEvent %s for %s: %v\n", e.Type, e.Subject, err)
+			metrics.CloudEventsPublished.WithLabelValues(e.Type, "failed").Inc()
+			continue
+		}
+		metrics.CloudEventsPublished.WithLabelValues(e.Type, "sent").Inc()
+	}
+}
+
+// Close publishes the events still buffered, waiting up to timeout, and
+// closes the sink. Events emitted after close are dropped.
+func (c *CloudEvents) Close(timeout time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.closed = true
+	close(c.events)
+	c.mu.Unlock()
+	select {
+	case <-c.done:
+	case <-time.After(timeout):
+		fmt.Printf("CloudEvents still queued after %s, dropping them\n", timeout)
+	}
+	if err := c.sink.Close(); err != nil {
+		fmt.Printf("Failed to close the CloudEvents sink: %v\n", err)
+	}
+}
+
+// emit queues an event of eventType about subject.
+func (c *CloudEvents) emit(eventType, subject string, data interface{}) {
+	if c == nil {
+		return
+	}
+	e := cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              eventID(),
+		Source:          c.source,
+		Type:            eventType,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		metrics.CloudEventsPublished.WithLabelValues(eventType, "dropped").Inc()
+		return
+	}
+	select {
+	case c.events <- e:
+	default:
+		metrics.CloudEventsPublished.WithLabelValues(eventType, "dropped").Inc()
+	}
+}
+
+// rotationDetected emits eventRotationDetected for a change of the source
+// of targets.
+func (c *CloudEvents) rotationDetected(targets []Mapping) {
+	if c == nil || len(targets) == 0 {
+		return
+	}
+	m := targets[0]
+	data := rotationEventData{Namespace: m.Namespace, SourceKind: m.sourceKind(), Source: m.sourceName()}
+	for _, t := range targets {
+		data.Targets = append(data.Targets, targetRef{Namespace: t.Namespace, Kind: t.Kind, Name: t.Deployment})
+	}
+	c.emit(eventRotationDetected, m.Namespace+"/"+m.sourceName(), data)
+}
+
+// restartScheduled emits eventRestartScheduled for the restart of m due at
+// due.
+func (c *CloudEvents) restartScheduled(m Mapping, due time.Time) {
+	c.emit(eventRestartScheduled, m.targetKey(), scheduledEventData{
+		Namespace:  m.Namespace,
+		SourceKind: m.sourceKind(),
+		Source:     m.sourceName(),
+		Kind:       m.Kind,
+		Deployment: m.Deployment,
+		Due:        due.UTC(),
+	})
+}
+
+// restarted emits n, the outcome of the restart of m.
+func (c *CloudEvents) restarted(m Mapping, n notify.Notification) {
+	eventType := eventRestartSucceeded
+	if n.Outcome == notify.Failed {
+		eventType = eventRestartFailed
+	}
+	c.emit(eventType, m.targetKey(), n)
+}
+
+// eventID returns a random CloudEvents id.
+func eventID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
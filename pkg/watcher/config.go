@@ -0,0 +1,336 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+// Config is the on-disk description of every secret the watcher manages.
+type Config struct {
+	Mappings []Mapping `json:"mappings"`
+}
+
+// Mapping ties a watched secret or ConfigMap to the workload that consumes
+// it. Exactly one of Secret, SecretSelector, ConfigMap, Vault, AWSSecret and
+// ACMCertificate is set; Deployment names the workload, whose kind is given
+// by Kind.
+type Mapping struct {
+	Namespace string `json:"namespace,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+	// SecretSelector is a label selector matching every watched secret,
+	// including ones created after the watcher started.
+	SecretSelector string `json:"secretSelector,omitempty"`
+	ConfigMap      string `json:"configMap,omitempty"`
+	// Vault is a Vault API path polled instead of a Kubernetes object.
+	Vault string `json:"vault,omitempty"`
+	// AWSSecret is the name or ARN of an AWS Secrets Manager secret and
+	// ACMCertificate the ARN of an ACM certificate, both polled for
+	// rotations.
+	AWSSecret      string `json:"awsSecret,omitempty"`
+	ACMCertificate string `json:"acmCertificate,omitempty"`
+	Kind           string `json:"kind,omitempty"`
+	// APIVersion, with Kind, names a custom workload kind with a pod
+	// template at spec.template; see restarter.CustomKind.
+	APIVersion string           `json:"apiVersion,omitempty"`
+	Deployment string           `json:"deployment"`
+	Delay      *metav1.Duration `json:"delay,omitempty"`
+	// Keys limits restarts to changes of these secret data keys.
+	Keys []string `json:"keys,omitempty"`
+	// Windows limits restarts to these times of day; see ParseWindows.
+	Windows []string `json:"windows,omitempty"`
+	// Strategy is how the workload is restarted; see restartStrategies.
+	Strategy string `json:"strategy,omitempty"`
+	// Order sequences the restarts caused by one change: targets with a
+	// lower order finish rolling out before those with a higher one start.
+	Order int `json:"order,omitempty"`
+	// Probe is a host:port serving the workload's certificate, checked
+	// once its rollout has finished; see probeTarget.
+	Probe string `json:"probe,omitempty"`
+	// Job is the template of the Job created on every rotation by a
+	// mapping of kind Job.
+	Job *batchv1.JobTemplateSpec `json:"job,omitempty"`
+	// PreRestart and PostRestart run before the restart and once it has
+	// rolled out.
+	PreRestart  *Hook `json:"preRestart,omitempty"`
+	PostRestart *Hook `json:"postRestart,omitempty"`
+	// Policy is a CEL expression that decides whether a change of the
+	// source restarts the workload; see rotationInput.
+	Policy string `json:"policy,omitempty"`
+
+	// certWatch is the namespace/name of the CertWatch resource that
+	// declared the mapping, if any.
+	certWatch string
+	// Files lists the paths watched in file mode, in place of a secret. It
+	// is not read from config files.
+	Files string `json:"-"`
+	// fixedDelay marks a Delay that the target's restarter.DelayAnnotation does
+	// not override, such as that of a manual or resumed restart.
+	fixedDelay bool
+}
+
+// sourceKind returns the kind of object the mapping watches.
+func (m Mapping) sourceKind() string {
+	if m.Files != "" {
+		return "File"
+	}
+	if m.Vault != "" {
+		return "Vault"
+	}
+	if m.AWSSecret != "" {
+		return "AWSSecret"
+	}
+	if m.ACMCertificate != "" {
+		return "ACMCertificate"
+	}
+	if m.ConfigMap != "" {
+		return "ConfigMap"
+	}
+	return "Secret"
+}
+
+// sourceName returns the name of the object the mapping watches.
+func (m Mapping) sourceName() string {
+	if m.Files != "" {
+		return m.Files
+	}
+	if m.Vault != "" {
+		return m.Vault
+	}
+	if m.AWSSecret != "" {
+		return m.AWSSecret
+	}
+	if m.ACMCertificate != "" {
+		return m.ACMCertificate
+	}
+	if m.ConfigMap != "" {
+		return m.ConfigMap
+	}
+	return m.Secret
+}
+
+// External reports whether the mapping's source lives outside Kubernetes
+// and is polled by a sourcePoller.
+func (m Mapping) External() bool {
+	return m.Vault != "" || m.AWSSecret != "" || m.ACMCertificate != ""
+}
+
+// MatchesSecret reports whether the mapping watches secret. The namespace is
+// not compared.
+func (m Mapping) MatchesSecret(secret *corev1.Secret) bool {
+	if m.SecretSelector != "" {
+		selector, err := labels.Parse(m.SecretSelector)
+		return err == nil && selector.Matches(labels.Set(secret.Labels))
+	}
+	return m.Secret != "" && MatchName(m.Secret, secret.Name)
+}
+
+// MatchName reports whether name matches pattern, which is a regular
+// expression when enclosed in slashes, a glob when it contains any of
+// "*?[", and a literal name otherwise. Regular expressions must match the
+// whole name.
+func MatchName(pattern, name string) bool {
+	if isRegexPattern(pattern) {
+		re, err := compileRegexPattern(pattern)
+		return err == nil && re.MatchString(name)
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, err := path.Match(pattern, name)
+		return err == nil && ok
+	}
+	return pattern == name
+}
+
+func isRegexPattern(pattern string) bool {
+	return len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+// compileRegexPattern compiles the regular expression between the slashes
+// of pattern, anchored so that it cannot match only part of a name.
+func compileRegexPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+}
+
+// validatePattern returns an error if pattern is a malformed glob or
+// regular expression.
+func validatePattern(pattern string) error {
+	if isRegexPattern(pattern) {
+		_, err := compileRegexPattern(pattern)
+		return err
+	}
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+// targetKey identifies the workload restarted by the mapping.
+func (m Mapping) targetKey() string {
+	return m.Namespace + "/" + m.Kind + "/" + m.Deployment
+}
+
+// LoadConfig reads a YAML config file and fills in the namespace, kind,
+// delay, keys, windows, strategy and policy of any mapping that does not set
+// them from defaults.
+func LoadConfig(path string, defaults Mapping) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config %s: %w", path, err)
+	}
+
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	for i := range config.Mappings {
+		m := &config.Mappings[i]
+		if m.Namespace == "" {
+			m.Namespace = defaults.Namespace
+		}
+		if m.Kind == "" {
+			m.Kind = defaults.Kind
+		}
+		if m.APIVersion != "" {
+			m.Kind = restarter.CustomKind(m.APIVersion, m.Kind)
+		}
+		if m.Delay == nil {
+			m.Delay = defaults.Delay
+		}
+		if m.Keys == nil {
+			m.Keys = defaults.Keys
+		}
+		if m.Windows == nil {
+			m.Windows = defaults.Windows
+		}
+		if m.Strategy == "" {
+			m.Strategy = defaults.Strategy
+		}
+		if m.Policy == "" {
+			m.Policy = defaults.Policy
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// Validate checks every mapping and reports all the problems it finds.
+func (c *Config) Validate() error {
+	if len(c.Mappings) == 0 {
+		return fmt.Errorf("no mappings defined")
+	}
+	var errs []error
+	seen := map[string]int{}
+	for i, m := range c.Mappings {
+		if err := m.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %d: %w", i, err))
+			continue
+		}
+		key := m.Namespace + "/" + m.sourceKind() + "/" + m.sourceName() + m.SecretSelector + "/" + m.targetKey()
+		if first, ok := seen[key]; ok {
+			errs = append(errs, fmt.Errorf("mapping %d: duplicates mapping %d", i, first))
+			continue
+		}
+		seen[key] = i
+	}
+	return errors.Join(errs...)
+}
+
+// validate returns the first problem of a mapping of a config file.
+func (m Mapping) validate() error {
+	if CountSet(m.Secret, m.SecretSelector, m.ConfigMap, m.Vault, m.AWSSecret, m.ACMCertificate) != 1 {
+		return fmt.Errorf("exactly one of secret, secretSelector, configMap, vault, awsSecret and acmCertificate is required")
+	}
+	if err := validatePattern(m.sourceName()); err != nil && !m.External() {
+		return fmt.Errorf("invalid name pattern %q: %w", m.sourceName(), err)
+	}
+	if m.SecretSelector != "" {
+		if _, err := labels.Parse(m.SecretSelector); err != nil {
+			return fmt.Errorf("invalid secretSelector: %w", err)
+		}
+	}
+	if m.Deployment == "" {
+		return fmt.Errorf("deployment is required")
+	}
+	if !restarter.ValidKind(m.Kind) {
+		return fmt.Errorf("unsupported kind %q", m.Kind)
+	}
+	for phase, hook := range map[string]*Hook{hookPreRestart: m.PreRestart, hookPostRestart: m.PostRestart} {
+		if hook == nil {
+			continue
+		}
+		if err := hook.validate(); err != nil {
+			return fmt.Errorf("%s: %w", phase, err)
+		}
+	}
+	if (m.Kind == restarter.KindJob) != (m.Job != nil) {
+		return fmt.Errorf("a job template is required with, and only allowed with, kind %s", restarter.KindJob)
+	}
+	if m.Delay != nil && m.Delay.Duration < 0 {
+		return fmt.Errorf("delay must not be negative")
+	}
+	if m.Strategy != "" && !restarter.ValidStrategy(m.Strategy) {
+		return fmt.Errorf("unsupported strategy %q", m.Strategy)
+	}
+	if (m.Strategy == restarter.StrategyChecksum || m.Strategy == restarter.StrategyDeleteMountingPods) && m.External() {
+		return fmt.Errorf("the %s strategy needs a secret or ConfigMap", m.Strategy)
+	}
+	if _, err := ParseWindows(m.Windows); err != nil {
+		return err
+	}
+	if m.Policy != "" {
+		if m.External() {
+			return fmt.Errorf("a policy needs a secret, secretSelector or configMap")
+		}
+		if _, err := compilePolicy(m.Policy); err != nil {
+			return err
+		}
+	}
+	if m.Probe != "" {
+		if m.Secret == "" && m.SecretSelector == "" {
+			return fmt.Errorf("probe needs a secret or secretSelector")
+		}
+		if _, _, err := net.SplitHostPort(m.Probe); err != nil {
+			return fmt.Errorf("invalid probe: %w", err)
+		}
+	}
+	return nil
+}
+
+// CountSet returns how many of values are not empty.
+func CountSet(values ...string) int {
+	n := 0
+	for _, v := range values {
+		if v != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// Namespaces returns the distinct namespaces whose secrets or ConfigMaps
+// the mappings watch.
+func (c *Config) Namespaces() []string {
+	var namespaces []string
+	seen := map[string]bool{}
+	for _, m := range c.Mappings {
+		if !m.External() && !seen[m.Namespace] {
+			seen[m.Namespace] = true
+			namespaces = append(namespaces, m.Namespace)
+		}
+	}
+	return namespaces
+}
@@ -0,0 +1,52 @@
+package watcher
+
+import "testing"
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"tls", "tls", true},
+		{"tls", "api-tls", false},
+		{"*-tls", "api-tls", true},
+		{"*-tls", "api-tls-old", false},
+		{"api-?", "api-1", true},
+		{"api-[ab]", "api-c", false},
+		{"/api-(tls|ca)/", "api-ca", true},
+		// Regular expressions are anchored at both ends.
+		{"/api/", "api-tls", false},
+		{"/tls/", "api-tls", false},
+		{"/a|b/", "ab", false},
+		{"/^api-.*$/", "api-tls", true},
+		// The slashes are only a regular expression when they enclose it.
+		{"/", "/", true},
+		{"re:api-.*", "api-tls", false},
+		// Invalid patterns match nothing.
+		{"/api-(/", "api-(", false},
+		{"api-[", "api-[", false},
+	}
+	for _, test := range tests {
+		if got := MatchName(test.pattern, test.name); got != test.want {
+			t.Errorf("MatchName(%q, %q) = %v, want %v", test.pattern, test.name, got, test.want)
+		}
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"tls", true},
+		{"*-tls", true},
+		{"/api-(tls|ca)/", true},
+		{"/api-(/", false},
+		{"api-[", false},
+	}
+	for _, test := range tests {
+		if err := validatePattern(test.pattern); (err == nil) != test.valid {
+			t.Errorf("validatePattern(%q) = %v, want valid %v", test.pattern, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+// rollingDeferralTimeout is how long a restart waits for a rollout already
+// in progress before running anyway, so that a stuck rollout cannot hold it
+// back forever.
+const rollingDeferralTimeout = 10 * time.Minute
+
+// deferral returns why the due restart p must wait, or "" if it can run. A
+// target that cannot be read is left to the restart to fail.
+func (w *Watcher) deferral(ctx context.Context, p *pendingRestart) string {
+	m := p.mapping
+	// A restart during a rollout would stack a second surge of pods on
+	// the first, so it waits for the rollout unless that is stuck.
+	rolling := func(inProgress bool) string {
+		if !inProgress {
+			return ""
+		}
+		if p.deferred == metrics.DeferRollingOut && time.Since(p.deferredSince) > rollingDeferralTimeout {
+			return ""
+		}
+		return metrics.DeferRollingOut
+	}
+
+	if w.sourcePaused(ctx, p.source) {
+		return metrics.DeferAnnotated
+	}
+
+	apps := w.restarter.Clientset.AppsV1()
+	switch m.Kind {
+	case restarter.KindDeployment:
+		deployment, err := apps.Deployments(m.Namespace).Get(ctx, m.Deployment, metav1.GetOptions{})
+		if err != nil {
+			return ""
+		}
+		// An operator who paused the workload is rolling it out by hand.
+		if deployment.Spec.Paused {
+			return metrics.DeferPaused
+		}
+		if annotatedPaused(deployment.Annotations) {
+			return metrics.DeferAnnotated
+		}
+		return rolling(deploymentRolling(deployment))
+	case restarter.KindStatefulSet:
+		statefulSet, err := apps.StatefulSets(m.Namespace).Get(ctx, m.Deployment, metav1.GetOptions{})
+		if err != nil {
+			return ""
+		}
+		if annotatedPaused(statefulSet.Annotations) {
+			return metrics.DeferAnnotated
+		}
+		return rolling(statefulSetRolling(statefulSet))
+	case restarter.KindDaemonSet:
+		daemonSet, err := apps.DaemonSets(m.Namespace).Get(ctx, m.Deployment, metav1.GetOptions{})
+		if err != nil {
+			return ""
+		}
+		if annotatedPaused(daemonSet.Annotations) {
+			return metrics.DeferAnnotated
+		}
+		return rolling(daemonSetRolling(daemonSet))
+	case restarter.KindJob:
+		// Jobs are created on every rotation; there is no workload to
+		// annotate.
+		return ""
+	}
+
+	obj, err := w.restarter.Workload(ctx, m.Namespace, m.Kind, m.Deployment)
+	if err != nil {
+		return ""
+	}
+	if m.Kind == restarter.KindRollout || m.Kind == restarter.KindDeploymentConfig {
+		if paused, _, _ := unstructured.NestedBool(obj.Object, "spec", "paused"); paused {
+			return metrics.DeferPaused
+		}
+	}
+	if annotatedPaused(obj.GetAnnotations()) {
+		return metrics.DeferAnnotated
+	}
+	return ""
+}
+
+// annotatedPaused reports whether annotations set PausedAnnotation to true.
+func annotatedPaused(annotations map[string]string) bool {
+	paused, _ := strconv.ParseBool(annotations[PausedAnnotation])
+	return paused
+}
+
+// sourcePaused reports whether the latest version of the secret or
+// ConfigMap whose change scheduled a restart carries PausedAnnotation.
+// Restarts without a source object, such as manual or restored ones, are
+// not held back by it.
+func (w *Watcher) sourcePaused(ctx context.Context, source runtime.Object) bool {
+	var annotations map[string]string
+	switch source := source.(type) {
+	case *corev1.Secret:
+		secret, err := w.clientset.CoreV1().Secrets(source.Namespace).Get(ctx, source.Name, metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		annotations = secret.Annotations
+	case *corev1.ConfigMap:
+		configMap, err := w.clientset.CoreV1().ConfigMaps(source.Namespace).Get(ctx, source.Name, metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		annotations = configMap.Annotations
+	}
+	return annotatedPaused(annotations)
+}
+
+// deploymentRolling reports whether the controller has not yet seen the latest
+// spec, or is still replacing old pods without having exceeded its progress
+// deadline. Unlike restarter.DeploymentComplete it ignores pods that are merely
+// unavailable.
+func deploymentRolling(deployment *appsv1.Deployment) bool {
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		return true
+	}
+	if _, err := restarter.DeploymentComplete(deployment); err != nil {
+		return false
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	return status.UpdatedReplicas < replicas || status.Replicas > status.UpdatedReplicas
+}
+
+func statefulSetRolling(statefulSet *appsv1.StatefulSet) bool {
+	status := statefulSet.Status
+	if status.ObservedGeneration < statefulSet.Generation {
+		return true
+	}
+	return statefulSet.Spec.UpdateStrategy.Type == appsv1.RollingUpdateStatefulSetStrategyType && status.UpdateRevision != status.CurrentRevision
+}
+
+func daemonSetRolling(daemonSet *appsv1.DaemonSet) bool {
+	status := daemonSet.Status
+	return status.ObservedGeneration < daemonSet.Generation || status.UpdatedNumberScheduled < status.DesiredNumberScheduled
+}
+
+// deferRestart holds back the due restart p of key while deferral gives a
+// reason, checking again every restarter.RolloutPollInterval, and reports
+// whether it did. The caller has taken a slot for the restart, which is
+// released. At shutdown a deferred restart is dropped and kept in the persisted
+// state.
+func (w *Watcher) deferRestart(key string, p *pendingRestart) bool {
+	m := p.mapping
+	reason := w.deferral(p.ctx, p)
+	if reason == metrics.DeferAnnotated {
+		metrics.PausedTargets.WithLabelValues(m.Namespace, m.Kind, m.Deployment).Set(1)
+	} else {
+		metrics.PausedTargets.DeleteLabelValues(m.Namespace, m.Kind, m.Deployment)
+	}
+	if reason == "" {
+		return false
+	}
+	w.finished(key)
+
+	if reason != p.deferred {
+		p.deferred = reason
+		p.deferredSince = time.Now()
+		fmt.Printf("Deferring the restart of %s %s %s: %s\n", m.Namespace, m.Kind, m.Deployment, reason)
+		metrics.RestartsDeferred.WithLabelValues(m.Namespace, m.Kind, m.Deployment, reason).Inc()
+		w.Audit.deferred(m, reason)
+		w.restarter.Recorder.Eventf(p.target, corev1.EventTypeNormal, restarter.ReasonRestartDeferred, "Restart after %s %s changed deferred: %s", m.sourceKind(), m.sourceName(), reason)
+		p.span.AddEvent("deferred: " + reason)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, newer := w.pending[key]; newer {
+		// A newer change replaced the restart while it was out of the
+		// queue; that one is checked when it is due.
+		p.delaySpan.End()
+		p.span.End()
+		return true
+	}
+	if w.closed {
+		fmt.Printf("Dropping restart of %s %s deferred at shutdown\n", m.Kind, m.Deployment)
+		w.dropped = append(w.dropped, p)
+		p.delaySpan.End()
+		p.span.AddEvent("dropped at shutdown")
+		p.span.End()
+		metrics.RestartsSkipped.WithLabelValues(m.Namespace, m.sourceName(), metrics.SkipShutdown).Inc()
+		w.Audit.targetSkipped(m, metrics.SkipShutdown)
+		return true
+	}
+	w.pending[key] = p
+	metrics.PendingRestarts.Set(float64(len(w.pending)))
+	w.queue.AddAfter(key, restarter.RolloutPollInterval)
+	return true
+}
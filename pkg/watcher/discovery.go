@@ -0,0 +1,79 @@
+package watcher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+const (
+	// secretsAnnotation lets a deployment opt in to restarts for a
+	// comma-separated list of secrets in its own namespace.
+	secretsAnnotation = "cert-watcher.io/secrets"
+	// ignoreAnnotation set to "true" excludes a workload from discovery,
+	// whatever else it references or lists.
+	ignoreAnnotation = "cert-watcher.io/ignore"
+
+	discoveryAnnotation = "annotation"
+	discoveryPodSpec    = "podspec"
+)
+
+// ValidDiscovery reports whether mode is a supported discovery mode.
+func ValidDiscovery(mode string) bool {
+	return mode == discoveryAnnotation || mode == discoveryPodSpec
+}
+
+// discover returns the names of deployments that reference secret according
+// to the configured discovery mode.
+func (w *Watcher) discover(secret *corev1.Secret, lister appslisters.DeploymentLister) []string {
+	if lister == nil {
+		return nil
+	}
+
+	deployments, err := lister.Deployments(secret.Namespace).List(labels.Everything())
+	if err != nil {
+		fmt.Printf("Failed to list deployments in namespace %s: %v\n", secret.Namespace, err)
+		return nil
+	}
+
+	var names []string
+	for _, d := range deployments {
+		if discoveryIgnored(d.Annotations) {
+			continue
+		}
+		switch w.discovery {
+		case discoveryAnnotation:
+			if annotationReferences(d.Annotations, secret.Name) {
+				names = append(names, d.Name)
+			}
+		case discoveryPodSpec:
+			if restarter.PodSpecReferences(&d.Spec.Template.Spec, secret.Name) {
+				names = append(names, d.Name)
+			}
+		}
+	}
+	return names
+}
+
+// discoveryIgnored reports whether annotations opt a workload out of
+// discovery.
+func discoveryIgnored(annotations map[string]string) bool {
+	ignored, _ := strconv.ParseBool(annotations[ignoreAnnotation])
+	return ignored
+}
+
+// annotationReferences reports whether the secrets annotation lists name.
+func annotationReferences(annotations map[string]string, name string) bool {
+	for _, s := range strings.Split(annotations[secretsAnnotation], ",") {
+		if strings.TrimSpace(s) == name {
+			return true
+		}
+	}
+	return false
+}
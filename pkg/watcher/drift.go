@@ -0,0 +1,101 @@
+package watcher
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// DriftScanner periodically compares the start time of every pod of a
+// watched secret's targets with the last time the secret's data was
+// written, and counts the pods that started before it and so may still hold
+// the old certificate. With remediate it also evicts those pods, and only
+// those, unless a restart of their workload is pending or in progress.
+type DriftScanner struct {
+	Watcher   *Watcher
+	Interval  time.Duration
+	Remediate bool
+}
+
+// Run scans every interval until stopCh is closed.
+func (s *DriftScanner) Run(stopCh <-chan struct{}) {
+	fmt.Printf("Checking for pods older than their secrets every %s\n", s.Interval)
+	wait.Until(s.scan, s.Interval, stopCh)
+}
+
+func (s *DriftScanner) scan() {
+	w := s.Watcher
+	ctx := w.ctx
+	for _, secret := range w.watchedSecrets() {
+		modified := dataModified(secret)
+		_, deployments := w.cachedSecret(secret.Namespace, secret.Name)
+
+		for _, m := range w.targetsFor(secret, deployments) {
+			if m.Job != nil {
+				continue
+			}
+			pods, err := w.restarter.Pods(ctx, m.Namespace, m.Kind, m.Deployment)
+			if err != nil {
+				fmt.Printf("Failed to list the pods of %s %s: %v\n", m.Kind, m.Deployment, err)
+				continue
+			}
+			var stale []corev1.Pod
+			for _, pod := range pods {
+				if pod.DeletionTimestamp == nil && pod.Status.StartTime != nil && pod.Status.StartTime.Time.Before(modified) {
+					stale = append(stale, pod)
+				}
+			}
+			metrics.StalePods.WithLabelValues(m.Namespace, m.Kind, m.Deployment, secret.Name).Set(float64(len(stale)))
+			if len(stale) == 0 || !s.Remediate || w.restarting(m.targetKey()) {
+				continue
+			}
+
+			fmt.Printf("%d pods of %s %s %s started before secret %s last changed, evicting them\n", len(stale), m.Namespace, m.Kind, m.Deployment, secret.Name)
+			for _, pod := range stale {
+				eviction := &policyv1.Eviction{ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name}}
+				err := w.restarter.Clientset.CoreV1().Pods(pod.Namespace).EvictV1(ctx, eviction)
+				switch {
+				case err == nil:
+					metrics.StalePodsEvicted.WithLabelValues(m.Namespace, m.Kind, m.Deployment).Inc()
+				case apierrors.IsTooManyRequests(err):
+					// A disruption budget; the next scan tries again.
+					metrics.EvictionsBlocked.WithLabelValues(m.Namespace, m.Kind, m.Deployment).Inc()
+				case !apierrors.IsNotFound(err):
+					fmt.Printf("Failed to evict pod %s/%s: %v\n", pod.Namespace, pod.Name, err)
+				}
+			}
+		}
+	}
+}
+
+// restarting reports whether the target has a restart pending or running.
+func (w *Watcher) restarting(key string) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	_, pending := w.pending[key]
+	return pending || w.rolling[key]
+}
+
+// dataModified returns when the data of secret was last written, as
+// recorded in its managedFields by the managers that own data keys. It
+// falls back to the creation time when no such entry exists.
+func dataModified(secret *corev1.Secret) time.Time {
+	modified := secret.CreationTimestamp.Time
+	for _, entry := range secret.ManagedFields {
+		if entry.Time == nil || entry.FieldsV1 == nil || !bytes.Contains(entry.FieldsV1.Raw, []byte(`"f:data"`)) {
+			continue
+		}
+		if entry.Time.Time.After(modified) {
+			modified = entry.Time.Time
+		}
+	}
+	return modified
+}
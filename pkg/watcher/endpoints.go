@@ -0,0 +1,93 @@
+package watcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+const (
+	EndpointActionAlert   = "alert"
+	endpointActionRestart = "restart"
+)
+
+func ValidEndpointAction(action string) bool {
+	return action == EndpointActionAlert || action == endpointActionRestart
+}
+
+// EndpointMonitor periodically dials the probe of every mapping of a
+// watched secret and compares the certificate served with the one in the
+// secret, catching pods that keep serving a stale certificate long after
+// their restart, or that were never restarted at all.
+type EndpointMonitor struct {
+	watcher  *Watcher
+	interval time.Duration
+	action   string
+
+	// stale remembers, by target, probe and fingerprint of the secret's
+	// certificate, the mismatches that were already acted on, so each one
+	// alerts or restarts only once until the endpoint is seen serving the
+	// right certificate.
+	stale map[string]bool
+}
+
+func NewEndpointMonitor(w *Watcher, interval time.Duration, action string) *EndpointMonitor {
+	return &EndpointMonitor{watcher: w, interval: interval, action: action, stale: map[string]bool{}}
+}
+
+// Run checks every interval until stopCh is closed.
+func (e *EndpointMonitor) Run(stopCh <-chan struct{}) {
+	fmt.Printf("Checking served certificates every %s\n", e.interval)
+	wait.Until(e.check, e.interval, stopCh)
+}
+
+func (e *EndpointMonitor) check() {
+	w := e.watcher
+	for _, secret := range w.watchedSecrets() {
+		cert, err := ParseCertificate(secret.Data[corev1.TLSCertKey])
+		if err != nil {
+			continue
+		}
+		fingerprint := sha256.Sum256(cert.Raw)
+		_, deployments := w.cachedSecret(secret.Namespace, secret.Name)
+
+		for _, m := range w.targetsFor(secret, deployments) {
+			if m.Probe == "" {
+				continue
+			}
+			key := fmt.Sprintf("%s/%s/%x", m.targetKey(), m.Probe, fingerprint)
+			served, err := servedCertificate(w.ctx, m.Probe)
+			if err != nil {
+				fmt.Printf("Failed to check the certificate served at %s: %v\n", m.Probe, err)
+				metrics.ProbeResults.WithLabelValues(m.Namespace, m.Kind, m.Deployment, probeError).Inc()
+				continue
+			}
+			if bytes.Equal(served, cert.Raw) {
+				metrics.ProbeResults.WithLabelValues(m.Namespace, m.Kind, m.Deployment, probeMatch).Inc()
+				metrics.EndpointStale.WithLabelValues(m.Namespace, m.Kind, m.Deployment, m.Probe).Set(0)
+				delete(e.stale, key)
+				continue
+			}
+			metrics.ProbeResults.WithLabelValues(m.Namespace, m.Kind, m.Deployment, probeMismatch).Inc()
+			metrics.EndpointStale.WithLabelValues(m.Namespace, m.Kind, m.Deployment, m.Probe).Set(1)
+			if e.stale[key] {
+				continue
+			}
+			e.stale[key] = true
+
+			fmt.Printf("%s serves a certificate other than the one in secret %s/%s\n", m.Probe, secret.Namespace, secret.Name)
+			target := w.restarter.Reference(w.ctx, m.Namespace, m.Kind, m.Deployment)
+			w.restarter.Recorder.Eventf(target, corev1.EventTypeWarning, restarter.ReasonStaleCertificate, "%s serves a certificate other than the one in secret %s", m.Probe, secret.Name)
+			if e.action == endpointActionRestart {
+				w.triggerValid(secret, []Mapping{m})
+			}
+		}
+	}
+}
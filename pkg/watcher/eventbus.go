@@ -0,0 +1,206 @@
+package watcher
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+const (
+	// Delivery guarantees of -event-bus-delivery.
+	deliveryAtMostOnce  = "at-most-once"
+	DeliveryAtLeastOnce = "at-least-once"
+
+	// SASL mechanisms of -event-bus-sasl-mechanism.
+	SASLPlain       = "plain"
+	saslSCRAMSHA256 = "scram-sha-256"
+	saslSCRAMSHA512 = "scram-sha-512"
+
+	// eventBusTimeout bounds a single publish to Kafka or NATS.
+	eventBusTimeout = 10 * time.Second
+
+	cloudEventsContentType = "application/cloudevents+json"
+)
+
+// EventBusOptions configures the Kafka and NATS sinks.
+type EventBusOptions struct {
+	// Username and Password authenticate through SASL on Kafka and as a
+	// user on NATS. A password without a username is a NATS token.
+	Username string
+	Password string
+	// SASLMechanism is one of SASLPlain, saslSCRAMSHA256 or saslSCRAMSHA512.
+	SASLMechanism string
+	// CredentialsFile is a NATS .creds file, used instead of a username.
+	CredentialsFile string
+	TLS             bool
+	// Delivery is deliveryAtMostOnce or DeliveryAtLeastOnce. At least once
+	// waits for every broker replica on Kafka, publishes through JetStream
+	// on NATS, and retries failed publishes on every sink.
+	Delivery string
+}
+
+// ValidDelivery reports whether delivery is a known delivery guarantee.
+func ValidDelivery(delivery string) bool {
+	return delivery == deliveryAtMostOnce || delivery == DeliveryAtLeastOnce
+}
+
+// ReadPassword returns the trimmed contents of path, or "" when path is
+// empty.
+func ReadPassword(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// kafkaEventSink produces every event to a Kafka topic in structured mode,
+// keyed by its subject so that the events of one target stay in order.
+type kafkaEventSink struct {
+	writer *kafka.Writer
+}
+
+// newKafkaEventSink returns a sink for kafka://broker[,broker...]/topic.
+func newKafkaEventSink(u *url.URL, opts EventBusOptions) (*kafkaEventSink, error) {
+	topic := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || topic == "" {
+		return nil, fmt.Errorf("a Kafka sink needs brokers and a topic, as in kafka://broker:9092/topic")
+	}
+	transport := &kafka.Transport{}
+	if opts.TLS {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if opts.Username != "" {
+		mechanism, err := saslMechanism(opts)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+	acks := kafka.RequireAll
+	if opts.Delivery == deliveryAtMostOnce {
+		acks = kafka.RequireNone
+	}
+	return &kafkaEventSink{writer: &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(u.Host, ",")...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: acks,
+		BatchTimeout: 10 * time.Millisecond,
+		Transport:    transport,
+	}}, nil
+}
+
+func saslMechanism(opts EventBusOptions) (sasl.Mechanism, error) {
+	switch opts.SASLMechanism {
+	case "", SASLPlain:
+		return plain.Mechanism{Username: opts.Username, Password: opts.Password}, nil
+	case saslSCRAMSHA256:
+		return scram.Mechanism(scram.SHA256, opts.Username, opts.Password)
+	case saslSCRAMSHA512:
+		return scram.Mechanism(scram.SHA512, opts.Username, opts.Password)
+	default:
+		return nil, fmt.Errorf("unknown SASL mechanism %q", opts.SASLMechanism)
+	}
+}
+
+func (s *kafkaEventSink) publish(e cloudEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), eventBusTimeout)
+	defer cancel()
+	return s.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(e.Subject),
+		Value:   body,
+		Headers: []kafka.Header{{Key: "content-type", Value: []byte(cloudEventsContentType)}},
+	})
+}
+
+func (s *kafkaEventSink) Close() error {
+	return s.writer.Close()
+}
+
+// natsEventSink publishes every event to a NATS subject in structured mode.
+type natsEventSink struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	subject string
+}
+
+// newNATSEventSink returns a sink for nats://server[,server...]/subject. At
+// least once delivery needs a JetStream stream capturing the subject.
+func newNATSEventSink(u *url.URL, opts EventBusOptions) (*natsEventSink, error) {
+	subject := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || subject == "" {
+		return nil, fmt.Errorf("a NATS sink needs servers and a subject, as in nats://nats:4222/subject")
+	}
+	var servers []string
+	for _, host := range strings.Split(u.Host, ",") {
+		servers = append(servers, "nats://"+host)
+	}
+
+	options := []nats.Option{nats.Name(restarter.EventSource)}
+	switch {
+	case opts.CredentialsFile != "":
+		options = append(options, nats.UserCredentials(opts.CredentialsFile))
+	case opts.Username != "":
+		options = append(options, nats.UserInfo(opts.Username, opts.Password))
+	case opts.Password != "":
+		options = append(options, nats.Token(opts.Password))
+	}
+	if opts.TLS {
+		options = append(options, nats.Secure(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+	conn, err := nats.Connect(strings.Join(servers, ","), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &natsEventSink{conn: conn, subject: subject}
+	if opts.Delivery == DeliveryAtLeastOnce {
+		if s.js, err = conn.JetStream(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *natsEventSink) publish(e cloudEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(s.subject)
+	msg.Data = body
+	msg.Header.Set("Content-Type", cloudEventsContentType)
+	if s.js != nil {
+		// Publishing through JetStream waits for the stream to
+		// acknowledge the message.
+		_, err = s.js.PublishMsg(msg, nats.AckWait(eventBusTimeout))
+		return err
+	}
+	return s.conn.PublishMsg(msg)
+}
+
+func (s *natsEventSink) Close() error {
+	return s.conn.Drain()
+}
@@ -0,0 +1,191 @@
+package watcher
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+)
+
+const (
+	expiryActionMetric  = "metric"
+	expiryActionEvent   = "event"
+	expiryActionWebhook = "webhook"
+	// expiryActionRenew asks cert-manager to re-issue the Certificate that
+	// owns the secret.
+	expiryActionRenew = "renew"
+)
+
+// expiryAlert is the webhook payload sent for a certificate that is about
+// to expire.
+type expiryAlert struct {
+	Namespace string    `json:"namespace"`
+	Secret    string    `json:"secret"`
+	Subject   string    `json:"subject"`
+	NotAfter  time.Time `json:"notAfter"`
+	Remaining string    `json:"remaining"`
+}
+
+// ExpiryScanner periodically checks the certificates of watched secrets and
+// alerts when one gets within threshold of its notAfter, whether or not the
+// secret has changed.
+type ExpiryScanner struct {
+	watcher    *Watcher
+	threshold  time.Duration
+	interval   time.Duration
+	actions    map[string]bool
+	webhookURL string
+	recorder   record.EventRecorder
+	// Dynamic is used by the renew action to update Certificates.
+	Dynamic dynamic.Interface
+
+	// alerted remembers certificates that already fired, by namespace,
+	// secret and serial, so each one is only reported once.
+	alerted map[string]bool
+}
+
+func NewExpiryScanner(w *Watcher, threshold, interval time.Duration, actions map[string]bool, webhookURL string, recorder record.EventRecorder) *ExpiryScanner {
+	return &ExpiryScanner{
+		watcher:    w,
+		threshold:  threshold,
+		interval:   interval,
+		actions:    actions,
+		webhookURL: webhookURL,
+		recorder:   recorder,
+		alerted:    map[string]bool{},
+	}
+}
+
+func ValidExpiryActions(actions map[string]bool) error {
+	for action := range actions {
+		switch action {
+		case expiryActionMetric, expiryActionEvent, expiryActionWebhook, expiryActionRenew, expiryActionIncident:
+		default:
+			return fmt.Errorf("unknown expiry action %q", action)
+		}
+	}
+	return nil
+}
+
+// Run scans every interval until stopCh is closed.
+func (s *ExpiryScanner) Run(stopCh <-chan struct{}) {
+	fmt.Printf("Checking certificate expiry every %s with a threshold of %s\n", s.interval, s.threshold)
+	wait.Until(s.scan, s.interval, stopCh)
+}
+
+func (s *ExpiryScanner) scan() {
+	for _, secret := range s.watcher.watchedSecrets() {
+		data, ok := secret.Data[corev1.TLSCertKey]
+		if !ok {
+			continue
+		}
+		cert, err := ParseCertificate(data)
+		if err != nil {
+			continue
+		}
+
+		remaining := time.Until(cert.NotAfter)
+		expiring := remaining < s.threshold
+
+		if s.actions[expiryActionMetric] {
+			value := 0.0
+			if expiring {
+				value = 1
+			}
+			metrics.CertificateExpiring.WithLabelValues(secret.Namespace, secret.Name).Set(value)
+		}
+
+		if !expiring && s.actions[expiryActionIncident] {
+			s.watcher.Incidents.notExpiring(secret)
+		}
+
+		key := fmt.Sprintf("%s/%s/%s", secret.Namespace, secret.Name, cert.SerialNumber)
+		if !expiring || s.alerted[key] {
+			continue
+		}
+		s.alerted[key] = true
+
+		fmt.Printf("Certificate in secret %s/%s expires in %s\n", secret.Namespace, secret.Name, remaining.Round(time.Minute))
+		if s.actions[expiryActionEvent] {
+			s.recorder.Eventf(secret, corev1.EventTypeWarning, "CertificateExpiring", "Certificate %s expires in %s at %s", cert.Subject.CommonName, remaining.Round(time.Minute), cert.NotAfter.Format(time.RFC3339))
+		}
+		if s.actions[expiryActionWebhook] && s.webhookURL != "" {
+			alert := expiryAlert{
+				Namespace: secret.Namespace,
+				Secret:    secret.Name,
+				Subject:   cert.Subject.String(),
+				NotAfter:  cert.NotAfter,
+				Remaining: remaining.Round(time.Minute).String(),
+			}
+			if err := notify.PostJSON(s.webhookURL, alert); err != nil {
+				fmt.Printf("Failed to send expiry alert for secret %s/%s: %v\n", secret.Namespace, secret.Name, err)
+			}
+		}
+		if s.actions[expiryActionIncident] {
+			s.watcher.Incidents.expiring(secret, cert)
+		}
+		if s.actions[expiryActionRenew] {
+			s.renew(secret)
+		}
+	}
+}
+
+// renew triggers re-issuance of the cert-manager Certificate that owns
+// secret, the equivalent of `cmctl renew`: it sets the Certificate's Issuing
+// condition, which cert-manager acts on as if the renewal time had come.
+func (s *ExpiryScanner) renew(secret *corev1.Secret) {
+	name := secret.Annotations[certificateNameAnnotation]
+	if name == "" {
+		fmt.Printf("Secret %s/%s is not managed by cert-manager, not renewing\n", secret.Namespace, secret.Name)
+		return
+	}
+
+	client := s.Dynamic.Resource(certificatesResource).Namespace(secret.Namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		certificate, err := client.Get(s.watcher.ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		conditions, _, _ := unstructured.NestedSlice(certificate.Object, "status", "conditions")
+		var kept []interface{}
+		for _, raw := range conditions {
+			if condition, ok := raw.(map[string]interface{}); ok && condition["type"] == "Issuing" {
+				if condition["status"] == string(metav1.ConditionTrue) {
+					// Already being issued.
+					return nil
+				}
+				continue
+			}
+			kept = append(kept, raw)
+		}
+		kept = append(kept, map[string]interface{}{
+			"type":               "Issuing",
+			"status":             string(metav1.ConditionTrue),
+			"reason":             "ManuallyTriggered",
+			"message":            "Certificate re-issuance triggered by cert-watcher ahead of expiry",
+			"lastTransitionTime": time.Now().UTC().Format(time.RFC3339),
+			"observedGeneration": certificate.GetGeneration(),
+		})
+		if err := unstructured.SetNestedSlice(certificate.Object, kept, "status", "conditions"); err != nil {
+			return err
+		}
+		_, err = client.UpdateStatus(s.watcher.ctx, certificate, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Failed to renew Certificate %s/%s: %v\n", secret.Namespace, name, err)
+		return
+	}
+	fmt.Printf("Triggered renewal of Certificate %s/%s\n", secret.Namespace, name)
+	s.recorder.Eventf(secret, corev1.EventTypeNormal, "RenewalTriggered", "Triggered renewal of Certificate %s", name)
+}
@@ -0,0 +1,100 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// FileWatcher watches certificate files on disk instead of the Kubernetes
+// API and calls OnChange whenever their contents change.
+//
+// Kubernetes updates mounted secrets by swapping a symlink in the mount
+// directory, and other tools rename new files into place, so the parent
+// directory of every path is watched rather than the files themselves and
+// the contents are compared after each event.
+type FileWatcher struct {
+	Paths    []string
+	OnChange func()
+}
+
+// Run watches until stopCh is closed.
+func (f *FileWatcher) Run(stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, path := range f.Paths {
+		dir := path
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			dir = filepath.Dir(path)
+		}
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("watching %s: %w", dir, err)
+		}
+	}
+
+	last, err := f.hash()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Watching files %s\n", strings.Join(f.Paths, ", "))
+
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case err := <-watcher.Errors:
+			fmt.Printf("File watch error: %v\n", err)
+		case <-watcher.Events:
+			current, err := f.hash()
+			if err != nil {
+				// A file is missing halfway through an update; a later
+				// event sees the finished one.
+				continue
+			}
+			if current != last {
+				last = current
+				f.OnChange()
+			}
+		}
+	}
+}
+
+// hash returns the dataHash of every watched file. A directory stands for
+// the regular files directly inside it, skipping the hidden entries that
+// Kubernetes uses for its atomic updates.
+func (f *FileWatcher) hash() (string, error) {
+	data := map[string][]byte{}
+	for _, path := range f.Paths {
+		files := []string{path}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return "", err
+			}
+			files = nil
+			for _, entry := range entries {
+				if !strings.HasPrefix(entry.Name(), ".") {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil && info.IsDir() {
+				continue
+			}
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return "", err
+			}
+			data[file] = content
+		}
+	}
+	return dataHash(data), nil
+}
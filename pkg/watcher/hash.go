@@ -0,0 +1,54 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// dataHash returns a stable SHA-256 over the keys and values of a secret's
+// data, so two versions can be compared regardless of map ordering.
+func dataHash(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		// Keys cannot contain NUL; values are length-prefixed so that no two
+		// different maps hash the same input.
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		binary.Write(h, binary.BigEndian, uint64(len(data[k])))
+		h.Write(data[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// configMapData returns the Data and BinaryData of a ConfigMap as one map.
+func configMapData(configMap *corev1.ConfigMap) map[string][]byte {
+	data := map[string][]byte{}
+	for k, v := range configMap.Data {
+		data[k] = []byte(v)
+	}
+	for k, v := range configMap.BinaryData {
+		data[k] = v
+	}
+	return data
+}
+
+// selectKeys returns the subset of data stored under keys.
+func selectKeys(data map[string][]byte, keys []string) map[string][]byte {
+	selected := map[string][]byte{}
+	for _, k := range keys {
+		if v, ok := data[k]; ok {
+			selected[k] = v
+		}
+	}
+	return selected
+}
@@ -0,0 +1,57 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// HealthChecker serves the liveness and readiness endpoints.
+type HealthChecker struct {
+	clientset kubernetes.Interface
+	watcher   *Watcher
+
+	// started is set once the initial informers have been started, or
+	// straight away for leader election followers which have none.
+	started atomic.Bool
+}
+
+func NewHealthChecker(clientset kubernetes.Interface, w *Watcher) *HealthChecker {
+	return &HealthChecker{clientset: clientset, watcher: w}
+}
+
+func (h *HealthChecker) MarkStarted() {
+	h.started.Store(true)
+}
+
+// Healthz reports that the process is alive and serving HTTP.
+func (h *HealthChecker) Healthz(rw http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(rw, "ok")
+}
+
+// Readyz reports ready once every informer cache has synced and the API
+// server answers its own health check.
+func (h *HealthChecker) Readyz(rw http.ResponseWriter, r *http.Request) {
+	if err := h.ready(r.Context()); err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(rw, "ok")
+}
+
+func (h *HealthChecker) ready(ctx context.Context) error {
+	if !h.started.Load() || !h.watcher.synced() {
+		return fmt.Errorf("informer caches not synced")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := h.clientset.Discovery().RESTClient().Get().AbsPath("/healthz").Do(ctx).Error(); err != nil {
+		return fmt.Errorf("API server unreachable: %v", err)
+	}
+	return nil
+}
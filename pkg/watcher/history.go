@@ -0,0 +1,311 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+)
+
+const (
+	// Events recorded in the restart history.
+	historyDetected  = "Detected"
+	historyScheduled = "Scheduled"
+	historySucceeded = "Succeeded"
+	historyFailed    = "Failed"
+
+	// StateHistory is the document holding the restart history.
+	StateHistory = "history"
+)
+
+// HistoryRecord is one entry of the restart history. Detected records name
+// only the changed source; the others also name the target.
+type HistoryRecord struct {
+	Time       time.Time  `json:"time"`
+	Event      string     `json:"event"`
+	Namespace  string     `json:"namespace"`
+	SourceKind string     `json:"sourceKind"`
+	Source     string     `json:"source"`
+	Kind       string     `json:"kind,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	Due        *time.Time `json:"due,omitempty"`
+	Rollout    string     `json:"rollout,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// DocumentStore keeps named JSON documents. StateStore keeps them in a
+// ConfigMap and FileStore in a local file.
+type DocumentStore interface {
+	Load(ctx context.Context, key string, v interface{}) error
+	Save(ctx context.Context, key string, v interface{}) error
+}
+
+// FileStore keeps JSON documents as the members of a JSON object in a file,
+// such as one on a persistent volume.
+type FileStore struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (s *FileStore) read() (map[string]json.RawMessage, error) {
+	documents := map[string]json.RawMessage{}
+	data, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return documents, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return documents, json.Unmarshal(data, &documents)
+}
+
+// Load decodes the document stored under key into v. A missing file or key
+// leaves v untouched.
+func (s *FileStore) Load(ctx context.Context, key string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	documents, err := s.read()
+	if err != nil {
+		return err
+	}
+	data, ok := documents[key]
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Save stores v under key, replacing the file atomically.
+func (s *FileStore) Save(ctx context.Context, key string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	documents, err := s.read()
+	if err != nil {
+		return err
+	}
+	if documents[key], err = json.Marshal(v); err != nil {
+		return err
+	}
+	data, err := json.Marshal(documents)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), ".history-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// RestartHistory keeps the latest size rotation and restart records, and
+// with a store, saves them every stateSyncInterval. A nil *RestartHistory
+// records nothing.
+type RestartHistory struct {
+	size  int
+	store DocumentStore
+
+	mu      sync.Mutex
+	records []HistoryRecord
+	// loaded is set once the stored history has been loaded; nothing is
+	// saved before, so that a follower never overwrites the leader's
+	// history.
+	loaded bool
+	dirty  bool
+}
+
+func NewRestartHistory(size int, store DocumentStore) *RestartHistory {
+	return &RestartHistory{size: size, store: store, loaded: store == nil}
+}
+
+func (h *RestartHistory) add(r HistoryRecord) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	if len(h.records) > h.size {
+		h.records = append([]HistoryRecord{}, h.records[len(h.records)-h.size:]...)
+	}
+	h.dirty = true
+}
+
+// detectedRecord records a change of the source of m.
+func detectedRecord(m Mapping) HistoryRecord {
+	return HistoryRecord{Time: time.Now().UTC(), Event: historyDetected, Namespace: m.Namespace, SourceKind: m.sourceKind(), Source: m.sourceName()}
+}
+
+// scheduledRecord records the restart of m due at due.
+func scheduledRecord(m Mapping, due time.Time) HistoryRecord {
+	due = due.UTC()
+	return HistoryRecord{
+		Time:       time.Now().UTC(),
+		Event:      historyScheduled,
+		Namespace:  m.Namespace,
+		SourceKind: m.sourceKind(),
+		Source:     m.sourceName(),
+		Kind:       m.Kind,
+		Name:       m.Deployment,
+		Due:        &due,
+	}
+}
+
+// restartedRecord records n, the outcome of a restart.
+func restartedRecord(n notify.Notification) HistoryRecord {
+	event := historySucceeded
+	if n.Outcome == notify.Failed {
+		event = historyFailed
+	}
+	return HistoryRecord{
+		Time:       n.Timestamp,
+		Event:      event,
+		Namespace:  n.Namespace,
+		SourceKind: n.SourceKind,
+		Source:     n.Source,
+		Kind:       n.Kind,
+		Name:       n.Deployment,
+		Rollout:    n.Rollout,
+		Error:      n.Error,
+	}
+}
+
+// HistoryFilter selects history records. Empty fields match anything.
+type HistoryFilter struct {
+	Namespace string
+	Kind      string
+	Name      string
+	Source    string
+	Event     string
+	Since     time.Time
+	// Limit keeps only the latest records when positive.
+	Limit int
+}
+
+// ParseHistoryFilter reads a filter from the namespace, kind, name, source,
+// event, since and limit query parameters. since is an RFC 3339 time or a
+// duration before now.
+func ParseHistoryFilter(query url.Values) (HistoryFilter, error) {
+	f := HistoryFilter{
+		Namespace: query.Get("namespace"),
+		Kind:      query.Get("kind"),
+		Name:      query.Get("name"),
+		Source:    query.Get("source"),
+		Event:     query.Get("event"),
+	}
+	if since := query.Get("since"); since != "" {
+		if d, err := time.ParseDuration(since); err == nil {
+			f.Since = time.Now().Add(-d)
+		} else if f.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return f, fmt.Errorf("since must be a duration or an RFC 3339 time")
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if f.Limit, err = strconv.Atoi(limit); err != nil || f.Limit < 0 {
+			return f, fmt.Errorf("limit must be a non-negative integer")
+		}
+	}
+	return f, nil
+}
+
+func (f HistoryFilter) matches(r HistoryRecord) bool {
+	return (f.Namespace == "" || r.Namespace == f.Namespace) &&
+		(f.Kind == "" || r.Kind == f.Kind) &&
+		(f.Name == "" || r.Name == f.Name) &&
+		(f.Source == "" || r.Source == f.Source) &&
+		(f.Event == "" || r.Event == f.Event) &&
+		!r.Time.Before(f.Since)
+}
+
+// Apply returns the records matching f, oldest first.
+func (f HistoryFilter) Apply(records []HistoryRecord) []HistoryRecord {
+	matched := []HistoryRecord{}
+	for _, r := range records {
+		if f.matches(r) {
+			matched = append(matched, r)
+		}
+	}
+	if f.Limit > 0 && len(matched) > f.Limit {
+		matched = matched[len(matched)-f.Limit:]
+	}
+	return matched
+}
+
+// query returns the records matching f, oldest first.
+func (h *RestartHistory) query(f HistoryFilter) []HistoryRecord {
+	if h == nil {
+		return []HistoryRecord{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return f.Apply(h.records)
+}
+
+// Load prepends the stored history to the records taken so far.
+func (h *RestartHistory) Load(ctx context.Context) error {
+	if h == nil || h.store == nil {
+		return nil
+	}
+	var stored []HistoryRecord
+	if err := h.store.Load(ctx, StateHistory, &stored); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(stored, h.records...)
+	if len(h.records) > h.size {
+		h.records = h.records[len(h.records)-h.size:]
+	}
+	h.loaded = true
+	return nil
+}
+
+// Save stores the history if it changed since the last save.
+func (h *RestartHistory) Save(ctx context.Context) error {
+	if h == nil || h.store == nil {
+		return nil
+	}
+	h.mu.Lock()
+	if !h.loaded || !h.dirty {
+		h.mu.Unlock()
+		return nil
+	}
+	records := append([]HistoryRecord{}, h.records...)
+	h.dirty = false
+	h.mu.Unlock()
+
+	if err := h.store.Save(ctx, StateHistory, records); err != nil {
+		h.mu.Lock()
+		h.dirty = true
+		h.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// RunSync saves the history every stateSyncInterval until stopCh closes.
+func (h *RestartHistory) RunSync(stopCh <-chan struct{}) {
+	ctx := wait.ContextForChannel(stopCh)
+	wait.Until(func() {
+		if err := h.Save(ctx); err != nil {
+			fmt.Printf("Failed to save the restart history: %v\n", err)
+		}
+	}, stateSyncInterval, stopCh)
+}
@@ -0,0 +1,111 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+const (
+	hookPreRestart  = "preRestart"
+	hookPostRestart = "postRestart"
+
+	// hookFailureFail fails the restart when its hook fails: a failed
+	// preRestart hook prevents the restart, which is retried, and a failed
+	// postRestart hook reports the restart as failed.
+	hookFailureFail = "fail"
+	// hookFailureAnnotate carries on, recording the failure in the
+	// hookFailedAnnotation of the workload.
+	hookFailureAnnotate = "annotate"
+
+	defaultHookTimeout = 30 * time.Second
+)
+
+// Hook is run around the restart of a mapping's workload. Exactly one of URL
+// and Exec is set.
+type Hook struct {
+	// URL receives a POST of the hookPayload as JSON; any non-2xx response
+	// fails the hook.
+	URL string `json:"url,omitempty"`
+	// Exec runs a command in every running pod of the workload.
+	Exec *ExecHook `json:"exec,omitempty"`
+	// Timeout bounds the whole hook; it defaults to defaultHookTimeout.
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// OnFailure is hookFailureFail (the default) or hookFailureAnnotate.
+	OnFailure string `json:"onFailure,omitempty"`
+}
+
+// ExecHook is a command run in the pods of a workload; a non-zero exit
+// fails the hook.
+type ExecHook struct {
+	// Container defaults to the pod's first container.
+	Container string   `json:"container,omitempty"`
+	Command   []string `json:"command"`
+}
+
+// hookPayload is the body POSTed to a URL hook.
+type hookPayload struct {
+	Phase string `json:"phase"`
+	notify.Notification
+}
+
+func (h *Hook) validate() error {
+	if (h.URL == "") == (h.Exec == nil) {
+		return fmt.Errorf("exactly one of url and exec is required")
+	}
+	if h.Exec != nil && len(h.Exec.Command) == 0 {
+		return fmt.Errorf("exec needs a command")
+	}
+	if h.OnFailure != "" && h.OnFailure != hookFailureFail && h.OnFailure != hookFailureAnnotate {
+		return fmt.Errorf("unknown onFailure %q", h.OnFailure)
+	}
+	return nil
+}
+
+// runHook runs the hook of phase for m, if any, and returns the error that
+// its failure policy passes on: nil unless the hook failed with the fail
+// policy. Failures are logged and recorded as Events on the target either
+// way.
+func (w *Watcher) runHook(ctx context.Context, phase string, hook *Hook, m Mapping, target *corev1.ObjectReference) error {
+	if hook == nil {
+		return nil
+	}
+	timeout := defaultHookTimeout
+	if hook.Timeout != nil {
+		timeout = hook.Timeout.Duration
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, phase+" hook")
+
+	var err error
+	if hook.URL != "" {
+		err = notify.PostJSON(hook.URL, hookPayload{Phase: phase, Notification: newRestartNotification(m, nil)})
+	} else {
+		err = w.restarter.Exec(ctx, m.Namespace, m.Kind, m.Deployment, hook.Exec.Container, hook.Exec.Command)
+	}
+	endSpan(span, err)
+
+	annotate := hook.OnFailure == hookFailureAnnotate
+	if err == nil {
+		if annotate {
+			w.restarter.SetHookFailed(ctx, m.Namespace, m.Kind, m.Deployment, nil)
+		}
+		return nil
+	}
+	fmt.Printf("%s hook of %s %s failed: %v\n", phase, m.Kind, m.Deployment, err)
+	metrics.HookFailures.WithLabelValues(m.Namespace, m.Kind, m.Deployment, phase).Inc()
+	w.restarter.Recorder.Eventf(target, corev1.EventTypeWarning, restarter.ReasonHookFailed, "%s hook failed: %v", phase, err)
+	if annotate {
+		w.restarter.SetHookFailed(ctx, m.Namespace, m.Kind, m.Deployment, fmt.Errorf("%s: %w", phase, err))
+		return nil
+	}
+	return fmt.Errorf("%s hook: %w", phase, err)
+}
@@ -0,0 +1,223 @@
+package watcher
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+const (
+	// expiryActionIncident opens an incident for an expiring certificate.
+	expiryActionIncident = "incident"
+
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+	DefaultOpsgenieURL = "https://api.opsgenie.com"
+)
+
+// incident is an alert raised in an incident management tool. Raising the
+// same dedupKey again updates the open incident rather than opening another.
+type incident struct {
+	dedupKey string
+	summary  string
+	// critical distinguishes failed restarts from expiry warnings.
+	critical bool
+	details  map[string]string
+}
+
+// IncidentSink opens and resolves Incidents in one tool.
+type IncidentSink interface {
+	trigger(i incident) error
+	resolve(dedupKey string) error
+}
+
+// PagerDutySink raises Incidents through the PagerDuty Events API v2.
+type PagerDutySink struct {
+	RoutingKey string
+}
+
+func (p PagerDutySink) trigger(i incident) error {
+	severity := "warning"
+	if i.critical {
+		severity = "error"
+	}
+	return notify.PostJSON(pagerDutyEventsURL, map[string]interface{}{
+		"routing_key":  p.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    i.dedupKey,
+		"payload": map[string]interface{}{
+			"summary":        i.summary,
+			"source":         restarter.EventSource,
+			"severity":       severity,
+			"custom_details": i.details,
+		},
+	})
+}
+
+func (p PagerDutySink) resolve(dedupKey string) error {
+	return notify.PostJSON(pagerDutyEventsURL, map[string]interface{}{
+		"routing_key":  p.RoutingKey,
+		"event_action": "resolve",
+		"dedup_key":    dedupKey,
+	})
+}
+
+// OpsgenieSink raises alerts through the Opsgenie Alert API, using the
+// dedup key as the alert alias.
+type OpsgenieSink struct {
+	APIURL string
+	APIKey string
+}
+
+func (o OpsgenieSink) header() http.Header {
+	return http.Header{"Authorization": {"GenieKey " + o.APIKey}}
+}
+
+func (o OpsgenieSink) trigger(i incident) error {
+	priority := "P3"
+	if i.critical {
+		priority = "P2"
+	}
+	return notify.PostJSONHeader(o.APIURL+"/v2/alerts", o.header(), map[string]interface{}{
+		"message":  truncate(i.summary, 130),
+		"alias":    i.dedupKey,
+		"priority": priority,
+		"source":   restarter.EventSource,
+		"details":  i.details,
+	})
+}
+
+func (o OpsgenieSink) resolve(dedupKey string) error {
+	return notify.PostJSONHeader(o.APIURL+"/v2/alerts/"+url.PathEscape(dedupKey)+"/close?identifierType=alias", o.header(), map[string]string{"source": restarter.EventSource})
+}
+
+// truncate shortens s to at most n bytes.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// Incidents opens an incident once the restarts of a target have failed
+// threshold times in a row, or a watched certificate is about to expire,
+// and resolves it once the target restarts or the certificate is renewed.
+// A nil *Incidents raises nothing.
+type Incidents struct {
+	sinks     []IncidentSink
+	threshold int
+
+	mu sync.Mutex
+	// failures counts the consecutive failed restarts of each target.
+	failures map[string]int
+	// open holds the dedup keys of the Incidents raised and not resolved.
+	open map[string]bool
+}
+
+func NewIncidents(sinks []IncidentSink, threshold int) *Incidents {
+	return &Incidents{sinks: sinks, threshold: threshold, failures: map[string]int{}, open: map[string]bool{}}
+}
+
+// restarted records the outcome of a restart of m.
+func (in *Incidents) restarted(m Mapping, outcome error) {
+	if in == nil {
+		return
+	}
+	key := "cert-watcher/restart/" + m.targetKey()
+
+	in.mu.Lock()
+	if outcome == nil {
+		delete(in.failures, m.targetKey())
+		wasOpen := in.open[key]
+		delete(in.open, key)
+		in.mu.Unlock()
+		if wasOpen {
+			in.resolve(key)
+		}
+		return
+	}
+	in.failures[m.targetKey()]++
+	failures := in.failures[m.targetKey()]
+	in.open[key] = in.open[key] || failures >= in.threshold
+	in.mu.Unlock()
+
+	if failures < in.threshold {
+		return
+	}
+	in.trigger(incident{
+		dedupKey: key,
+		summary:  fmt.Sprintf("%s %s/%s failed to restart %d times after %s %s changed", m.Kind, m.Namespace, m.Deployment, failures, m.sourceKind(), m.sourceName()),
+		critical: true,
+		details: map[string]string{
+			"namespace":  m.Namespace,
+			"kind":       m.Kind,
+			"name":       m.Deployment,
+			"sourceKind": m.sourceKind(),
+			"source":     m.sourceName(),
+			"failures":   fmt.Sprint(failures),
+			"error":      outcome.Error(),
+		},
+	})
+}
+
+// expiring raises an incident for the certificate of secret.
+func (in *Incidents) expiring(secret *corev1.Secret, cert *x509.Certificate) {
+	if in == nil {
+		return
+	}
+	key := "cert-watcher/expiry/" + secret.Namespace + "/" + secret.Name
+	in.mu.Lock()
+	in.open[key] = true
+	in.mu.Unlock()
+
+	remaining := time.Until(cert.NotAfter).Round(time.Minute)
+	in.trigger(incident{
+		dedupKey: key,
+		summary:  fmt.Sprintf("Certificate %s in secret %s/%s expires in %s", cert.Subject.CommonName, secret.Namespace, secret.Name, remaining),
+		details: map[string]string{
+			"namespace": secret.Namespace,
+			"secret":    secret.Name,
+			"subject":   cert.Subject.String(),
+			"notAfter":  cert.NotAfter.Format(time.RFC3339),
+			"remaining": remaining.String(),
+		},
+	})
+}
+
+// notExpiring resolves the expiry incident of secret, if one is open.
+func (in *Incidents) notExpiring(secret *corev1.Secret) {
+	if in == nil {
+		return
+	}
+	key := "cert-watcher/expiry/" + secret.Namespace + "/" + secret.Name
+	in.mu.Lock()
+	wasOpen := in.open[key]
+	delete(in.open, key)
+	in.mu.Unlock()
+	if wasOpen {
+		in.resolve(key)
+	}
+}
+
+func (in *Incidents) trigger(i incident) {
+	for _, sink := range in.sinks {
+		if err := sink.trigger(i); err != nil {
+			fmt.Printf("Failed to raise incident %s: %v\n", i.dedupKey, err)
+		}
+	}
+}
+
+func (in *Incidents) resolve(dedupKey string) {
+	for _, sink := range in.sinks {
+		if err := sink.resolve(dedupKey); err != nil {
+			fmt.Printf("Failed to resolve incident %s: %v\n", dedupKey, err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package watcher
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+// discoverKnativeServices returns the names of the Knative Services in the
+// secret's namespace that reference it according to the configured
+// discovery mode. Services are listed from the API server, as changes of
+// watched secrets are rare.
+func (w *Watcher) discoverKnativeServices(secret *corev1.Secret) []string {
+	list, err := w.restarter.Dynamic.Resource(restarter.KnativeServicesResource).Namespace(secret.Namespace).List(w.ctx, metav1.ListOptions{})
+	if err != nil {
+		fmt.Printf("Failed to list Knative Services in namespace %s: %v\n", secret.Namespace, err)
+		return nil
+	}
+
+	var names []string
+	for _, service := range list.Items {
+		if discoveryIgnored(service.GetAnnotations()) {
+			continue
+		}
+		switch w.discovery {
+		case discoveryAnnotation:
+			if annotationReferences(service.GetAnnotations(), secret.Name) {
+				names = append(names, service.GetName())
+			}
+		case discoveryPodSpec:
+			raw, _, _ := unstructured.NestedMap(service.Object, "spec", "template", "spec")
+			var spec corev1.PodSpec
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &spec); err != nil {
+				continue
+			}
+			if restarter.PodSpecReferences(&spec, secret.Name) {
+				names = append(names, service.GetName())
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,27 @@
+package watcher
+
+import "net/http"
+
+// SetStandby marks the watcher as a leader election follower, which must not
+// restart anything, or as the leader once it holds the Lease. A watcher
+// starts out as the leader, as it is without leader election.
+func (w *Watcher) SetStandby(standby bool) {
+	w.standby.Store(standby)
+}
+
+// leading reports whether this replica may restart workloads.
+func (w *Watcher) leading() bool {
+	return !w.standby.Load()
+}
+
+// leaderOnly responds with 503 while this replica is a follower, whose
+// restarts would double the leader's, instead of calling next.
+func (w *Watcher) leaderOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !w.leading() {
+			http.Error(rw, "this replica is not the leader", http.StatusServiceUnavailable)
+			return
+		}
+		next(rw, r)
+	}
+}
@@ -0,0 +1,29 @@
+package watcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLeaderOnly(t *testing.T) {
+	w, _ := newTestWatcher(nil)
+	handler := w.leaderOnly(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, test := range []struct {
+		standby bool
+		want    int
+	}{
+		{false, http.StatusNoContent},
+		{true, http.StatusServiceUnavailable},
+	} {
+		w.SetStandby(test.standby)
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest(http.MethodPost, "/api/v1/pause", nil))
+		if rw.Code != test.want {
+			t.Errorf("standby %v: status = %d, want %d", test.standby, rw.Code, test.want)
+		}
+	}
+}
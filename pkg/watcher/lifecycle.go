@@ -0,0 +1,66 @@
+package watcher
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+const (
+	// What -on-create does with a secret created while the watcher runs.
+	CreateActionIgnore  = "ignore"
+	createActionRestart = "restart"
+
+	// What -on-delete does with the targets of a deleted secret.
+	deleteActionEvent     = "event"
+	deleteActionNotify    = "notify"
+	deleteActionScaleDown = "scale-down"
+)
+
+// ValidCreateAction reports whether action is a known -on-create action.
+func ValidCreateAction(action string) bool {
+	return action == CreateActionIgnore || action == createActionRestart
+}
+
+// ValidDeleteActions returns an error naming the first unknown -on-delete
+// action.
+func ValidDeleteActions(actions map[string]bool) error {
+	for action := range actions {
+		switch action {
+		case deleteActionEvent, deleteActionNotify, deleteActionScaleDown:
+		default:
+			return fmt.Errorf("unknown delete action %q", action)
+		}
+	}
+	return nil
+}
+
+// sourceDeleted applies the -on-delete actions to the targets of a deleted
+// secret. Workloads keep running with the certificate they mounted, but
+// their pods will fail to start once rescheduled, so scale-down takes them
+// out of service deliberately instead.
+func (w *Watcher) sourceDeleted(targets []Mapping) {
+	for _, m := range targets {
+		fmt.Printf("%s %s/%s used by %s %s was deleted\n", m.sourceKind(), m.Namespace, m.sourceName(), m.Kind, m.Deployment)
+		target := w.restarter.Reference(w.ctx, m.Namespace, m.Kind, m.Deployment)
+		if w.OnDelete[deleteActionEvent] {
+			w.restarter.Recorder.Eventf(target, corev1.EventTypeWarning, restarter.ReasonSourceDeleted, "%s %s was deleted", m.sourceKind(), m.sourceName())
+		}
+		if w.OnDelete[deleteActionNotify] {
+			n := newRestartNotification(m, nil)
+			n.Outcome = notify.SourceDeleted
+			w.Notifiers.Send(n)
+		}
+		if w.OnDelete[deleteActionScaleDown] {
+			if err := w.restarter.ScaleDown(w.ctx, m.Namespace, m.Kind, m.Deployment); err != nil {
+				fmt.Printf("Failed to scale down %s %s: %v\n", m.Kind, m.Deployment, err)
+				continue
+			}
+			fmt.Printf("Scaled %s %s to zero\n", m.Kind, m.Deployment)
+			w.restarter.Recorder.Eventf(target, corev1.EventTypeWarning, restarter.ReasonScaledDown, "Scaled to zero because %s %s was deleted", m.sourceKind(), m.sourceName())
+		}
+	}
+}
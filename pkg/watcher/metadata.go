@@ -0,0 +1,161 @@
+package watcher
+
+import (
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+var secretsResource = corev1.SchemeGroupVersion.WithResource("secrets")
+
+// metadataSecretHandlers handles the events of a metadata-only secret
+// informer. Secrets with at least one target are fetched in full when they
+// are added or their resourceVersion changes, and kept in fetched as the
+// previous version to compare the next one with.
+func (w *Watcher) metadataSecretHandlers(fetched *fetchedSecrets, deployments appslisters.DeploymentLister) cache.ResourceEventHandlerDetailedFuncs {
+	return cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			meta, ok := obj.(*metav1.PartialObjectMetadata)
+			if !ok || !w.Filter.allows(meta.Namespace) {
+				return
+			}
+			if len(w.targetsFor(&corev1.Secret{ObjectMeta: meta.ObjectMeta}, deployments)) == 0 {
+				return
+			}
+			secret, err := w.fetchSecret(meta)
+			if err != nil {
+				return
+			}
+			fetched.set(secret)
+			w.secretAdded(secret, deployments, !isInInitialList)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldMeta, ok := oldObj.(*metav1.PartialObjectMetadata)
+			if !ok {
+				return
+			}
+			meta, ok := newObj.(*metav1.PartialObjectMetadata)
+			if !ok || !w.Filter.allows(meta.Namespace) {
+				return
+			}
+			if len(w.targetsFor(&corev1.Secret{ObjectMeta: meta.ObjectMeta}, deployments)) == 0 {
+				if oldMeta.ResourceVersion == meta.ResourceVersion {
+					metrics.InformerResyncs.WithLabelValues("Secret").Inc()
+				}
+				fetched.delete(meta.Namespace, meta.Name)
+				return
+			}
+
+			previous := fetched.get(meta.Namespace, meta.Name)
+			if previous != nil && previous.ResourceVersion == meta.ResourceVersion {
+				w.secretUpdated(previous, previous, deployments)
+				return
+			}
+			secret, err := w.fetchSecret(meta)
+			if err != nil {
+				return
+			}
+			fetched.set(secret)
+			if previous == nil {
+				// The secret only started matching a mapping now.
+				w.secretAdded(secret, deployments, false)
+				return
+			}
+			w.secretUpdated(previous, secret, deployments)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if meta, ok := obj.(*metav1.PartialObjectMetadata); ok {
+				fetched.delete(meta.Namespace, meta.Name)
+				w.secretDeleted(&corev1.Secret{ObjectMeta: meta.ObjectMeta}, deployments)
+			}
+		},
+	}
+}
+
+// fetchSecret gets the secret described by meta from the API server.
+func (w *Watcher) fetchSecret(meta *metav1.PartialObjectMetadata) (*corev1.Secret, error) {
+	secret, err := w.clientset.CoreV1().Secrets(meta.Namespace).Get(w.ctx, meta.Name, metav1.GetOptions{})
+	if err != nil {
+		fmt.Printf("Failed to fetch secret %s/%s: %v\n", meta.Namespace, meta.Name, err)
+	}
+	return secret, err
+}
+
+// fetchedSecrets holds the full copies of the watched secrets in
+// metadata-only mode. It serves as the SecretLister of the namespace cache,
+// so that it only lists secrets that have targets.
+type fetchedSecrets struct {
+	mu      sync.RWMutex
+	secrets map[string]*corev1.Secret
+}
+
+func newFetchedSecrets() *fetchedSecrets {
+	return &fetchedSecrets{secrets: map[string]*corev1.Secret{}}
+}
+
+func (f *fetchedSecrets) get(namespace, name string) *corev1.Secret {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.secrets[namespace+"/"+name]
+}
+
+func (f *fetchedSecrets) set(secret *corev1.Secret) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.secrets[secret.Namespace+"/"+secret.Name] = secret
+}
+
+func (f *fetchedSecrets) delete(namespace, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.secrets, namespace+"/"+name)
+}
+
+func (f *fetchedSecrets) List(selector labels.Selector) ([]*corev1.Secret, error) {
+	return f.list(metav1.NamespaceAll, selector), nil
+}
+
+func (f *fetchedSecrets) Secrets(namespace string) corelisters.SecretNamespaceLister {
+	return fetchedNamespace{fetched: f, namespace: namespace}
+}
+
+func (f *fetchedSecrets) list(namespace string, selector labels.Selector) []*corev1.Secret {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var secrets []*corev1.Secret
+	for _, secret := range f.secrets {
+		if (namespace == metav1.NamespaceAll || secret.Namespace == namespace) && selector.Matches(labels.Set(secret.Labels)) {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// fetchedNamespace is the SecretNamespaceLister of fetchedSecrets.
+type fetchedNamespace struct {
+	fetched   *fetchedSecrets
+	namespace string
+}
+
+func (n fetchedNamespace) List(selector labels.Selector) ([]*corev1.Secret, error) {
+	return n.fetched.list(n.namespace, selector), nil
+}
+
+func (n fetchedNamespace) Get(name string) (*corev1.Secret, error) {
+	if secret := n.fetched.get(n.namespace, name); secret != nil {
+		return secret, nil
+	}
+	return nil, apierrors.NewNotFound(corev1.Resource("secrets"), name)
+}
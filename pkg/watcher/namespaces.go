@@ -0,0 +1,41 @@
+package watcher
+
+import "strings"
+
+// NamespaceFilter restricts which namespaces a cluster-wide watcher acts on.
+// An empty include list allows every namespace that is not excluded.
+type NamespaceFilter struct {
+	include map[string]bool
+	exclude map[string]bool
+}
+
+func NewNamespaceFilter(include, exclude string) NamespaceFilter {
+	return NamespaceFilter{include: SplitSet(include), exclude: SplitSet(exclude)}
+}
+
+func (f NamespaceFilter) allows(namespace string) bool {
+	if f.exclude[namespace] {
+		return false
+	}
+	return len(f.include) == 0 || f.include[namespace]
+}
+
+// SplitSet parses a comma-separated flag value into a set.
+func SplitSet(value string) map[string]bool {
+	set := map[string]bool{}
+	for _, v := range SplitList(value) {
+		set[v] = true
+	}
+	return set
+}
+
+// SplitList parses a comma-separated flag value, dropping empty entries.
+func SplitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,43 @@
+package watcher
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+)
+
+func newRestartNotification(m Mapping, err error) notify.Notification {
+	n := notify.Notification{
+		Namespace:  m.Namespace,
+		SourceKind: m.sourceKind(),
+		Source:     m.sourceName(),
+		Kind:       m.Kind,
+		Deployment: m.Deployment,
+		Outcome:    notify.Succeeded,
+		Timestamp:  time.Now().UTC(),
+	}
+	if err != nil {
+		n.Outcome = notify.Failed
+		n.Error = err.Error()
+	}
+	return n
+}
+
+// describeSource fills in the Secret, Certificate and NotAfter of n from
+// source, when it is a secret.
+func describeSource(n *notify.Notification, source runtime.Object) {
+	secret, ok := source.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	n.Secret = &notify.SecretInfo{Namespace: secret.Namespace, Name: secret.Name, Labels: secret.Labels, Annotations: secret.Annotations}
+	cert, err := ParseCertificate(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return
+	}
+	n.Certificate = notify.NewCertificateInfo(cert)
+	n.NotAfter = &n.Certificate.NotAfter
+}
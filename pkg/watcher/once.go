@@ -0,0 +1,171 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// stateHashes is the state document holding the hashes recorded by -once.
+const stateHashes = "hashes"
+
+// onceSource is a Secret or ConfigMap checked by RunOnce.
+type onceSource struct {
+	object runtime.Object
+	name   string
+	data   map[string][]byte
+}
+
+// RunOnce compares every source of the static mappings with the hash
+// recorded by the previous run, restarts the targets of the ones that
+// changed and records the new hashes. Sources seen for the first time are
+// only recorded. A source whose restart failed, is outside its restart
+// windows, was denied by a policy or is deferred keeps its old hash so that
+// the next run tries again. While every restart is paused, nothing is
+// checked, so that the first run after the pause catches up.
+func (w *Watcher) RunOnce(ctx context.Context, store *StateStore) error {
+	if by := w.pausedBy(); len(by) > 0 {
+		fmt.Printf("Restarts are paused by %s, not checking anything\n", strings.Join(by, ", "))
+		return nil
+	}
+
+	hashes := map[string]string{}
+	if err := store.Load(ctx, stateHashes, &hashes); err != nil {
+		return fmt.Errorf("loading recorded hashes: %w", err)
+	}
+
+	failed := 0
+	restarted := map[string]bool{}
+	for _, m := range w.currentMappings() {
+		if !w.Filter.allows(m.Namespace) {
+			continue
+		}
+		if m.External() || m.Files != "" {
+			fmt.Printf("Skipping %s %s, which -once cannot check\n", m.sourceKind(), m.sourceName())
+			continue
+		}
+		sources, err := w.onceSources(ctx, m)
+		if err != nil {
+			fmt.Printf("Failed to list %s %s in namespace %s: %v\n", m.sourceKind(), m.sourceName(), m.Namespace, err)
+			failed++
+			continue
+		}
+
+		for _, source := range sources {
+			data := source.data
+			if len(m.Keys) > 0 {
+				data = selectKeys(data, m.Keys)
+			}
+			hash := dataHash(data)
+			key := m.targetKey() + "/" + m.sourceKind() + "/" + source.name
+			recorded, ok := hashes[key]
+			switch {
+			case !ok:
+				fmt.Printf("Recording %s %s/%s for %s %s\n", m.sourceKind(), m.Namespace, source.name, m.Kind, m.Deployment)
+				hashes[key] = hash
+				continue
+			case recorded == hash:
+				continue
+			case restarted[m.targetKey()]:
+				// Another changed source already restarted the target
+				// in this run.
+				hashes[key] = hash
+				continue
+			}
+
+			target := m
+			if m.ConfigMap != "" {
+				target.ConfigMap = source.name
+			} else {
+				target.Secret = source.name
+				target.SecretSelector = ""
+			}
+			if secret, ok := source.object.(*corev1.Secret); ok && w.Validate {
+				if err := ValidateCertificate(secret, w.VerifyChain); err != nil {
+					fmt.Printf("Secret %s/%s failed validation, not restarting: %v\n", secret.Namespace, secret.Name, err)
+					metrics.ValidationFailures.WithLabelValues(secret.Namespace, secret.Name).Inc()
+					metrics.RestartsSkipped.WithLabelValues(secret.Namespace, secret.Name, metrics.SkipValidationFailed).Inc()
+					w.Audit.skipped(secret.Namespace, "Secret", secret.Name, metrics.SkipValidationFailed)
+					continue
+				}
+			}
+			windows, err := ParseWindows(m.Windows)
+			if err != nil {
+				fmt.Printf("Not restarting %s %s %s: %v\n", m.Namespace, m.Kind, m.Deployment, err)
+				failed++
+				continue
+			}
+			if now := time.Now(); windows.next(now).After(now) {
+				fmt.Printf("%s %s %s is outside its restart windows, leaving the restart to a later run\n", m.Namespace, m.Kind, m.Deployment)
+				continue
+			}
+			if len(w.policyAllowed(source.object, nil, data, []Mapping{target})) == 0 {
+				// The next run asks again.
+				continue
+			}
+			if reason := w.deferral(ctx, &pendingRestart{mapping: target, source: source.object}); reason != "" {
+				fmt.Printf("Deferring the restart of %s %s %s to a later run: %s\n", m.Namespace, m.Kind, m.Deployment, reason)
+				metrics.RestartsDeferred.WithLabelValues(m.Namespace, m.Kind, m.Deployment, reason).Inc()
+				w.Audit.deferred(target, reason)
+				continue
+			}
+
+			fmt.Printf("%s %s changed since the last run, restarting %s %s\n", target.sourceKind(), target.sourceName(), m.Kind, m.Deployment)
+			ref := w.restarter.Reference(ctx, m.Namespace, m.Kind, m.Deployment)
+			if err := w.restart(ctx, target, source.object, ref); err != nil {
+				fmt.Printf("Failed to restart %s %s: %v\n", m.Kind, m.Deployment, err)
+				failed++
+				continue
+			}
+			restarted[m.targetKey()] = true
+			hashes[key] = hash
+		}
+	}
+
+	if err := store.Save(ctx, stateHashes, hashes); err != nil {
+		return fmt.Errorf("recording hashes: %w", err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d restarts failed", failed)
+	}
+	return nil
+}
+
+// onceSources lists the Secrets or ConfigMaps watched by m straight from
+// the API server.
+func (w *Watcher) onceSources(ctx context.Context, m Mapping) ([]onceSource, error) {
+	var sources []onceSource
+	if m.ConfigMap != "" {
+		list, err := w.clientset.CoreV1().ConfigMaps(m.Namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			configMap := &list.Items[i]
+			if !MatchName(m.ConfigMap, configMap.Name) {
+				continue
+			}
+			sources = append(sources, onceSource{object: configMap, name: configMap.Name, data: configMapData(configMap)})
+		}
+		return sources, nil
+	}
+
+	list, err := w.clientset.CoreV1().Secrets(m.Namespace).List(ctx, metav1.ListOptions{LabelSelector: m.SecretSelector})
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		secret := &list.Items[i]
+		if m.MatchesSecret(secret) {
+			sources = append(sources, onceSource{object: secret, name: secret.Name, data: secret.Data})
+		}
+	}
+	return sources, nil
+}
@@ -0,0 +1,77 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+)
+
+// OPA asks an Open Policy Agent decision endpoint, such as
+// http://opa:8181/v1/data/certwatcher/allow, whether a restart may run. The
+// rotationInput of the restart is POSTed as the input of the query.
+type OPA struct {
+	URL string
+	// TokenFile holds a bearer token for OPA's authentication, re-read on
+	// every query so that it can be rotated; none is sent when it is empty.
+	TokenFile string
+	// FailOpen lets restarts run when OPA cannot be asked or returns no
+	// decision. They are held back otherwise.
+	FailOpen bool
+}
+
+// allows queries the decision for input. The result is either a bool, or
+// an object whose allow field is one, with an optional reason.
+func (o OPA) allows(ctx context.Context, input map[string]interface{}) (allowed bool, reason string, err error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.TokenFile != "" {
+		token, err := os.ReadFile(o.TokenFile)
+		if err != nil {
+			return false, "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := notify.Client.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("opa returned %s", resp.Status)
+	}
+
+	var decision struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, "", err
+	}
+	if len(decision.Result) == 0 {
+		return false, "", fmt.Errorf("opa returned no result for %s", o.URL)
+	}
+	if err := json.Unmarshal(decision.Result, &allowed); err == nil {
+		return allowed, "", nil
+	}
+	var result struct {
+		Allow  *bool  `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(decision.Result, &result); err != nil || result.Allow == nil {
+		return false, "", fmt.Errorf("opa returned %s, not a bool or an object with allow", decision.Result)
+	}
+	return *result.Allow, result.Reason, nil
+}
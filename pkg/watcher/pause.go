@@ -0,0 +1,108 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// PausedAnnotation set to "true" on the pause ConfigMap holds back every
+// restart, see WatchPauseConfigMap, and on a workload or a watched source the
+// restarts of that workload or caused by that source, see deferral.
+const PausedAnnotation = "cert-watcher.io/paused"
+
+// pauseByAdminAPI is the pauser of a global pause set through the admin API.
+const pauseByAdminAPI = "admin API"
+
+// SetGlobalPause pauses or resumes every restart on behalf of by, such as
+// the admin API or the pause ConfigMap. Sources are still watched and their
+// restarts scheduled, and run once no one holds the pause any more; a newer
+// change still replaces them.
+func (w *Watcher) SetGlobalPause(by string, paused bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if paused == w.globalPause[by] {
+		return
+	}
+	if paused {
+		w.globalPause[by] = true
+		fmt.Printf("Restarts paused by %s\n", by)
+	} else {
+		delete(w.globalPause, by)
+		fmt.Printf("Restarts resumed by %s\n", by)
+	}
+	if len(w.globalPause) > 0 {
+		metrics.GloballyPaused.Set(1)
+	} else {
+		metrics.GloballyPaused.Set(0)
+		fmt.Printf("Running the %d pending restarts held back by the pause\n", len(w.pending))
+	}
+}
+
+// globallyPaused reports whether every restart is paused. The caller holds
+// mu.
+func (w *Watcher) globallyPaused() bool {
+	return len(w.globalPause) > 0
+}
+
+// pausedBy returns who holds the global pause, sorted.
+func (w *Watcher) pausedBy() []string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	by := []string{}
+	for pauser := range w.globalPause {
+		by = append(by, pauser)
+	}
+	sort.Strings(by)
+	return by
+}
+
+// ReadPauseConfigMap pauses every restart if the ConfigMap name in namespace
+// carries PausedAnnotation set to "true" now, for runs too short to watch
+// it, such as -once. A missing ConfigMap does not pause anything.
+func (w *Watcher) ReadPauseConfigMap(ctx context.Context, namespace, name string) error {
+	configMap, err := w.clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	paused, _ := strconv.ParseBool(configMap.Annotations[PausedAnnotation])
+	w.SetGlobalPause("ConfigMap "+namespace+"/"+name, paused)
+	return nil
+}
+
+// WatchPauseConfigMap pauses every restart while the ConfigMap name in
+// namespace carries PausedAnnotation set to "true". A missing ConfigMap does
+// not pause anything.
+func (w *Watcher) WatchPauseConfigMap(namespace, name string) {
+	by := "ConfigMap " + namespace + "/" + name
+	factory := informers.NewSharedInformerFactoryWithOptions(w.clientset, w.ResyncPeriod, informers.WithNamespace(namespace), informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+	}))
+	update := func(obj interface{}) {
+		if configMap, ok := obj.(*corev1.ConfigMap); ok {
+			paused, _ := strconv.ParseBool(configMap.Annotations[PausedAnnotation])
+			w.SetGlobalPause(by, paused)
+		}
+	}
+	factory.Core().V1().ConfigMaps().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(oldObj, newObj interface{}) { update(newObj) },
+		DeleteFunc: func(obj interface{}) { w.SetGlobalPause(by, false) },
+	})
+	factory.Start(w.stopCh)
+	factory.WaitForCacheSync(w.stopCh)
+	fmt.Printf("Pausing restarts while %s is annotated %s=true\n", by, PausedAnnotation)
+}
@@ -0,0 +1,150 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// stateWatcher is the state document holding the watcherState.
+	stateWatcher = "watcher"
+
+	// stateSyncInterval is how often the watcherState is saved when it has
+	// changed.
+	stateSyncInterval = 10 * time.Second
+)
+
+// watcherState is what -persist-state keeps across restarts of the watcher.
+type watcherState struct {
+	Pending []persistedRestart `json:"pending,omitempty"`
+	// Hashes is the dataHash of every watched source by sourceHashKey.
+	Hashes map[string]string `json:"hashes,omitempty"`
+}
+
+// persistedRestart is a pendingRestart as saved in the watcherState.
+type persistedRestart struct {
+	Mapping   Mapping   `json:"mapping"`
+	CertWatch string    `json:"certWatch,omitempty"`
+	Due       time.Time `json:"due"`
+}
+
+func sourceHashKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// RestoreState loads the state saved by the previous watcher and schedules
+// its pending restarts for their original due time, or right away if that
+// has passed. It must run before any namespace is watched, so that the
+// initial sync compares every source with its saved hash.
+func (w *Watcher) RestoreState(ctx context.Context) error {
+	var state watcherState
+	if err := w.State.Load(ctx, stateWatcher, &state); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.seen = map[string]string{}
+	for key, hash := range state.Hashes {
+		w.seen[key] = hash
+	}
+	w.mu.Unlock()
+
+	for _, p := range state.Pending {
+		m := p.Mapping
+		m.certWatch = p.CertWatch
+		delay := time.Until(p.Due)
+		if delay < 0 {
+			delay = 0
+		}
+		m.Delay = &metav1.Duration{Duration: delay}
+		m.fixedDelay = true
+		fmt.Printf("Resuming the restart of %s %s %s saved by the previous watcher\n", m.Namespace, m.Kind, m.Deployment)
+		w.Trigger(nil, []Mapping{m})
+	}
+	return nil
+}
+
+// RunStateSync saves the state every stateSyncInterval until stopCh closes.
+func (w *Watcher) RunStateSync() {
+	wait.Until(func() {
+		if err := w.SaveState(w.ctx); err != nil {
+			fmt.Printf("Failed to save state: %v\n", err)
+		}
+	}, stateSyncInterval, w.stopCh)
+}
+
+// SaveState saves the pending restarts, including those shutdown left
+// waiting, and the source hashes if they changed since the last save. It
+// does nothing until RestoreState has run, so that a follower never
+// overwrites the leader's state.
+func (w *Watcher) SaveState(ctx context.Context) error {
+	w.saveMu.Lock()
+	defer w.saveMu.Unlock()
+
+	w.mu.RLock()
+	if w.seen == nil {
+		w.mu.RUnlock()
+		return nil
+	}
+	state := watcherState{Hashes: map[string]string{}}
+	for key, hash := range w.seen {
+		state.Hashes[key] = hash
+	}
+	pending := append([]*pendingRestart{}, w.dropped...)
+	for _, p := range w.pending {
+		pending = append(pending, p)
+	}
+	w.mu.RUnlock()
+
+	for _, p := range pending {
+		// File mode watches the pod's own mounts, which a new pod
+		// checks afresh.
+		if p.mapping.Files != "" {
+			continue
+		}
+		state.Pending = append(state.Pending, persistedRestart{Mapping: p.mapping, CertWatch: p.mapping.certWatch, Due: p.due})
+	}
+	sort.Slice(state.Pending, func(i, j int) bool {
+		return state.Pending[i].Mapping.targetKey() < state.Pending[j].Mapping.targetKey()
+	})
+
+	if reflect.DeepEqual(state, w.saved) {
+		return nil
+	}
+	if err := w.State.Save(ctx, stateWatcher, state); err != nil {
+		return err
+	}
+	w.saved = state
+	return nil
+}
+
+// forgetHash drops the hash of a deleted source.
+func (w *Watcher) forgetHash(kind, namespace, name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.seen != nil {
+		delete(w.seen, sourceHashKey(kind, namespace, name))
+	}
+}
+
+// observeHash records the dataHash of a watched source and reports whether
+// it differs from the hash saved for it, which means the source changed
+// while no watcher was running. It does nothing unless state is restored.
+func (w *Watcher) observeHash(kind, namespace, name string, data map[string][]byte) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.seen == nil {
+		return false
+	}
+	key := sourceHashKey(kind, namespace, name)
+	hash := dataHash(data)
+	previous, ok := w.seen[key]
+	w.seen[key] = hash
+	return ok && previous != hash
+}
@@ -0,0 +1,270 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+// policyEnv declares the variables a mapping's policy sees; rotationInput
+// sets them.
+var policyEnv = mustPolicyEnv()
+
+func mustPolicyEnv() *cel.Env {
+	object := cel.MapType(cel.StringType, cel.DynType)
+	env, err := cel.NewEnv(
+		cel.Variable("source", object),
+		cel.Variable("target", object),
+		cel.Variable("oldHash", cel.StringType),
+		cel.Variable("newHash", cel.StringType),
+		cel.Variable("changedKeys", cel.ListType(cel.StringType)),
+		cel.Variable("certificate", object),
+		cel.Variable("oldCertificate", object),
+		cel.Variable("now", cel.TimestampType),
+		cel.Variable("hour", cel.IntType),
+		cel.Variable("weekday", cel.IntType),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}
+
+var (
+	policiesMu sync.Mutex
+	// policies caches the compiled policies by expression, as mappings are
+	// copied around by value.
+	policies = map[string]cel.Program{}
+)
+
+// compilePolicy compiles a CEL policy, which must evaluate to a bool.
+func compilePolicy(expr string) (cel.Program, error) {
+	policiesMu.Lock()
+	defer policiesMu.Unlock()
+	if program, ok := policies[expr]; ok {
+		return program, nil
+	}
+	ast, issues := policyEnv.Compile(expr)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("invalid policy: %w", issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("invalid policy: evaluates to %s, not bool", ast.OutputType())
+	}
+	program, err := policyEnv.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	policies[expr] = program
+	return program, nil
+}
+
+// ValidPolicy returns why expr is not a valid policy, if it is not.
+func ValidPolicy(expr string) error {
+	_, err := compilePolicy(expr)
+	return err
+}
+
+// evalPolicy reports whether the policy expr allows a restart described by
+// input.
+func evalPolicy(expr string, input map[string]interface{}) (bool, error) {
+	program, err := compilePolicy(expr)
+	if err != nil {
+		return false, err
+	}
+	out, _, err := program.Eval(input)
+	if err != nil {
+		return false, err
+	}
+	allowed, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("policy returned %v, not a bool", out.Value())
+	}
+	return allowed, nil
+}
+
+// policyAllowed drops the targets that their policy or OPA does not allow
+// to restart for the change of source from oldData to newData; oldData is
+// nil when the previous version is unknown. A policy that fails to evaluate
+// does not hold back its restart, so that a mistake in it cannot leave
+// workloads serving an expired certificate; OPA failing to answer does
+// unless it fails open.
+func (w *Watcher) policyAllowed(source runtime.Object, oldData, newData map[string][]byte, targets []Mapping) []Mapping {
+	if w.OPA == nil {
+		policed := false
+		for _, m := range targets {
+			policed = policed || m.Policy != ""
+		}
+		if !policed {
+			return targets
+		}
+	}
+	object, err := meta.Accessor(source)
+	if err != nil {
+		return targets
+	}
+
+	var allowed []Mapping
+	for _, m := range targets {
+		if m.Policy == "" && w.OPA == nil {
+			allowed = append(allowed, m)
+			continue
+		}
+		input := w.rotationInput(w.ctx, m, object, oldData, newData)
+		if m.Policy != "" {
+			ok, err := evalPolicy(m.Policy, input)
+			switch {
+			case err != nil:
+				metrics.PolicyDecisions.WithLabelValues("cel", "error").Inc()
+				fmt.Printf("Failed to evaluate the policy of %s %s, restarting it anyway: %v\n", m.Kind, m.Deployment, err)
+			case !ok:
+				metrics.PolicyDecisions.WithLabelValues("cel", "deny").Inc()
+				w.policyDenied(source, object, m, metrics.SkipPolicyDenied, "its policy")
+				continue
+			default:
+				metrics.PolicyDecisions.WithLabelValues("cel", "allow").Inc()
+			}
+		}
+		if w.OPA != nil {
+			ok, reason, err := w.OPA.allows(w.ctx, input)
+			switch {
+			case err != nil:
+				metrics.PolicyDecisions.WithLabelValues("opa", "error").Inc()
+				if !w.OPA.FailOpen {
+					fmt.Printf("Failed to query OPA about %s %s, not restarting it: %v\n", m.Kind, m.Deployment, err)
+					w.policyDenied(source, object, m, metrics.SkipOPAFailed, "OPA, which failed to answer")
+					continue
+				}
+				fmt.Printf("Failed to query OPA about %s %s, restarting it anyway: %v\n", m.Kind, m.Deployment, err)
+			case !ok:
+				metrics.PolicyDecisions.WithLabelValues("opa", "deny").Inc()
+				by := "OPA"
+				if reason != "" {
+					by += ": " + reason
+				}
+				w.policyDenied(source, object, m, metrics.SkipOPADenied, by)
+				continue
+			default:
+				metrics.PolicyDecisions.WithLabelValues("opa", "allow").Inc()
+			}
+		}
+		allowed = append(allowed, m)
+	}
+	return allowed
+}
+
+// policyDenied reports that by did not allow the restart of m, and counts
+// it as skipped for reason.
+func (w *Watcher) policyDenied(source runtime.Object, object metav1.Object, m Mapping, reason, by string) {
+	fmt.Printf("Not restarting %s %s after %s %s/%s changed, denied by %s\n", m.Kind, m.Deployment, m.sourceKind(), object.GetNamespace(), object.GetName(), by)
+	metrics.RestartsSkipped.WithLabelValues(object.GetNamespace(), object.GetName(), reason).Inc()
+	w.Audit.targetSkipped(m, reason)
+	w.Recorder.Eventf(source, corev1.EventTypeNormal, restarter.ReasonRestartDenied, "Not restarting %s %s, denied by %s", m.Kind, m.Deployment, by)
+}
+
+// rotationInput describes a change of source from oldData to newData, which
+// is about to restart the target of m, to its policy:
+//
+//   - source and target: the kind, namespace, name, labels and annotations
+//     of the changed object and of the workload
+//   - oldHash and newHash: the dataHash of the source before and after the
+//     change; oldHash is empty when the watcher did not see the version
+//     before, as for a source created or changed while it was not running
+//   - changedKeys: the data keys added, removed or changed, sorted
+//   - certificate and oldCertificate: the tls.crt leaf after and before the
+//     change, empty when there is none
+//   - now: the current time, and hour and weekday (0 is Sunday) of it in the
+//     local time zone
+func (w *Watcher) rotationInput(ctx context.Context, m Mapping, source metav1.Object, oldData, newData map[string][]byte) map[string]interface{} {
+	now := time.Now()
+	oldHash := ""
+	if oldData != nil {
+		oldHash = dataHash(oldData)
+	}
+	return map[string]interface{}{
+		"source":         objectInput(m.sourceKind(), source.GetNamespace(), source.GetName(), source.GetLabels(), source.GetAnnotations()),
+		"target":         w.targetInput(ctx, m),
+		"oldHash":        oldHash,
+		"newHash":        dataHash(newData),
+		"changedKeys":    changedKeys(oldData, newData),
+		"certificate":    certificateInput(newData),
+		"oldCertificate": certificateInput(oldData),
+		"now":            now,
+		"hour":           now.Hour(),
+		"weekday":        int(now.Weekday()),
+	}
+}
+
+// targetInput describes the workload of m. Its labels and annotations are
+// empty when it cannot be read, and for Jobs, which are created on restart.
+func (w *Watcher) targetInput(ctx context.Context, m Mapping) map[string]interface{} {
+	var objectLabels, annotations map[string]string
+	if m.Kind != restarter.KindJob {
+		if obj, err := w.restarter.Workload(ctx, m.Namespace, m.Kind, m.Deployment); err == nil {
+			objectLabels, annotations = obj.GetLabels(), obj.GetAnnotations()
+		}
+	}
+	return objectInput(m.Kind, m.Namespace, m.Deployment, objectLabels, annotations)
+}
+
+func objectInput(kind, namespace, name string, objectLabels, annotations map[string]string) map[string]interface{} {
+	if objectLabels == nil {
+		objectLabels = map[string]string{}
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	return map[string]interface{}{
+		"kind":        kind,
+		"namespace":   namespace,
+		"name":        name,
+		"labels":      objectLabels,
+		"annotations": annotations,
+	}
+}
+
+// certificateInput describes the leaf certificate in the tls.crt of data.
+func certificateInput(data map[string][]byte) map[string]interface{} {
+	input := map[string]interface{}{}
+	cert, err := ParseCertificate(data[corev1.TLSCertKey])
+	if err != nil {
+		return input
+	}
+	input["subject"] = cert.Subject.String()
+	input["commonName"] = cert.Subject.CommonName
+	input["dnsNames"] = append([]string{}, cert.DNSNames...)
+	input["issuer"] = cert.Issuer.String()
+	input["serialNumber"] = cert.SerialNumber.String()
+	input["notBefore"] = cert.NotBefore
+	input["notAfter"] = cert.NotAfter
+	return input
+}
+
+// changedKeys returns the keys whose values differ between oldData and
+// newData, sorted.
+func changedKeys(oldData, newData map[string][]byte) []string {
+	changed := []string{}
+	for k, v := range newData {
+		if old, ok := oldData[k]; !ok || string(old) != string(v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range oldData {
+		if _, ok := newData[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,122 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// ExternalSource is a certificate store outside Kubernetes that is polled
+// for changes.
+type ExternalSource interface {
+	// version returns a value that changes whenever the certificate does.
+	version(ctx context.Context) (string, error)
+}
+
+// sourcePoller polls an external source and triggers its mappings whenever
+// the source's version changes. The first poll only records the version.
+type sourcePoller struct {
+	watcher  *Watcher
+	source   ExternalSource
+	mappings []Mapping
+	interval time.Duration
+}
+
+// Run polls until stopCh is closed.
+func (p *sourcePoller) Run(stopCh <-chan struct{}) {
+	m := p.mappings[0]
+	var last string
+	stopCtx := wait.ContextForChannel(stopCh)
+	wait.Until(func() {
+		ctx, cancel := context.WithTimeout(stopCtx, p.interval)
+		defer cancel()
+
+		version, err := p.source.version(ctx)
+		if err != nil {
+			fmt.Printf("Failed to poll %s %s: %v\n", m.sourceKind(), m.sourceName(), err)
+			metrics.SourcePollFailures.WithLabelValues(m.sourceKind(), m.sourceName()).Inc()
+			return
+		}
+		if last != "" && version != last {
+			metrics.SourceUpdates.WithLabelValues(m.Namespace, m.sourceKind(), m.sourceName()).Inc()
+			p.watcher.Audit.received(m.Namespace, m.sourceKind(), m.sourceName())
+			p.watcher.Trigger(nil, p.mappings)
+		}
+		last = version
+	}, p.interval, stopCh)
+}
+
+// newSourcePollers groups the mappings of external sources by source and
+// returns one poller for each; newSource builds the source of a mapping.
+func newSourcePollers(w *Watcher, mappings []Mapping, interval time.Duration, newSource func(Mapping) ExternalSource) []*sourcePoller {
+	var pollers []*sourcePoller
+	bySource := map[string]*sourcePoller{}
+	for _, m := range mappings {
+		if !m.External() {
+			continue
+		}
+		key := m.sourceKind() + "/" + m.sourceName()
+		if p, ok := bySource[key]; ok {
+			p.mappings = append(p.mappings, m)
+			continue
+		}
+		p := &sourcePoller{watcher: w, source: newSource(m), mappings: []Mapping{m}, interval: interval}
+		bySource[key] = p
+		pollers = append(pollers, p)
+	}
+	return pollers
+}
+
+// PollerSet runs a sourcePoller for every external source of the mappings
+// it was last synced with.
+type PollerSet struct {
+	Watcher   *Watcher
+	Interval  time.Duration
+	NewSource func(Mapping) ExternalSource
+	StopCh    <-chan struct{}
+
+	mu      sync.Mutex
+	running map[string]runningPoller
+}
+
+type runningPoller struct {
+	mappings []Mapping
+	stop     chan struct{}
+}
+
+// Sync starts a poller for every new source of mappings and stops those of
+// sources no mapping has any more. A source whose mappings changed gets a
+// new poller, whose first poll records the version again.
+func (s *PollerSet) Sync(mappings []Mapping) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running == nil {
+		s.running = map[string]runningPoller{}
+	}
+
+	wanted := map[string]*sourcePoller{}
+	for _, p := range newSourcePollers(s.Watcher, mappings, s.Interval, s.NewSource) {
+		m := p.mappings[0]
+		wanted[m.sourceKind()+"/"+m.sourceName()] = p
+	}
+	for key, r := range s.running {
+		if p, ok := wanted[key]; !ok || !reflect.DeepEqual(p.mappings, r.mappings) {
+			close(r.stop)
+			delete(s.running, key)
+		}
+	}
+	for key, p := range wanted {
+		if _, ok := s.running[key]; ok {
+			continue
+		}
+		stop := make(chan struct{})
+		s.running[key] = runningPoller{mappings: p.mappings, stop: stop}
+		go p.Run(mergeStop(s.StopCh, stop))
+	}
+}
@@ -0,0 +1,98 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+const (
+	// probeTimeout bounds how long probeTarget waits for the endpoint to
+	// serve the new certificate, as load balancers may still route to
+	// terminating pods for a while.
+	probeTimeout = time.Minute
+
+	probeMatch    = "match"
+	probeMismatch = "mismatch"
+	probeError    = "error"
+)
+
+// probeTarget dials m.Probe with TLS once the workload has rolled out and
+// checks that the leaf certificate it serves is the one in the secret that
+// caused the restart. The outcome is logged, counted in
+// cert_watcher_probe_results_total and recorded as an Event on the target;
+// it does not change the outcome of the restart.
+func (w *Watcher) probeTarget(ctx context.Context, m Mapping, source runtime.Object, target *corev1.ObjectReference) {
+	secret, ok := source.(*corev1.Secret)
+	if !ok && m.SecretSelector == "" {
+		var err error
+		if secret, err = w.clientset.CoreV1().Secrets(m.Namespace).Get(ctx, m.Secret, metav1.GetOptions{}); err != nil {
+			fmt.Printf("Failed to read secret %s/%s to probe %s: %v\n", m.Namespace, m.Secret, m.Probe, err)
+			return
+		}
+	}
+	if secret == nil {
+		return
+	}
+	want, err := ParseCertificate(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		fmt.Printf("Not probing %s: secret %s/%s has no certificate: %v\n", m.Probe, secret.Namespace, secret.Name, err)
+		return
+	}
+
+	var served []byte
+	var dialErr error
+	err = wait.PollUntilContextTimeout(ctx, restarter.RolloutPollInterval, probeTimeout, true, func(ctx context.Context) (bool, error) {
+		served, dialErr = servedCertificate(ctx, m.Probe)
+		return dialErr == nil && bytes.Equal(served, want.Raw), nil
+	})
+	switch {
+	case ctx.Err() != nil:
+		return
+	case err == nil:
+		fmt.Printf("%s serves the new certificate of secret %s/%s\n", m.Probe, secret.Namespace, secret.Name)
+		metrics.ProbeResults.WithLabelValues(m.Namespace, m.Kind, m.Deployment, probeMatch).Inc()
+		w.restarter.Recorder.Eventf(target, corev1.EventTypeNormal, restarter.ReasonCertificateServed, "%s serves the new certificate of secret %s", m.Probe, secret.Name)
+	case dialErr != nil:
+		fmt.Printf("Failed to probe %s after restarting %s %s: %v\n", m.Probe, m.Kind, m.Deployment, dialErr)
+		metrics.ProbeResults.WithLabelValues(m.Namespace, m.Kind, m.Deployment, probeError).Inc()
+		w.restarter.Recorder.Eventf(target, corev1.EventTypeWarning, restarter.ReasonStaleCertificate, "Probing %s failed: %v", m.Probe, dialErr)
+	default:
+		fmt.Printf("%s still serves an old certificate %s after %s %s rolled out\n", m.Probe, probeTimeout, m.Kind, m.Deployment)
+		metrics.ProbeResults.WithLabelValues(m.Namespace, m.Kind, m.Deployment, probeMismatch).Inc()
+		w.restarter.Recorder.Eventf(target, corev1.EventTypeWarning, restarter.ReasonStaleCertificate, "%s still serves an old certificate instead of the one in secret %s", m.Probe, secret.Name)
+	}
+}
+
+// servedCertificate returns the DER leaf certificate served at address. The
+// chain is not verified: only the identity of the certificate matters.
+func servedCertificate(ctx context.Context, address string) ([]byte, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: host, InsecureSkipVerify: true}}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate served")
+	}
+	return certs[0].Raw, nil
+}
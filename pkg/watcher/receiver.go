@@ -0,0 +1,131 @@
+package watcher
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// rotationRequest is the body of a rotation notification pushed to the
+// receiver. Kind is one of the source kinds of Mapping and defaults to
+// Secret; Namespace is not compared for sources outside Kubernetes when it
+// is empty.
+type rotationRequest struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name"`
+}
+
+// RotationReceiver lets other systems, such as a CI pipeline or a Vault
+// plugin, announce that a source has rotated instead of waiting for the
+// watcher to notice. Every request must carry the shared bearer token, and
+// leader election followers refuse them with 503.
+type RotationReceiver struct {
+	watcher *Watcher
+	token   []byte
+}
+
+// NewRotationReceiver reads the shared token from tokenFile.
+func NewRotationReceiver(w *Watcher, tokenFile string) (*RotationReceiver, error) {
+	data, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("%s is empty", tokenFile)
+	}
+	return &RotationReceiver{watcher: w, token: []byte(token)}, nil
+}
+
+func (v *RotationReceiver) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/rotations", v.watcher.leaderOnly(v.rotation))
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), v.token) != 1 {
+			http.Error(rw, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(rw, r)
+	})
+}
+
+// rotation schedules the restarts of every target of the announced source
+// and responds with the ones its policies allow, or with 404 if the source
+// has none. Delays, windows, validation and policies apply as to a change
+// seen by the watcher, and a change the watcher then sees itself replaces
+// the pending restart.
+func (v *RotationReceiver) rotation(rw http.ResponseWriter, r *http.Request) {
+	var request rotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(rw, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if request.Kind == "" {
+		request.Kind = "Secret"
+	}
+	if request.Name == "" || (request.Namespace == "" && (request.Kind == "Secret" || request.Kind == "ConfigMap")) {
+		http.Error(rw, "name, and namespace for a Secret or ConfigMap, are required", http.StatusBadRequest)
+		return
+	}
+
+	w := v.watcher
+	w.Audit.received(request.Namespace, request.Kind, request.Name)
+	var targets, allowed []Mapping
+	if request.Kind == "Secret" {
+		secret, deployments := w.cachedSecret(request.Namespace, request.Name)
+		targets = w.targetsFor(secret, deployments)
+		if len(targets) > 0 {
+			fmt.Printf("Rotation of secret %s/%s announced\n", request.Namespace, request.Name)
+			allowed = w.policyAllowed(secret, nil, secret.Data, targets)
+			if secret.Data != nil {
+				w.triggerValid(secret, allowed)
+			} else {
+				w.Trigger(nil, allowed)
+			}
+		}
+	} else {
+		for _, m := range w.currentMappings() {
+			if m.sourceKind() != request.Kind || (m.Namespace != request.Namespace && (request.Namespace != "" || !m.External())) {
+				continue
+			}
+			switch {
+			case m.ConfigMap != "" && MatchName(m.ConfigMap, request.Name):
+				m.ConfigMap = request.Name
+			case m.External() && m.sourceName() == request.Name:
+			default:
+				continue
+			}
+			targets = append(targets, m)
+		}
+		if len(targets) > 0 {
+			fmt.Printf("Rotation of %s %s announced\n", request.Kind, request.Name)
+			allowed = targets
+			if request.Kind == "ConfigMap" {
+				configMap, err := w.clientset.CoreV1().ConfigMaps(request.Namespace).Get(r.Context(), request.Name, metav1.GetOptions{})
+				if err != nil {
+					fmt.Printf("Failed to get ConfigMap %s/%s: %v\n", request.Namespace, request.Name, err)
+					configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: request.Namespace, Name: request.Name}}
+				}
+				allowed = w.policyAllowed(configMap, nil, configMapData(configMap), targets)
+			}
+			w.Trigger(nil, allowed)
+		}
+	}
+
+	if len(targets) == 0 {
+		http.Error(rw, fmt.Sprintf("no mapping watches %s %s", request.Kind, request.Name), http.StatusNotFound)
+		return
+	}
+	if allowed == nil {
+		allowed = []Mapping{}
+	}
+	writeJSON(rw, http.StatusAccepted, allowed)
+}
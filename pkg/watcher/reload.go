@@ -0,0 +1,134 @@
+package watcher
+
+import (
+	"fmt"
+	"reflect"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// ReloadConfig applies the mappings of the config file at path, which has
+// changed, and keeps the current ones when it is invalid.
+func (w *Watcher) ReloadConfig(path string, pollers *PollerSet) {
+	config, err := LoadConfig(path, w.defaults)
+	if err != nil {
+		fmt.Printf("Failed to reload config, keeping the current mappings: %v\n", err)
+		metrics.ConfigReloads.WithLabelValues("failed").Inc()
+		return
+	}
+	w.setMappings(config.Mappings)
+	pollers.Sync(config.Mappings)
+	metrics.ConfigReloads.WithLabelValues("succeeded").Inc()
+	fmt.Printf("Reloaded config %s with %d mappings\n", path, len(config.Mappings))
+}
+
+// setMappings replaces the static mappings and reconciles the informers
+// with them: namespaces no mapping needs any more are unwatched, those
+// whose informers must list other objects are watched again, and new ones
+// are watched.
+func (w *Watcher) setMappings(mappings []Mapping) {
+	w.mu.RLock()
+	unchanged := reflect.DeepEqual(w.mappings, mappings)
+	var namespaces []string
+	for namespace := range w.started {
+		namespaces = append(namespaces, namespace)
+	}
+	w.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	scopes := map[string]string{}
+	for _, namespace := range namespaces {
+		scopes[namespace] = w.informerScope(namespace)
+	}
+	w.mu.Lock()
+	w.mappings = mappings
+	w.mu.Unlock()
+
+	for _, namespace := range namespaces {
+		switch {
+		case !w.needsNamespace(namespace):
+			fmt.Printf("No mapping watches namespace %s any more\n", namespace)
+			w.unwatchNamespace(namespace)
+		case w.informerScope(namespace) != scopes[namespace]:
+			w.unwatchNamespace(namespace)
+			w.WatchNamespace(namespace)
+		}
+	}
+	for _, namespace := range (&Config{Mappings: mappings}).Namespaces() {
+		w.WatchNamespace(namespace)
+	}
+}
+
+// informerScope describes what the informers of namespace list, which
+// changes when secretScope or watchesConfigMaps would start them
+// differently.
+func (w *Watcher) informerScope(namespace string) string {
+	name, selector := w.scopeSelectors(namespace)
+	return fmt.Sprintf("%s|%s|%t", name, selector, w.watchesConfigMaps(namespace))
+}
+
+// needsNamespace reports whether a mapping, or discovery, watches objects
+// in namespace.
+func (w *Watcher) needsNamespace(namespace string) bool {
+	if namespace == metav1.NamespaceAll || (w.discovery != "" && namespace == w.defaults.Namespace) {
+		return true
+	}
+	for _, m := range w.currentMappings() {
+		if m.Namespace == namespace && !m.External() && m.Files == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// unwatchNamespace stops the informers of namespace and forgets the
+// certificates they cached.
+func (w *Watcher) unwatchNamespace(namespace string) {
+	w.mu.Lock()
+	stop, ok := w.started[namespace]
+	if !ok {
+		w.mu.Unlock()
+		return
+	}
+	close(stop)
+	delete(w.started, namespace)
+	var removed []namespaceCache
+	caches := w.caches[:0]
+	for _, c := range w.caches {
+		if c.namespace == namespace {
+			removed = append(removed, c)
+		} else {
+			caches = append(caches, c)
+		}
+	}
+	w.caches = caches
+	w.mu.Unlock()
+
+	for _, c := range removed {
+		secrets, err := c.secrets.Secrets(c.namespace).List(labels.Everything())
+		if err != nil {
+			continue
+		}
+		for _, secret := range secrets {
+			forgetCertificate(secret.Namespace, secret.Name)
+		}
+	}
+}
+
+// mergeStop returns a channel that is closed once either a or b is.
+func mergeStop(a, b <-chan struct{}) <-chan struct{} {
+	merged := make(chan struct{})
+	go func() {
+		defer close(merged)
+		select {
+		case <-a:
+		case <-b:
+		}
+	}()
+	return merged
+}
@@ -0,0 +1,164 @@
+package watcher
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// RetryPolicy is how failed restarts are retried. The nth retry waits
+// InitialBackoff * Factor^(n-1), up to MaxBackoff. After MaxAttempts
+// attempts, counting the first, the restart is parked as a dead letter.
+type RetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Factor         float64
+	MaxAttempts    int
+	// AttemptTimeout bounds the API calls of one attempt, not counting its
+	// hooks or the rollout it waits for; 0 leaves them unbounded.
+	AttemptTimeout time.Duration
+}
+
+// DefaultRetryPolicy retries a failed restart five times, backing off from
+// 5 seconds to 5 minutes.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialBackoff: 5 * time.Second,
+	MaxBackoff:     5 * time.Minute,
+	Factor:         2,
+	MaxAttempts:    6,
+}
+
+// Validate returns why the policy cannot be used, if it cannot.
+func (p RetryPolicy) Validate() error {
+	switch {
+	case p.InitialBackoff <= 0 || p.MaxBackoff < p.InitialBackoff:
+		return fmt.Errorf("the initial retry backoff must be positive and at most the maximum backoff")
+	case p.Factor < 1:
+		return fmt.Errorf("the retry backoff factor must be at least 1")
+	case p.MaxAttempts < 1:
+		return fmt.Errorf("a restart must be attempted at least once")
+	case p.AttemptTimeout < 0:
+		return fmt.Errorf("the restart attempt timeout must not be negative")
+	}
+	return nil
+}
+
+// backoff returns how long to wait before the retry that follows failures
+// failed attempts.
+func (p RetryPolicy) backoff(failures int) time.Duration {
+	backoff := float64(p.InitialBackoff) * math.Pow(p.Factor, float64(failures-1))
+	if backoff > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+	return time.Duration(backoff)
+}
+
+// retryLimiter is the workqueue.RateLimiter of the restart queue. It reads
+// the Watcher's Retry on every retry, so that the policy can be set after
+// New.
+type retryLimiter struct {
+	policy *RetryPolicy
+
+	mu       sync.Mutex
+	failures map[interface{}]int
+}
+
+func newRetryLimiter(policy *RetryPolicy) *retryLimiter {
+	return &retryLimiter{policy: policy, failures: map[interface{}]int{}}
+}
+
+func (l *retryLimiter) When(item interface{}) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures[item]++
+	return l.policy.backoff(l.failures[item])
+}
+
+func (l *retryLimiter) Forget(item interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, item)
+}
+
+func (l *retryLimiter) NumRequeues(item interface{}) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failures[item]
+}
+
+// deadLetter is a restart that failed every attempt of the retry policy. It
+// stays parked until it is retried or discarded through the admin API, a
+// newer change schedules another restart of its target, or a later restart
+// of the target succeeds.
+type deadLetter struct {
+	Mapping  Mapping   `json:"mapping"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+
+	restart *pendingRestart
+}
+
+// park records p, whose last attempt failed with err, as a dead letter.
+func (w *Watcher) park(key string, p *pendingRestart, attempts int, err error) {
+	m := p.mapping
+	fmt.Printf("Giving up on restarting %s %s %s after %d attempts: %v\n", m.Namespace, m.Kind, m.Deployment, attempts, err)
+	w.mu.Lock()
+	w.deadLetters[key] = &deadLetter{Mapping: m, Attempts: attempts, Error: err.Error(), Time: time.Now(), restart: p}
+	w.mu.Unlock()
+	metrics.DeadLetters.WithLabelValues(m.Namespace, m.Kind, m.Deployment).Set(1)
+}
+
+// unpark removes the dead letter of key, if there is one, and returns it.
+// The caller holds mu.
+func (w *Watcher) unpark(key string) *deadLetter {
+	letter, ok := w.deadLetters[key]
+	if !ok {
+		return nil
+	}
+	delete(w.deadLetters, key)
+	metrics.DeadLetters.DeleteLabelValues(letter.Mapping.Namespace, letter.Mapping.Kind, letter.Mapping.Deployment)
+	return letter
+}
+
+// deadLetterList returns the dead letters, oldest first.
+func (w *Watcher) deadLetterList() []*deadLetter {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	letters := []*deadLetter{}
+	for _, letter := range w.deadLetters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Time.Before(letters[j].Time) })
+	return letters
+}
+
+// retryDeadLetter schedules the parked restart of key again, right away and
+// with a fresh set of attempts, and reports whether there was one.
+func (w *Watcher) retryDeadLetter(key string) bool {
+	w.mu.Lock()
+	letter := w.unpark(key)
+	w.mu.Unlock()
+	if letter == nil {
+		return false
+	}
+	m := letter.Mapping
+	m.Delay = &metav1.Duration{}
+	m.fixedDelay = true
+	w.Trigger(letter.restart.source, []Mapping{m})
+	return true
+}
+
+// discardDeadLetter drops the parked restart of key and reports whether
+// there was one.
+func (w *Watcher) discardDeadLetter(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.unpark(key) != nil
+}
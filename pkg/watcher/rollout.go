@@ -0,0 +1,75 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+// awaitRollout waits for the rollout started by restarting m's workload and
+// reports its outcome and duration through logs, metrics and Events on
+// target.
+func (w *Watcher) awaitRollout(ctx context.Context, m Mapping, target *corev1.ObjectReference) error {
+	ctx, span := tracer.Start(ctx, "rollout")
+	start := time.Now()
+	err := w.restarter.WaitForRollout(ctx, m.Namespace, m.Kind, m.Deployment, start, w.RolloutTimeout)
+	endSpan(span, err)
+	elapsed := time.Since(start)
+
+	result := notify.Succeeded
+	if err != nil {
+		result = notify.Failed
+		fmt.Printf("%s %s rollout failed after %s: %v\n", m.Kind, m.Deployment, elapsed.Round(time.Second), err)
+		w.restarter.Recorder.Eventf(target, corev1.EventTypeWarning, restarter.ReasonRolloutFailed, "Rollout after %s %s changed failed: %v", m.sourceKind(), m.sourceName(), err)
+	} else {
+		fmt.Printf("%s %s rolled out in %s\n", m.Kind, m.Deployment, elapsed.Round(time.Second))
+		w.restarter.Recorder.Eventf(target, corev1.EventTypeNormal, restarter.ReasonRolloutComplete, "Rolled out in %s", elapsed.Round(time.Second))
+	}
+	metrics.RolloutsTotal.WithLabelValues(m.Namespace, m.Kind, m.Deployment, result).Inc()
+	metrics.RolloutDuration.WithLabelValues(m.Kind, result).Observe(elapsed.Seconds())
+
+	if err != nil && w.RolloutFailureAction != "" {
+		if actionErr := w.remediate(ctx, m, target); actionErr != nil {
+			fmt.Printf("Failed to %s %s %s: %v\n", w.RolloutFailureAction, m.Kind, m.Deployment, actionErr)
+			err = fmt.Errorf("%w; %s failed: %v", err, w.RolloutFailureAction, actionErr)
+		} else {
+			err = fmt.Errorf("%w; %s applied", err, w.RolloutFailureAction)
+		}
+	}
+	return err
+}
+
+// remediate pauses or rolls back the Deployment of m after a failed rollout,
+// so that the pods of the previous ReplicaSet keep serving. Rolling back
+// only makes sense when the restart created a new revision, as the
+// annotation and checksum strategies do.
+func (w *Watcher) remediate(ctx context.Context, m Mapping, target *corev1.ObjectReference) error {
+	if m.Kind != restarter.KindDeployment {
+		return fmt.Errorf("only Deployments can be paused or rolled back")
+	}
+	switch w.RolloutFailureAction {
+	case restarter.RolloutActionPause:
+		if err := w.restarter.PauseDeployment(ctx, m.Namespace, m.Deployment); err != nil {
+			return err
+		}
+		fmt.Printf("Paused Deployment %s after its rollout failed\n", m.Deployment)
+		w.restarter.Recorder.Event(target, corev1.EventTypeWarning, restarter.ReasonRolloutPaused, "Paused after the rollout failed")
+	case restarter.RolloutActionRollback:
+		if m.Strategy != "" && m.Strategy != restarter.StrategyAnnotation && m.Strategy != restarter.StrategyChecksum {
+			return fmt.Errorf("the %s strategy does not create a revision to roll back", m.Strategy)
+		}
+		revision, err := w.restarter.RollbackDeployment(ctx, m.Namespace, m.Deployment)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rolled Deployment %s back to revision %d after its rollout failed\n", m.Deployment, revision)
+		w.restarter.Recorder.Eventf(target, corev1.EventTypeWarning, restarter.ReasonRolledBack, "Rolled back to revision %d after the rollout failed", revision)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// signals are the signals -signal accepts, with or without the SIG prefix.
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// ParseSignal looks up a signal name such as SIGHUP or usr1.
+func ParseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal %q", name)
+	}
+	return sig, nil
+}
+
+// ProcessSignaler sends a signal to co-located processes after a delay,
+// instead of restarting a workload. It relies on the pod sharing its process
+// namespace, so that the other containers' processes are visible in /proc.
+type ProcessSignaler struct {
+	Process string
+	Signal  syscall.Signal
+	Delay   time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// Schedule signals the processes once delay has passed. A change that
+// arrives while a signal is pending replaces it.
+func (s *ProcessSignaler) Schedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	fmt.Printf("Files changed, signalling %s with %s in %s\n", s.Process, s.Signal, s.Delay)
+	s.timer = time.AfterFunc(s.Delay, s.send)
+}
+
+func (s *ProcessSignaler) send() {
+	pids, err := findProcesses(s.Process)
+	if err != nil || len(pids) == 0 {
+		fmt.Printf("No %s process to signal: %v\n", s.Process, err)
+		metrics.SignalsSent.WithLabelValues(s.Process, "false").Inc()
+		return
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, s.Signal); err != nil {
+			fmt.Printf("Failed to signal %s (pid %d): %v\n", s.Process, pid, err)
+			metrics.SignalsSent.WithLabelValues(s.Process, "false").Inc()
+			continue
+		}
+		fmt.Printf("Sent %s to %s (pid %d)\n", s.Signal, s.Process, pid)
+		metrics.SignalsSent.WithLabelValues(s.Process, "true").Inc()
+	}
+}
+
+// findProcesses returns the pids of every other process whose name, or the
+// base name of its executable, is name. The kernel truncates names to 15
+// characters, which the command line check covers.
+func findProcesses(name string) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == name {
+			pids = append(pids, pid)
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		argv0, _, _ := strings.Cut(string(cmdline), "\x00")
+		if argv0 != "" && filepath.Base(argv0) == name {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
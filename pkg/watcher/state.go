@@ -0,0 +1,66 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// StateStore keeps the watcher's state as JSON documents in the data of a
+// ConfigMap, so that it survives the watcher's own restarts.
+type StateStore struct {
+	Clientset kubernetes.Interface
+	Namespace string
+	Name      string
+}
+
+// Load decodes the document stored under key into v. A missing ConfigMap or
+// key leaves v untouched.
+func (s *StateStore) Load(ctx context.Context, key string, v interface{}) error {
+	configMap, err := s.Clientset.CoreV1().ConfigMaps(s.Namespace).Get(ctx, s.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, ok := configMap.Data[key]
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+// Save stores v under key, creating the ConfigMap if needed.
+func (s *StateStore) Save(ctx context.Context, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	client := s.Clientset.CoreV1().ConfigMaps(s.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := client.Get(ctx, s.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = client.Create(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: s.Namespace, Name: s.Name},
+				Data:       map[string]string{key: string(data)},
+			}, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[key] = string(data)
+		_, err = client.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,181 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+const (
+	// streamBuffer is how many records a slow subscriber may fall behind
+	// before records are dropped for it.
+	streamBuffer = 64
+	// streamKeepalive is how often an idle stream sends a comment, so that
+	// proxies keep the connection open.
+	streamKeepalive = 15 * time.Second
+)
+
+// EventStream pushes rotation and restart records to subscribers as Server-
+// Sent Events as they happen. A nil *EventStream pushes nothing.
+type EventStream struct {
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]bool
+	closed      bool
+}
+
+type streamSubscriber struct {
+	filter  HistoryFilter
+	records chan HistoryRecord
+}
+
+func NewEventStream() *EventStream {
+	return &EventStream{subscribers: map[*streamSubscriber]bool{}}
+}
+
+// record adds r to the restart history and pushes it to the event stream.
+func (w *Watcher) record(r HistoryRecord) {
+	w.History.add(r)
+	w.Stream.publish(r)
+}
+
+// publish sends r to every subscriber it matches, dropping it for those
+// whose buffer is full.
+func (s *EventStream) publish(r HistoryRecord) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subscribers {
+		if !sub.filter.matches(r) {
+			continue
+		}
+		select {
+		case sub.records <- r:
+		default:
+			metrics.StreamRecordsDropped.Inc()
+		}
+	}
+}
+
+// subscribe returns a subscriber to the records matching filter, or false
+// once the stream is closed.
+func (s *EventStream) subscribe(filter HistoryFilter) (*streamSubscriber, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, false
+	}
+	sub := &streamSubscriber{filter: filter, records: make(chan HistoryRecord, streamBuffer)}
+	s.subscribers[sub] = true
+	metrics.StreamSubscribers.Set(float64(len(s.subscribers)))
+	return sub, true
+}
+
+func (s *EventStream) unsubscribe(sub *streamSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subscribers[sub] {
+		delete(s.subscribers, sub)
+		close(sub.records)
+	}
+	metrics.StreamSubscribers.Set(float64(len(s.subscribers)))
+}
+
+// Close ends every stream, so that servers can shut down without waiting
+// for their clients to disconnect.
+func (s *EventStream) Close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for sub := range s.subscribers {
+		delete(s.subscribers, sub)
+		close(sub.records)
+	}
+	metrics.StreamSubscribers.Set(0)
+}
+
+// serve streams the records matching the filter ParseHistoryFilter reads
+// from the request, one JSON document per event. With since or limit, the
+// matching records of history are sent first.
+func (s *EventStream) serve(rw http.ResponseWriter, r *http.Request, history *RestartHistory) {
+	filter, err := ParseHistoryFilter(r.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s == nil {
+		http.Error(rw, "the event stream is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	sub, ok := s.subscribe(filter)
+	if !ok {
+		http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.unsubscribe(sub)
+
+	var replay []HistoryRecord
+	if filter.Limit > 0 || !filter.Since.IsZero() {
+		replay = history.query(filter)
+	}
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(rw)
+
+	var last time.Time
+	for _, record := range replay {
+		if err := writeStreamEvent(rw, record); err != nil {
+			return
+		}
+		last = record.Time
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case record, ok := <-sub.records:
+			if !ok {
+				return
+			}
+			// Records taken between subscribing and the replay are in both.
+			if !record.Time.After(last) {
+				continue
+			}
+			if err := writeStreamEvent(rw, record); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(rw, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeStreamEvent(rw http.ResponseWriter, record HistoryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(rw, "data: %s\n\n", data)
+	return err
+}
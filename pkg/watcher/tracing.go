@@ -0,0 +1,20 @@
+package watcher
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records the restart pipeline. Until a program installs a tracer
+// provider it is a no-op.
+var tracer = otel.Tracer("github.com/andreistefanzx/cert-watcher")
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
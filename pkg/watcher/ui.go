@@ -0,0 +1,85 @@
+package watcher
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+)
+
+// dashboardHistory is how many of the latest history records the dashboard
+// shows.
+const dashboardHistory = 50
+
+//go:embed ui
+var uiFiles embed.FS
+
+// dashboardSecret is a watched secret as shown on the dashboard.
+type dashboardSecret struct {
+	Namespace   string                  `json:"namespace"`
+	Name        string                  `json:"name"`
+	Certificate *notify.CertificateInfo `json:"certificate,omitempty"`
+	Targets     []targetRef             `json:"targets"`
+}
+
+// dashboard is everything the web UI shows, fetched in one request.
+type dashboard struct {
+	Time    time.Time         `json:"time"`
+	Secrets []dashboardSecret `json:"secrets"`
+	Targets []targetStatus    `json:"targets"`
+	History []HistoryRecord   `json:"history"`
+}
+
+// UIHandler serves the read-only web UI and the JSON document it renders.
+// It carries no authentication of its own and is meant to be reached
+// through `kubectl port-forward` or an authenticating proxy.
+func (w *Watcher) UIHandler() http.Handler {
+	static, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServer(http.FS(static)))
+	mux.HandleFunc("GET /api/dashboard", func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, w.dashboard())
+	})
+	mux.HandleFunc("GET /api/events", func(rw http.ResponseWriter, r *http.Request) {
+		w.Stream.serve(rw, r, w.History)
+	})
+	return mux
+}
+
+func (w *Watcher) dashboard() dashboard {
+	d := dashboard{
+		Time:    time.Now().UTC(),
+		Secrets: []dashboardSecret{},
+		Targets: w.targetStatuses(),
+		History: w.History.query(HistoryFilter{Limit: dashboardHistory}),
+	}
+	for _, secret := range w.watchedSecrets() {
+		_, deployments := w.cachedSecret(secret.Namespace, secret.Name)
+		s := dashboardSecret{Namespace: secret.Namespace, Name: secret.Name, Targets: []targetRef{}}
+		if cert, err := ParseCertificate(secret.Data[corev1.TLSCertKey]); err == nil {
+			s.Certificate = notify.NewCertificateInfo(cert)
+		}
+		for _, m := range w.targetsFor(secret, deployments) {
+			s.Targets = append(s.Targets, targetRef{Namespace: m.Namespace, Kind: m.Kind, Name: m.Deployment})
+		}
+		d.Secrets = append(d.Secrets, s)
+	}
+	sort.Slice(d.Secrets, func(i, j int) bool {
+		if d.Secrets[i].Namespace != d.Secrets[j].Namespace {
+			return d.Secrets[i].Namespace < d.Secrets[j].Namespace
+		}
+		return d.Secrets[i].Name < d.Secrets[j].Name
+	})
+	if d.Targets == nil {
+		d.Targets = []targetStatus{}
+	}
+	return d
+}
@@ -0,0 +1,65 @@
+package watcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+)
+
+// VaultSource polls a Vault path, such as a KV secret written by Vault
+// Agent or a PKI engine's cert/<serial> endpoint, through the HTTP API.
+type VaultSource struct {
+	Address string
+	// TokenFile is re-read on every poll so that tokens renewed by Vault
+	// Agent are picked up; VAULT_TOKEN is used when it is empty.
+	TokenFile string
+	Path      string
+}
+
+// version hashes the data of the secret at the path, which for KV version 2
+// also covers its version metadata.
+func (v VaultSource) version(ctx context.Context) (string, error) {
+	token := os.Getenv("VAULT_TOKEN")
+	if v.TokenFile != "" {
+		data, err := os.ReadFile(v.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	url := strings.TrimSuffix(v.Address, "/") + "/v1/" + strings.TrimPrefix(v.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := notify.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, v.Path)
+	}
+
+	var body struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if len(body.Data) == 0 {
+		return "", fmt.Errorf("vault returned no data for %s", v.Path)
+	}
+	sum := sha256.Sum256(body.Data)
+	return hex.EncodeToString(sum[:]), nil
+}
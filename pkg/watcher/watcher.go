@@ -0,0 +1,1136 @@
+// Package watcher watches secrets, ConfigMaps and external secret stores and
+// restarts the workloads that use them when they change.
+//
+// A program embedding it builds a restarter.Restarter and a Watcher with New,
+// sets the Watcher's exported options, then watches namespaces with
+// WatchNamespace and runs its workers with RunWorkers. Both take a
+// kubernetes.Interface, so the fake clientsets of client-go work in tests.
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+// concurrencyRolloutTimeout is how long an untracked rollout counts against
+// -max-concurrent-restarts.
+const concurrencyRolloutTimeout = 10 * time.Minute
+
+// Watcher owns the informers for every watched namespace and turns secret
+// changes into deployment restarts. Its exported fields configure it and
+// must be set before it starts watching.
+type Watcher struct {
+	clientset kubernetes.Interface
+	restarter *restarter.Restarter
+	discovery string
+	// DiscoverKnative extends discovery to Knative Services.
+	DiscoverKnative bool
+	// defaults supplies the delay and keys of discovered and CertWatch
+	// mappings.
+	defaults Mapping
+	stopCh   <-chan struct{}
+	// ResyncPeriod is how often informers redeliver every cached object;
+	// such resyncs are counted and otherwise ignored.
+	ResyncPeriod time.Duration
+
+	// AllNamespaces replaces per-namespace informers with cluster-wide
+	// ones, limited to the namespaces the filter allows.
+	AllNamespaces bool
+	Filter        NamespaceFilter
+
+	// Validate refuses to restart onto a certificate that fails
+	// ValidateCertificate, with VerifyChain also checking ca.crt.
+	Validate    bool
+	VerifyChain bool
+	// Recorder records Events on watched sources; Events on workloads go
+	// through the restarter's recorder, which may be another cluster's.
+	Recorder record.EventRecorder
+	// OPA decides, with the mapping's policy, whether a change of a secret
+	// or ConfigMap restarts each target; nil disables it.
+	OPA *OPA
+
+	Notifiers notify.Notifiers
+	// Audit logs every decision about a source change; nil disables it.
+	Audit *AuditLog
+	// History records every rotation and restart for the admin API; nil
+	// disables it.
+	History *RestartHistory
+	// Stream pushes the history's records to the clients of the events
+	// endpoints as they happen.
+	Stream *EventStream
+	// Incidents raises Incidents for repeatedly failing restarts; nil
+	// disables it.
+	Incidents *Incidents
+	// CloudEvents publishes the progress of every rotation; nil disables
+	// it.
+	CloudEvents *CloudEvents
+
+	// ChangeDetection decides what counts as a new certificate once the
+	// secret data has changed; see certificateChanged.
+	ChangeDetection string
+
+	// MinRestartInterval holds back a restart until this long after the
+	// previous successful restart of the same target.
+	MinRestartInterval time.Duration
+
+	// DelayJitter adds a random duration up to this long to each delay, so
+	// that the targets of one change do not all restart at once.
+	DelayJitter time.Duration
+
+	// MaxConcurrentRestarts, when positive, bounds how many restarts are in
+	// progress at once, counting each until its rollout has finished or
+	// concurrencyRolloutTimeout has passed. Due restarts beyond it stay
+	// queued.
+	MaxConcurrentRestarts int
+
+	// Retry is how failed restarts are retried before they are parked as
+	// dead letters.
+	Retry RetryPolicy
+
+	// RolloutTimeout bounds how long a restart waits for its rollout to
+	// finish; 0 reports success as soon as the restart is accepted.
+	RolloutTimeout time.Duration
+	// RolloutFailureAction is applied to a Deployment whose rollout failed;
+	// see remediate.
+	RolloutFailureAction string
+
+	// RecordChecksums records the hash of the secret behind every
+	// successful restart on the workload, for CatchUp.
+	RecordChecksums bool
+
+	// OnCreate says whether a secret created while the watcher runs counts
+	// as a rotation, and OnDelete lists what happens to the targets of a
+	// deleted one; see lifecycle.go.
+	OnCreate string
+	OnDelete map[string]bool
+
+	// MetadataOnly caches only the metadata of secrets through the metadata
+	// client, and fetches the data of watched secrets when they change.
+	MetadataOnly bool
+	Metadata     metadata.Interface
+
+	// ScopeSecrets lets secretScope narrow the secret informers. It must
+	// stay off when mappings are added at run time.
+	ScopeSecrets bool
+
+	// CertManager hands secrets issued by cert-manager over to the
+	// CertManagerController.
+	CertManager bool
+
+	// certWatches is set in operator mode and receives the outcome of
+	// restarts declared by CertWatch resources.
+	certWatches *CertWatchController
+
+	// ctx bounds restart API calls and is cancelled once shutdown gives up
+	// waiting for them.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// queue holds the targetKey of every pending restart, added once its
+	// delay has elapsed; the restart itself is in pending.
+	queue workqueue.RateLimitingInterface
+
+	mu       sync.RWMutex
+	mappings []Mapping
+	managed  map[string][]Mapping
+	// started holds a channel for every watched namespace that stops its
+	// informers when closed; see unwatchNamespace.
+	started map[string]chan struct{}
+	pending map[string]*pendingRestart
+	closed  bool
+	caches  []namespaceCache
+	// lastRestart is when each target was last restarted successfully.
+	lastRestart map[string]time.Time
+	// rolling holds the targets whose restart is in progress.
+	rolling map[string]bool
+	// active counts the restarts in progress, up to maxConcurrentRestarts.
+	active int
+	// paused holds the targets whose restarts are held back through the
+	// admin API, and results the outcome of each target's last restart.
+	paused  map[string]bool
+	results map[string]restartResult
+	// deadLetters holds the restarts that failed every attempt, by target.
+	deadLetters map[string]*deadLetter
+	// globalPause holds whoever pauses every restart; see SetGlobalPause.
+	globalPause map[string]bool
+	// seen holds the dataHash of every watched source once RestoreState
+	// has run, and dropped the restarts shutdown left waiting for a window
+	// or a resume, both for SaveState.
+	seen    map[string]string
+	dropped []*pendingRestart
+
+	// standby is set while this replica is a leader election follower;
+	// see SetStandby.
+	standby atomic.Bool
+
+	// State is where SaveState keeps the watcherState, if set, and saved
+	// the last state it saved.
+	State  *StateStore
+	saveMu sync.Mutex
+	saved  watcherState
+}
+
+// pendingRestart is a restart waiting out its delay.
+type pendingRestart struct {
+	mapping Mapping
+	source  runtime.Object
+	target  *corev1.ObjectReference
+	// ctx carries span, the rotation trace, into the restart.
+	ctx       context.Context
+	span      trace.Span
+	delaySpan trace.Span
+	// due is when the restart runs. A replaced restart is due later than
+	// the queue item scheduled for the one it replaced.
+	due time.Time
+	// after holds the targets whose rollouts must finish first, and ordered
+	// marks the target as rolling while it restarts so that its dependents
+	// wait for it.
+	after   []string
+	ordered bool
+	// windowed is set while the restart waits for a restart window to
+	// open, so shutdown does not run it outside the window.
+	windowed bool
+	// deferred is the reason the due restart is held back, if any; see
+	// deferral.
+	deferred      string
+	deferredSince time.Time
+}
+
+// namespaceCache holds the listers of one watched namespace, or of the whole
+// cluster in all-namespaces mode.
+type namespaceCache struct {
+	namespace   string
+	secrets     corelisters.SecretLister
+	deployments appslisters.DeploymentLister
+}
+
+// New returns a Watcher of mappings that restarts their targets through r.
+// discovery is the discovery mode, or empty, and defaults fills in the
+// mappings it and CertWatch resources declare. The Watcher stops when stopCh
+// is closed.
+func New(clientset kubernetes.Interface, r *restarter.Restarter, mappings []Mapping, discovery string, defaults Mapping, stopCh <-chan struct{}) *Watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{
+		clientset:       clientset,
+		restarter:       r,
+		mappings:        mappings,
+		discovery:       discovery,
+		defaults:        defaults,
+		stopCh:          stopCh,
+		ChangeDetection: ChangeDetectionData,
+		ResyncPeriod:    10 * time.Minute,
+		RolloutTimeout:  10 * time.Minute,
+		Retry:           DefaultRetryPolicy,
+		ctx:             ctx,
+		cancel:          cancel,
+		managed:         map[string][]Mapping{},
+		started:         map[string]chan struct{}{},
+		pending:         map[string]*pendingRestart{},
+		lastRestart:     map[string]time.Time{},
+		rolling:         map[string]bool{},
+		paused:          map[string]bool{},
+		globalPause:     map[string]bool{},
+		results:         map[string]restartResult{},
+		deadLetters:     map[string]*deadLetter{},
+	}
+	w.queue = workqueue.NewNamedRateLimitingQueue(newRetryLimiter(&w.Retry), "restarts")
+	return w
+}
+
+// currentMappings returns the static mappings together with every mapping
+// currently declared by a CertWatch resource.
+func (w *Watcher) currentMappings() []Mapping {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	mappings := append([]Mapping{}, w.mappings...)
+	for _, managed := range w.managed {
+		mappings = append(mappings, managed...)
+	}
+	return mappings
+}
+
+// setManagedMappings replaces the mappings owned by key, removing them when
+// mappings is empty.
+func (w *Watcher) setManagedMappings(key string, mappings []Mapping) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(mappings) == 0 {
+		delete(w.managed, key)
+		return
+	}
+	w.managed[key] = mappings
+}
+
+// WatchNamespace starts the informers for a single namespace and restarts
+// the mapped deployments whenever one of their secrets changes. Namespaces
+// that are already watched are left alone, and in all-namespaces mode every
+// call shares the same cluster-wide informers.
+func (w *Watcher) WatchNamespace(namespace string) {
+	if w.AllNamespaces {
+		namespace = metav1.NamespaceAll
+	}
+
+	w.mu.Lock()
+	_, started := w.started[namespace]
+	namespaceStop := make(chan struct{})
+	if !started {
+		w.started[namespace] = namespaceStop
+	}
+	w.mu.Unlock()
+	if started {
+		return
+	}
+	stopCh := mergeStop(w.stopCh, namespaceStop)
+
+	factory := informers.NewSharedInformerFactoryWithOptions(w.clientset, w.ResyncPeriod, informers.WithNamespace(namespace))
+	secretFactory := factory
+	scope := w.secretScope(namespace)
+	if scope != nil {
+		secretFactory = informers.NewSharedInformerFactoryWithOptions(w.clientset, w.ResyncPeriod, informers.WithNamespace(namespace), informers.WithTweakListOptions(scope))
+	}
+
+	// In metadata-only mode the informer caches the metadata of secrets,
+	// and only the watched ones are fetched in full.
+	var secretInformer cache.SharedIndexInformer
+	var secretLister corelisters.SecretLister
+	var fetched *fetchedSecrets
+	var metadataFactory metadatainformer.SharedInformerFactory
+	if w.MetadataOnly {
+		metadataFactory = metadatainformer.NewFilteredSharedInformerFactory(w.Metadata, w.ResyncPeriod, namespace, scope)
+		secretInformer = metadataFactory.ForResource(secretsResource).Informer()
+		fetched = newFetchedSecrets()
+		secretLister = fetched
+	} else {
+		secrets := secretFactory.Core().V1().Secrets()
+		secretInformer = secrets.Informer()
+		secretLister = secrets.Lister()
+	}
+	synced := []cache.InformerSynced{secretInformer.HasSynced}
+
+	var deployments appslisters.DeploymentLister
+	if w.discovery != "" {
+		deploymentInformer := factory.Apps().V1().Deployments()
+		deployments = deploymentInformer.Lister()
+		synced = append(synced, deploymentInformer.Informer().HasSynced)
+	}
+
+	var configMapInformer cache.SharedIndexInformer
+	if w.watchesConfigMaps(namespace) {
+		configMapInformer = factory.Core().V1().ConfigMaps().Informer()
+		synced = append(synced, configMapInformer.HasSynced)
+	}
+
+	factory.Start(stopCh)
+	secretFactory.Start(stopCh)
+	if metadataFactory != nil {
+		metadataFactory.Start(stopCh)
+	}
+
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		// Only happens when stopCh closes during startup, or the namespace
+		// is unwatched before its caches synced.
+		return
+	}
+
+	w.mu.Lock()
+	w.caches = append(w.caches, namespaceCache{namespace: namespace, secrets: secretLister, deployments: deployments})
+	w.mu.Unlock()
+
+	if fetched != nil {
+		secretInformer.AddEventHandler(w.metadataSecretHandlers(fetched, deployments))
+	} else {
+		secretInformer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(obj interface{}, isInInitialList bool) {
+				if secret, ok := obj.(*corev1.Secret); ok {
+					w.secretAdded(secret, deployments, !isInInitialList)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldSecret, ok := oldObj.(*corev1.Secret)
+				if !ok {
+					return
+				}
+				if secret, ok := newObj.(*corev1.Secret); ok {
+					w.secretUpdated(oldSecret, secret, deployments)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				if secret, ok := obj.(*corev1.Secret); ok {
+					w.secretDeleted(secret, deployments)
+				}
+			},
+		})
+	}
+
+	if configMapInformer != nil {
+		configMapInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				configMap, ok := obj.(*corev1.ConfigMap)
+				if !ok || !w.Filter.allows(configMap.Namespace) {
+					return
+				}
+				targets := w.configMapTargetsFor(configMap)
+				if len(targets) == 0 || !w.observeHash("ConfigMap", configMap.Namespace, configMap.Name, configMapData(configMap)) {
+					return
+				}
+				fmt.Printf("ConfigMap %s/%s changed while no watcher was running\n", configMap.Namespace, configMap.Name)
+				w.Trigger(configMap, w.policyAllowed(configMap, nil, configMapData(configMap), targets))
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldConfigMap, ok := oldObj.(*corev1.ConfigMap)
+				if !ok {
+					return
+				}
+				configMap, ok := newObj.(*corev1.ConfigMap)
+				if !ok || !w.Filter.allows(configMap.Namespace) {
+					return
+				}
+				if oldConfigMap.ResourceVersion == configMap.ResourceVersion {
+					metrics.InformerResyncs.WithLabelValues("ConfigMap").Inc()
+					return
+				}
+				targets := w.configMapTargetsFor(configMap)
+				if len(targets) == 0 {
+					return
+				}
+				metrics.SourceUpdates.WithLabelValues(configMap.Namespace, "ConfigMap", configMap.Name).Inc()
+				w.Audit.received(configMap.Namespace, "ConfigMap", configMap.Name)
+				w.observeHash("ConfigMap", configMap.Namespace, configMap.Name, configMapData(configMap))
+				if reflect.DeepEqual(oldConfigMap.Data, configMap.Data) && reflect.DeepEqual(oldConfigMap.BinaryData, configMap.BinaryData) {
+					metrics.RestartsSkipped.WithLabelValues(configMap.Namespace, configMap.Name, metrics.SkipDataUnchanged).Inc()
+					w.Audit.skipped(configMap.Namespace, "ConfigMap", configMap.Name, metrics.SkipDataUnchanged)
+					return
+				}
+				w.Trigger(configMap, w.policyAllowed(configMap, configMapData(oldConfigMap), configMapData(configMap), targets))
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				if configMap, ok := obj.(*corev1.ConfigMap); ok {
+					w.forgetHash("ConfigMap", configMap.Namespace, configMap.Name)
+				}
+			},
+		})
+	}
+
+	for _, m := range w.currentMappings() {
+		if namespace == metav1.NamespaceAll || m.Namespace == namespace {
+			fmt.Printf("Watching %s %s in namespace %s\n", m.sourceKind(), m.sourceName(), m.Namespace)
+		}
+	}
+	if w.discovery != "" {
+		if namespace == metav1.NamespaceAll {
+			fmt.Printf("Discovering deployments by %s in all namespaces\n", w.discovery)
+		} else {
+			fmt.Printf("Discovering deployments by %s in namespace %s\n", w.discovery, namespace)
+		}
+	}
+}
+
+// Trigger schedules a restart of every target mapping after its delay.
+// A change that arrives while a target's restart is still pending replaces
+// that restart, so the delay starts over from the latest change. source is the
+// changed Secret or ConfigMap, which Events are recorded against alongside
+// the target, or nil in file mode.
+func (w *Watcher) Trigger(source runtime.Object, targets []Mapping) {
+	w.CloudEvents.rotationDetected(targets)
+	if len(targets) > 0 {
+		w.record(detectedRecord(targets[0]))
+	}
+
+	ordered := false
+	for _, m := range targets {
+		ordered = ordered || m.Order != targets[0].Order
+	}
+
+	for _, m := range targets {
+		// When the targets have different orders, each waits for the
+		// rollouts of every target ordered before it.
+		var after []string
+		if ordered {
+			for _, other := range targets {
+				if other.Order < m.Order {
+					after = append(after, other.targetKey())
+				}
+			}
+		}
+
+		key := m.targetKey()
+
+		// The API calls are made before taking mu, which every informer
+		// handler and worker waits for.
+		if !m.fixedDelay {
+			if delay, ok := w.restarter.AnnotatedDelay(w.ctx, m.Namespace, m.Kind, m.Deployment); ok {
+				m.Delay = &metav1.Duration{Duration: delay}
+			}
+		}
+		target := w.restarter.Reference(w.ctx, m.Namespace, m.Kind, m.Deployment)
+
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			fmt.Printf("%s %s changed during shutdown, not restarting %s %s\n", m.sourceKind(), m.sourceName(), m.Kind, m.Deployment)
+			metrics.RestartsSkipped.WithLabelValues(m.Namespace, m.sourceName(), metrics.SkipShutdown).Inc()
+			w.Audit.targetSkipped(m, metrics.SkipShutdown)
+			continue
+		}
+		if p, ok := w.pending[key]; ok {
+			fmt.Printf("%s %s changed again, replacing the pending restart of %s %s\n", m.sourceKind(), m.sourceName(), m.Kind, m.Deployment)
+			metrics.RestartsSkipped.WithLabelValues(m.Namespace, m.sourceName(), metrics.SkipSuperseded).Inc()
+			w.Audit.targetSkipped(m, metrics.SkipSuperseded)
+			p.delaySpan.End()
+			p.span.AddEvent("superseded")
+			p.span.End()
+		}
+
+		delay := m.Delay.Duration
+		if w.DelayJitter > 0 && !m.fixedDelay {
+			delay += time.Duration(rand.Int63n(int64(w.DelayJitter)))
+		}
+		if last, ok := w.lastRestart[key]; ok {
+			if cooldown := w.MinRestartInterval - time.Since(last); cooldown > delay {
+				fmt.Printf("%s %s %s restarted %s ago, holding back the next restart\n", m.Namespace, m.Kind, m.Deployment, time.Since(last).Round(time.Second))
+				metrics.RestartsSuppressed.WithLabelValues(m.Namespace, m.Kind, m.Deployment).Inc()
+				delay = cooldown
+			}
+		}
+
+		windowed := false
+		windows, _ := ParseWindows(m.Windows)
+		if due := time.Now().Add(delay); windows.next(due).After(due) {
+			opens := windows.next(due)
+			fmt.Printf("%s %s %s is outside its restart windows, deferring the restart to %s\n", m.Namespace, m.Kind, m.Deployment, opens.Format(time.RFC3339))
+			delay = time.Until(opens)
+			windowed = true
+		}
+
+		if w.paused[key] {
+			fmt.Printf("%s %s %s is paused, holding the restart until it is resumed\n", m.Namespace, m.Kind, m.Deployment)
+		} else if w.globallyPaused() {
+			fmt.Printf("Restarts are paused, holding the restart of %s %s %s until they are resumed\n", m.Namespace, m.Kind, m.Deployment)
+		}
+		fmt.Printf("%s %s changed, waiting for %s before restarting %s %s\n", m.sourceKind(), m.sourceName(), delay, m.Kind, m.Deployment)
+
+		ctx, span := tracer.Start(w.ctx, "rotation", trace.WithAttributes(
+			attribute.String("namespace", m.Namespace),
+			attribute.String("source.kind", m.sourceKind()),
+			attribute.String("source.name", m.sourceName()),
+			attribute.String("target.kind", m.Kind),
+			attribute.String("target.name", m.Deployment),
+		))
+		_, delaySpan := tracer.Start(ctx, "delay", trace.WithAttributes(attribute.String("delay", delay.String())))
+
+		w.unpark(key)
+		w.pending[key] = &pendingRestart{
+			mapping:   m,
+			source:    source,
+			target:    target,
+			ctx:       ctx,
+			span:      span,
+			delaySpan: delaySpan,
+			due:       time.Now().Add(delay),
+			after:     after,
+			ordered:   ordered,
+			windowed:  windowed,
+		}
+		metrics.PendingRestarts.Set(float64(len(w.pending)))
+		w.mu.Unlock()
+		w.restarter.Recorder.Eventf(target, corev1.EventTypeNormal, restarter.ReasonRestartScheduled, "%s %s changed, restarting in %s", m.sourceKind(), m.sourceName(), delay)
+		if source != nil {
+			w.Recorder.Eventf(source, corev1.EventTypeNormal, restarter.ReasonRestartScheduled, "Restarting %s %s in %s", m.Kind, m.Deployment, delay)
+		}
+		w.CloudEvents.restartScheduled(m, time.Now().Add(delay))
+		w.record(scheduledRecord(m, time.Now().Add(delay)))
+		w.Audit.scheduled(m, time.Now().Add(delay))
+		w.queue.AddAfter(key, delay)
+	}
+}
+
+// secretAdded handles a secret seen for the first time: at startup, when it
+// is created, or when it starts matching a mapping. It restarts the targets
+// if the secret changed while no watcher was running, or if it was created
+// and -on-create asks for it.
+func (w *Watcher) secretAdded(secret *corev1.Secret, deployments appslisters.DeploymentLister, created bool) {
+	if !w.Filter.allows(secret.Namespace) {
+		return
+	}
+	targets := w.targetsFor(secret, deployments)
+	if len(targets) == 0 {
+		return
+	}
+	observeCertificate(secret)
+	missed := w.observeHash("Secret", secret.Namespace, secret.Name, secret.Data)
+	if created && w.OnCreate == createActionRestart {
+		fmt.Printf("Secret %s/%s was created, restarting its workloads\n", secret.Namespace, secret.Name)
+		metrics.SourceUpdates.WithLabelValues(secret.Namespace, "Secret", secret.Name).Inc()
+		w.Audit.received(secret.Namespace, "Secret", secret.Name)
+		w.triggerValid(secret, w.policyAllowed(secret, nil, secret.Data, targets))
+		return
+	}
+	if !missed {
+		return
+	}
+	if w.CertManager && secret.Annotations[certificateNameAnnotation] != "" {
+		metrics.RestartsSkipped.WithLabelValues(secret.Namespace, secret.Name, metrics.SkipCertificateManaged).Inc()
+		w.Audit.skipped(secret.Namespace, "Secret", secret.Name, metrics.SkipCertificateManaged)
+		return
+	}
+	fmt.Printf("Secret %s/%s changed while no watcher was running\n", secret.Namespace, secret.Name)
+	w.Audit.received(secret.Namespace, "Secret", secret.Name)
+	w.triggerValid(secret, w.policyAllowed(secret, nil, secret.Data, targets))
+}
+
+// secretUpdated restarts the targets of a secret whose certificate changed
+// between oldSecret and secret.
+func (w *Watcher) secretUpdated(oldSecret, secret *corev1.Secret, deployments appslisters.DeploymentLister) {
+	if !w.Filter.allows(secret.Namespace) {
+		return
+	}
+	if oldSecret.ResourceVersion == secret.ResourceVersion {
+		metrics.InformerResyncs.WithLabelValues("Secret").Inc()
+	}
+	targets := w.targetsFor(secret, deployments)
+	if len(targets) == 0 {
+		return
+	}
+	observeCertificate(secret)
+	if oldSecret.ResourceVersion == secret.ResourceVersion {
+		return
+	}
+	metrics.SourceUpdates.WithLabelValues(secret.Namespace, "Secret", secret.Name).Inc()
+	w.Audit.received(secret.Namespace, "Secret", secret.Name)
+	w.observeHash("Secret", secret.Namespace, secret.Name, secret.Data)
+
+	// Issuances of cert-manager secrets are picked up from their
+	// Certificate instead.
+	if w.CertManager && secret.Annotations[certificateNameAnnotation] != "" {
+		metrics.RestartsSkipped.WithLabelValues(secret.Namespace, secret.Name, metrics.SkipCertificateManaged).Inc()
+		w.Audit.skipped(secret.Namespace, "Secret", secret.Name, metrics.SkipCertificateManaged)
+		return
+	}
+
+	// Metadata-only changes leave the data untouched and must not
+	// roll anything.
+	if dataHash(oldSecret.Data) == dataHash(secret.Data) {
+		metrics.RestartsSkipped.WithLabelValues(secret.Namespace, secret.Name, metrics.SkipDataUnchanged).Inc()
+		w.Audit.skipped(secret.Namespace, "Secret", secret.Name, metrics.SkipDataUnchanged)
+		return
+	}
+	if !certificateChanged(oldSecret, secret, w.ChangeDetection) {
+		fmt.Printf("Secret %s/%s changed but its certificate %s did not, not restarting\n", secret.Namespace, secret.Name, w.ChangeDetection)
+		metrics.RestartsSkipped.WithLabelValues(secret.Namespace, secret.Name, metrics.SkipCertificateUnchanged).Inc()
+		w.Audit.skipped(secret.Namespace, "Secret", secret.Name, metrics.SkipCertificateUnchanged)
+		return
+	}
+	w.triggerValid(secret, w.policyAllowed(secret, oldSecret.Data, secret.Data, w.keysChanged(oldSecret, secret, targets)))
+}
+
+// secretDeleted forgets what is known about a deleted secret and applies
+// the -on-delete actions to its targets.
+func (w *Watcher) secretDeleted(secret *corev1.Secret, deployments appslisters.DeploymentLister) {
+	forgetCertificate(secret.Namespace, secret.Name)
+	w.forgetHash("Secret", secret.Namespace, secret.Name)
+	if !w.Filter.allows(secret.Namespace) {
+		return
+	}
+	if targets := w.targetsFor(secret, deployments); len(targets) > 0 {
+		w.sourceDeleted(targets)
+	}
+}
+
+// triggerValid triggers targets for secret, unless certificate validation
+// is enabled and the secret fails it.
+func (w *Watcher) triggerValid(secret *corev1.Secret, targets []Mapping) {
+	if len(targets) > 0 && w.Validate {
+		if err := ValidateCertificate(secret, w.VerifyChain); err != nil {
+			fmt.Printf("Secret %s/%s failed validation, not restarting: %v\n", secret.Namespace, secret.Name, err)
+			metrics.ValidationFailures.WithLabelValues(secret.Namespace, secret.Name).Inc()
+			metrics.RestartsSkipped.WithLabelValues(secret.Namespace, secret.Name, metrics.SkipValidationFailed).Inc()
+			w.Audit.skipped(secret.Namespace, "Secret", secret.Name, metrics.SkipValidationFailed)
+			w.Recorder.Eventf(secret, corev1.EventTypeWarning, "CertificateInvalid", "Not restarting workloads: %v", err)
+			return
+		}
+	}
+	w.Trigger(secret, targets)
+}
+
+// RunWorkers starts n goroutines that restart targets as their delays
+// elapse. Restarts of the same target never run concurrently.
+func (w *Watcher) RunWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for w.processNext() {
+			}
+		}()
+	}
+}
+
+// processNext restarts the next target taken off the queue. A failed
+// restart is retried as the Retry policy says, unless a newer change has
+// scheduled another restart in the meantime, and parked as a dead letter
+// once it runs out of attempts.
+func (w *Watcher) processNext() bool {
+	item, shutdown := w.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer w.queue.Done(item)
+	key := item.(string)
+
+	w.mu.Lock()
+	p, ok := w.pending[key]
+	if ok && !w.closed && time.Now().Before(p.due) {
+		w.mu.Unlock()
+		w.queue.AddAfter(key, time.Until(p.due))
+		return true
+	}
+	if ok && !w.closed && (w.paused[key] || w.globallyPaused() || w.waitingOn(p) || w.saturated()) {
+		w.mu.Unlock()
+		w.queue.AddAfter(key, restarter.RolloutPollInterval)
+		return true
+	}
+	delete(w.pending, key)
+	metrics.PendingRestarts.Set(float64(len(w.pending)))
+	if ok {
+		w.rolling[key] = true
+		w.active++
+	}
+	w.mu.Unlock()
+	if !ok {
+		return true
+	}
+	if w.deferRestart(key, p) {
+		return true
+	}
+
+	p.delaySpan.End()
+	m := p.mapping
+	started := time.Now()
+	err := w.restart(p.ctx, m, p.source, p.target)
+	if err == nil && w.MaxConcurrentRestarts > 0 && w.RolloutTimeout == 0 && restarter.RolloutTracked(m.Kind) {
+		// The restart returned as soon as it was accepted, but its
+		// rollout still counts against the limit until it finishes.
+		go func() {
+			_ = w.restarter.WaitForRollout(w.ctx, m.Namespace, m.Kind, m.Deployment, started, concurrencyRolloutTimeout)
+			w.finished(key)
+		}()
+	} else {
+		w.finished(key)
+	}
+	if err == nil {
+		w.queue.Forget(key)
+		endSpan(p.span, nil)
+		return true
+	}
+
+	w.mu.Lock()
+	if _, ok := w.pending[key]; ok || w.closed {
+		w.mu.Unlock()
+		w.queue.Forget(key)
+		endSpan(p.span, err)
+		return true
+	}
+	if attempts := w.queue.NumRequeues(key) + 1; attempts >= w.Retry.MaxAttempts {
+		w.mu.Unlock()
+		w.queue.Forget(key)
+		w.park(key, p, attempts, err)
+		endSpan(p.span, err)
+		return true
+	}
+	w.pending[key] = p
+	metrics.PendingRestarts.Set(float64(len(w.pending)))
+	w.mu.Unlock()
+
+	fmt.Printf("Retrying restart of %s %s after backoff\n", p.mapping.Kind, p.mapping.Deployment)
+	p.span.AddEvent("retry")
+	w.queue.AddRateLimited(key)
+	return true
+}
+
+// finished releases the slot held by the restart of key.
+func (w *Watcher) finished(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.active--
+	delete(w.rolling, key)
+}
+
+// saturated reports whether maxConcurrentRestarts restarts are already in
+// progress. The caller holds mu.
+func (w *Watcher) saturated() bool {
+	return w.MaxConcurrentRestarts > 0 && w.active >= w.MaxConcurrentRestarts
+}
+
+// waitingOn reports whether a target that p must restart after is still
+// pending or rolling out. The caller holds mu.
+func (w *Watcher) waitingOn(p *pendingRestart) bool {
+	for _, key := range p.after {
+		if _, ok := w.pending[key]; ok || w.rolling[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// Shutdown stops accepting changes, runs every pending restart right away
+// instead of dropping it unless it waits for a window or is paused, and
+// waits up to timeout for the queue to drain before cancelling the
+// restarts' API calls.
+func (w *Watcher) Shutdown(timeout time.Duration) {
+	w.mu.Lock()
+	w.closed = true
+	flushed := 0
+	for key, p := range w.pending {
+		if p.windowed || w.paused[key] || w.globallyPaused() {
+			m := p.mapping
+			fmt.Printf("Dropping restart of %s %s waiting for its restart window or to be resumed\n", m.Kind, m.Deployment)
+			delete(w.pending, key)
+			w.dropped = append(w.dropped, p)
+			p.span.AddEvent("dropped at shutdown")
+			p.span.End()
+			metrics.RestartsSkipped.WithLabelValues(m.Namespace, m.sourceName(), metrics.SkipShutdown).Inc()
+			w.Audit.targetSkipped(m, metrics.SkipShutdown)
+			continue
+		}
+		w.queue.Add(key)
+		flushed++
+	}
+	w.mu.Unlock()
+
+	if flushed > 0 {
+		fmt.Printf("Flushing %d pending restarts\n", flushed)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.queue.ShutDownWithDrain()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		fmt.Printf("Restarts still running after %s, cancelling them\n", timeout)
+	}
+	w.cancel()
+}
+
+// restart rolls the mapping's workload, waits for the rollout and reports
+// the outcome. Only a failure to restart is returned: a rollout that fails
+// is reported but not retried.
+func (w *Watcher) restart(ctx context.Context, m Mapping, source runtime.Object, target *corev1.ObjectReference) error {
+	err := w.runHook(ctx, hookPreRestart, m.PreRestart, m, target)
+	attemptCtx := ctx
+	if w.Retry.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, w.Retry.AttemptTimeout)
+		defer cancel()
+	}
+	switch {
+	case err != nil:
+	case m.Job != nil:
+		err = w.restarter.CreateJob(attemptCtx, m.Namespace, m.Deployment, m.Job, m.sourceKind(), m.sourceName(), w.checksum(attemptCtx, m, source))
+	default:
+		err = w.restarter.Restart(attemptCtx, m.Namespace, m.sourceName(), m.Kind, m.Deployment, m.Strategy, w.checksum(attemptCtx, m, source))
+	}
+	if err != nil {
+		w.restarter.Recorder.Eventf(target, corev1.EventTypeWarning, restarter.ReasonRestartFailed, "Restart after %s %s changed failed: %v", m.sourceKind(), m.sourceName(), err)
+		if source != nil {
+			w.Recorder.Eventf(source, corev1.EventTypeWarning, restarter.ReasonRestartFailed, "Restart of %s %s failed: %v", m.Kind, m.Deployment, err)
+		}
+	} else {
+		w.mu.Lock()
+		w.lastRestart[m.targetKey()] = time.Now()
+		w.unpark(m.targetKey())
+		w.mu.Unlock()
+		if w.RecordChecksums && m.Job == nil {
+			w.recordRestartChecksum(ctx, m, source)
+		}
+		w.restarter.Recorder.Eventf(target, corev1.EventTypeNormal, restarter.ReasonRestarted, "Restarted because %s %s changed", m.sourceKind(), m.sourceName())
+		if source != nil {
+			w.Recorder.Eventf(source, corev1.EventTypeNormal, restarter.ReasonRestarted, "Restarted %s %s", m.Kind, m.Deployment)
+		}
+	}
+
+	outcome := err
+	rollout := ""
+	if err == nil && w.RolloutTimeout > 0 && restarter.RolloutTracked(m.Kind) {
+		outcome = w.awaitRollout(ctx, m, target)
+		rollout = notify.Succeeded
+		if outcome != nil {
+			rollout = notify.Failed
+		}
+		if outcome == nil && m.Probe != "" {
+			w.probeTarget(ctx, m, source, target)
+		}
+	}
+	if outcome == nil {
+		outcome = w.runHook(ctx, hookPostRestart, m.PostRestart, m, target)
+	}
+
+	result := restartResult{Time: time.Now()}
+	if outcome != nil {
+		result.Error = outcome.Error()
+	}
+	w.mu.Lock()
+	w.results[m.targetKey()] = result
+	w.mu.Unlock()
+
+	if m.certWatch != "" && w.certWatches != nil {
+		w.certWatches.recordRestart(m, outcome)
+	}
+	n := newRestartNotification(m, outcome)
+	n.Rollout = rollout
+	describeSource(&n, source)
+	w.Notifiers.Send(n)
+	w.CloudEvents.restarted(m, n)
+	w.record(restartedRecord(n))
+	w.Audit.restarted(n)
+	w.Incidents.restarted(m, outcome)
+	return err
+}
+
+// checksum returns the dataHash of the watched keys of m's source for the
+// checksum and annotation strategies. Restarts without a source object, such
+// as manual or restored ones, read the source from the API server. It is
+// empty for sources outside Kubernetes and for strategies that do not use it.
+func (w *Watcher) checksum(ctx context.Context, m Mapping, source runtime.Object) string {
+	if m.Strategy != restarter.StrategyChecksum && m.Strategy != restarter.StrategyAnnotation && m.Strategy != "" {
+		return ""
+	}
+	if source == nil && m.Secret != "" && m.SecretSelector == "" {
+		if secret, err := w.clientset.CoreV1().Secrets(m.Namespace).Get(ctx, m.Secret, metav1.GetOptions{}); err == nil {
+			source = secret
+		}
+	}
+	if source == nil && m.ConfigMap != "" {
+		if configMap, err := w.clientset.CoreV1().ConfigMaps(m.Namespace).Get(ctx, m.ConfigMap, metav1.GetOptions{}); err == nil {
+			source = configMap
+		}
+	}
+
+	var data map[string][]byte
+	switch source := source.(type) {
+	case *corev1.Secret:
+		data = source.Data
+	case *corev1.ConfigMap:
+		data = configMapData(source)
+	default:
+		return ""
+	}
+	if len(m.Keys) > 0 {
+		data = selectKeys(data, m.Keys)
+	}
+	return dataHash(data)
+}
+
+// synced reports whether every namespace that has been started has finished
+// its initial cache sync.
+func (w *Watcher) synced() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.caches) == len(w.started)
+}
+
+// watchedSecrets returns every cached secret that currently has at least one
+// target.
+func (w *Watcher) watchedSecrets() []*corev1.Secret {
+	w.mu.RLock()
+	caches := append([]namespaceCache{}, w.caches...)
+	w.mu.RUnlock()
+
+	var watched []*corev1.Secret
+	for _, c := range caches {
+		secrets, err := c.secrets.Secrets(c.namespace).List(labels.Everything())
+		if err != nil {
+			fmt.Printf("Failed to list secrets: %v\n", err)
+			continue
+		}
+		for _, secret := range secrets {
+			if w.Filter.allows(secret.Namespace) && len(w.targetsFor(secret, c.deployments)) > 0 {
+				watched = append(watched, secret)
+			}
+		}
+	}
+	return watched
+}
+
+// keysChanged drops the targets whose configured keys did not change between
+// the two versions of a secret.
+func (w *Watcher) keysChanged(oldSecret, secret *corev1.Secret, targets []Mapping) []Mapping {
+	var changed []Mapping
+	for _, m := range targets {
+		if len(m.Keys) > 0 && dataHash(selectKeys(oldSecret.Data, m.Keys)) == dataHash(selectKeys(secret.Data, m.Keys)) {
+			fmt.Printf("Secret %s changed outside keys %v, not restarting %s %s\n", secret.Name, m.Keys, m.Kind, m.Deployment)
+			metrics.RestartsSkipped.WithLabelValues(secret.Namespace, secret.Name, metrics.SkipKeysUnchanged).Inc()
+			w.Audit.targetSkipped(m, metrics.SkipKeysUnchanged)
+			continue
+		}
+		changed = append(changed, m)
+	}
+	return changed
+}
+
+// secretScope returns list options that limit the secret informer of
+// namespace to what its mappings watch, when they all name the same secret
+// or share one label selector, so that the cache does not hold every secret
+// in the namespace. It returns nil when any secret may matter: with
+// discovery, patterns, several watched secrets, cluster-wide informers, or
+// mappings that can appear at run time.
+func (w *Watcher) secretScope(namespace string) func(*metav1.ListOptions) {
+	name, selector := w.scopeSelectors(namespace)
+	switch {
+	case name != "":
+		fmt.Printf("Caching only secret %s in namespace %s\n", name, namespace)
+		fieldSelector := fields.OneTermEqualSelector("metadata.name", name).String()
+		return func(options *metav1.ListOptions) {
+			options.FieldSelector = fieldSelector
+		}
+	case selector != "":
+		fmt.Printf("Caching only secrets matching %s in namespace %s\n", selector, namespace)
+		return func(options *metav1.ListOptions) {
+			options.LabelSelector = selector
+		}
+	}
+	return nil
+}
+
+// scopeSelectors returns the only secret name, or the only label selector,
+// that the mappings of namespace watch, if secretScope can scope the
+// informer to it.
+func (w *Watcher) scopeSelectors(namespace string) (name, selector string) {
+	if !w.ScopeSecrets || namespace == metav1.NamespaceAll || w.discovery != "" {
+		return "", ""
+	}
+
+	names := map[string]bool{}
+	selectors := map[string]bool{}
+	for _, m := range w.currentMappings() {
+		if m.Namespace != namespace || m.External() || m.ConfigMap != "" || m.Files != "" {
+			continue
+		}
+		switch {
+		case m.SecretSelector != "":
+			selectors[m.SecretSelector] = true
+		case isRegexPattern(m.Secret) || strings.ContainsAny(m.Secret, "*?["):
+			return "", ""
+		default:
+			names[m.Secret] = true
+		}
+	}
+
+	switch {
+	case len(names) == 1 && len(selectors) == 0:
+		for name := range names {
+			return name, ""
+		}
+	case len(selectors) == 1 && len(names) == 0:
+		for selector := range selectors {
+			return "", selector
+		}
+	}
+	return "", ""
+}
+
+// watchesConfigMaps reports whether any mapping in namespace watches a
+// ConfigMap, so the ConfigMap cache is only built when it is needed.
+func (w *Watcher) watchesConfigMaps(namespace string) bool {
+	for _, m := range w.currentMappings() {
+		if (namespace == metav1.NamespaceAll || m.Namespace == namespace) && m.ConfigMap != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// configMapTargetsFor returns one mapping per workload that should be
+// restarted because configMap changed.
+func (w *Watcher) configMapTargetsFor(configMap *corev1.ConfigMap) []Mapping {
+	var targets []Mapping
+	seen := map[string]bool{}
+	for _, m := range w.currentMappings() {
+		if m.Namespace == configMap.Namespace && m.ConfigMap != "" && MatchName(m.ConfigMap, configMap.Name) && !seen[m.targetKey()] {
+			seen[m.targetKey()] = true
+			m.ConfigMap = configMap.Name
+			targets = append(targets, m)
+		}
+	}
+	return targets
+}
+
+// targetsFor returns one mapping per workload that should be restarted
+// because secret changed, combining static mappings with ones discovered
+// through the namespace's deployment lister. Workloads are told apart by
+// targetKey, as the restart queue does.
+func (w *Watcher) targetsFor(secret *corev1.Secret, deployments appslisters.DeploymentLister) []Mapping {
+	var targets []Mapping
+	seen := map[string]bool{}
+	for _, m := range w.currentMappings() {
+		if m.Namespace == secret.Namespace && m.MatchesSecret(secret) && !seen[m.targetKey()] {
+			seen[m.targetKey()] = true
+			// Selector and pattern mappings report the secret that
+			// actually changed.
+			m.Secret = secret.Name
+			m.SecretSelector = ""
+			targets = append(targets, m)
+		}
+	}
+
+	discovered := func(kind, name string) {
+		m := Mapping{
+			Namespace:  secret.Namespace,
+			Secret:     secret.Name,
+			Kind:       kind,
+			Deployment: name,
+			Delay:      w.defaults.Delay,
+			Keys:       w.defaults.Keys,
+			Windows:    w.defaults.Windows,
+			Strategy:   w.defaults.Strategy,
+			Policy:     w.defaults.Policy,
+		}
+		if !seen[m.targetKey()] {
+			seen[m.targetKey()] = true
+			targets = append(targets, m)
+		}
+	}
+	for _, name := range w.discover(secret, deployments) {
+		discovered(restarter.KindDeployment, name)
+	}
+	if w.discovery != "" && w.DiscoverKnative {
+		for _, name := range w.discoverKnativeServices(secret) {
+			discovered(restarter.KindKnativeService, name)
+		}
+	}
+	return targets
+}
@@ -0,0 +1,216 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+// newTestWatcher returns a Watcher of mappings backed by a fake clientset
+// holding objects. Rollouts are not awaited, since nothing rolls the fake
+// workloads.
+func newTestWatcher(mappings []Mapping, objects ...runtime.Object) (*Watcher, kubernetes.Interface) {
+	clientset := fake.NewSimpleClientset(objects...)
+	r := restarter.New(clientset, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), record.NewFakeRecorder(100))
+	w := New(clientset, r, mappings, "", Mapping{}, make(chan struct{}))
+	w.Recorder = record.NewFakeRecorder(100)
+	w.RolloutTimeout = 0
+	return w, clientset
+}
+
+func secret(namespace, name string, data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}, Data: data}
+}
+
+func TestTargetsFor(t *testing.T) {
+	w, _ := newTestWatcher([]Mapping{
+		{Namespace: "default", Secret: "tls", Kind: restarter.KindDeployment, Deployment: "web"},
+		{Namespace: "default", Secret: "tls-*", Kind: restarter.KindDeployment, Deployment: "web"},
+		{Namespace: "default", Secret: "tls", Kind: restarter.KindStatefulSet, Deployment: "web"},
+		{Namespace: "default", Secret: "other", Kind: restarter.KindDeployment, Deployment: "api"},
+		{Namespace: "staging", Secret: "tls", Kind: restarter.KindDeployment, Deployment: "web"},
+	})
+
+	targets := w.targetsFor(secret("default", "tls", nil), nil)
+	var keys []string
+	for _, m := range targets {
+		keys = append(keys, m.targetKey())
+	}
+	want := []string{"default/Deployment/web", "default/StatefulSet/web"}
+	if len(keys) != len(want) {
+		t.Fatalf("targets = %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Errorf("targets = %v, want %v", keys, want)
+		}
+	}
+}
+
+func TestTargetsForSelector(t *testing.T) {
+	w, _ := newTestWatcher([]Mapping{
+		{Namespace: "default", Secret: "tls-*", Kind: restarter.KindDeployment, Deployment: "web"},
+	})
+
+	targets := w.targetsFor(secret("default", "tls-web", nil), nil)
+	if len(targets) != 1 {
+		t.Fatalf("got %d targets, want 1", len(targets))
+	}
+	if targets[0].Secret != "tls-web" {
+		t.Errorf("Secret = %q, want the secret that changed", targets[0].Secret)
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	ctx := context.Background()
+	w, clientset := newTestWatcher(
+		[]Mapping{{Namespace: "default", Secret: "tls", Kind: restarter.KindDeployment, Deployment: "web"}},
+		secret("default", "tls", map[string][]byte{"tls.crt": []byte("one")}),
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			// A finished rollout, so that the restart is not deferred.
+			Status: appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1},
+		},
+	)
+	store := &StateStore{Clientset: clientset, Namespace: "default", Name: "cert-watcher-state"}
+	restartedAt := func() string {
+		t.Helper()
+		d, err := clientset.AppsV1().Deployments("default").Get(ctx, "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Spec.Template.Annotations[restarter.RestartedAtAnnotation]
+	}
+
+	// The first run only records the secret.
+	if err := w.RunOnce(ctx, store); err != nil {
+		t.Fatalf("first RunOnce: %v", err)
+	}
+	if got := restartedAt(); got != "" {
+		t.Fatalf("first run restarted web at %q", got)
+	}
+	hashes := map[string]string{}
+	if err := store.Load(ctx, stateHashes, &hashes); err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 {
+		t.Fatalf("recorded hashes = %v, want one", hashes)
+	}
+
+	// An unchanged secret restarts nothing.
+	if err := w.RunOnce(ctx, store); err != nil {
+		t.Fatalf("second RunOnce: %v", err)
+	}
+	if got := restartedAt(); got != "" {
+		t.Fatalf("unchanged secret restarted web at %q", got)
+	}
+
+	if _, err := clientset.CoreV1().Secrets("default").Update(ctx, secret("default", "tls", map[string][]byte{"tls.crt": []byte("two")}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RunOnce(ctx, store); err != nil {
+		t.Fatalf("third RunOnce: %v", err)
+	}
+	if restartedAt() == "" {
+		t.Fatal("changed secret did not restart web")
+	}
+	before := hashes
+	hashes = map[string]string{}
+	if err := store.Load(ctx, stateHashes, &hashes); err != nil {
+		t.Fatal(err)
+	}
+	for key, hash := range hashes {
+		if before[key] == hash {
+			t.Errorf("hash of %s was not updated after the restart", key)
+		}
+	}
+}
+
+func TestRunOncePaused(t *testing.T) {
+	ctx := context.Background()
+	w, clientset := newTestWatcher(
+		[]Mapping{{Namespace: "default", Secret: "tls", Kind: restarter.KindDeployment, Deployment: "web"}},
+		secret("default", "tls", map[string][]byte{"tls.crt": []byte("one")}),
+	)
+	store := &StateStore{Clientset: clientset, Namespace: "default", Name: "cert-watcher-state"}
+	w.SetGlobalPause("test", true)
+
+	if err := w.RunOnce(ctx, store); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	hashes := map[string]string{}
+	if err := store.Load(ctx, stateHashes, &hashes); err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 0 {
+		t.Errorf("paused run recorded %v", hashes)
+	}
+}
+
+func TestRestartRetries(t *testing.T) {
+	m := Mapping{Namespace: "default", Secret: "tls", Kind: restarter.KindDeployment, Deployment: "web", Delay: &metav1.Duration{}, fixedDelay: true}
+	w, clientset := newTestWatcher([]Mapping{m}, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Status:     appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1},
+	})
+	defer w.cancel()
+	w.Retry = RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Factor: 1, MaxAttempts: 3}
+	failing := true
+	attempts := 0
+	clientset.(*fake.Clientset).PrependReactor("patch", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		attempts++
+		if failing {
+			return true, nil, errors.New("API server unavailable")
+		}
+		return false, nil, nil
+	})
+	key := m.targetKey()
+
+	w.Trigger(nil, []Mapping{m})
+	for i := 0; i < w.Retry.MaxAttempts; i++ {
+		w.processNext()
+	}
+	if attempts != w.Retry.MaxAttempts {
+		t.Fatalf("restart attempted %d times, want %d", attempts, w.Retry.MaxAttempts)
+	}
+	letters := w.deadLetterList()
+	if len(letters) != 1 || letters[0].Attempts != w.Retry.MaxAttempts {
+		t.Fatalf("dead letters = %v, want the restart parked after %d attempts", letters, w.Retry.MaxAttempts)
+	}
+	if _, ok := w.pending[key]; ok {
+		t.Fatal("parked restart is still pending")
+	}
+	if w.queue.NumRequeues(key) != 0 {
+		t.Errorf("parked restart has %d requeues, want a fresh set of attempts", w.queue.NumRequeues(key))
+	}
+
+	// A newer change schedules another restart in place of the parked one.
+	failing = false
+	w.Trigger(nil, []Mapping{m})
+	if letters := w.deadLetterList(); len(letters) != 0 {
+		t.Fatalf("dead letters = %v after a newer change, want none", letters)
+	}
+	if _, ok := w.pending[key]; !ok {
+		t.Fatal("newer change did not schedule a restart")
+	}
+	w.processNext()
+	if attempts != w.Retry.MaxAttempts+1 {
+		t.Errorf("restart attempted %d times, want %d", attempts, w.Retry.MaxAttempts+1)
+	}
+	if _, ok := w.pending[key]; ok || len(w.deadLetterList()) != 0 {
+		t.Error("successful restart left a pending restart or dead letter behind")
+	}
+}
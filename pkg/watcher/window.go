@@ -0,0 +1,136 @@
+package watcher
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// restartWindow is a daily time range, optionally limited to some days of
+// the week, during which restarts may run. A range whose end is before its
+// start runs past midnight into the next day.
+type restartWindow struct {
+	days       [7]bool
+	start, end time.Duration
+}
+
+// RestartWindows allows restarts whenever any of its windows is open. An
+// empty list allows them at any time.
+type RestartWindows []restartWindow
+
+// ParseWindows parses windows such as "02:00-04:00" or "Mon-Fri 22:00-06:00",
+// interpreted in the local time zone.
+func ParseWindows(specs []string) (RestartWindows, error) {
+	var windows RestartWindows
+	for _, spec := range specs {
+		window, err := parseWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+func parseWindow(spec string) (restartWindow, error) {
+	var window restartWindow
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return window, fmt.Errorf("restart window %q: expected [days] HH:MM-HH:MM", spec)
+	}
+
+	if len(fields) == 1 {
+		for day := range window.days {
+			window.days[day] = true
+		}
+	} else {
+		first, last, isRange := strings.Cut(strings.ToLower(fields[0]), "-")
+		if !isRange {
+			last = first
+		}
+		from, ok := weekdays[first]
+		to, ok2 := weekdays[last]
+		if !ok || !ok2 {
+			return window, fmt.Errorf("restart window %q: unknown days %q", spec, fields[0])
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			window.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	times := fields[len(fields)-1]
+	start, end, ok := strings.Cut(times, "-")
+	if !ok {
+		return window, fmt.Errorf("restart window %q: expected a HH:MM-HH:MM range", spec)
+	}
+	var err error
+	if window.start, err = parseClock(start); err != nil {
+		return window, fmt.Errorf("restart window %q: %w", spec, err)
+	}
+	if window.end, err = parseClock(end); err != nil {
+		return window, fmt.Errorf("restart window %q: %w", spec, err)
+	}
+	if window.start == window.end {
+		return window, fmt.Errorf("restart window %q: empty range", spec)
+	}
+	return window, nil
+}
+
+// parseClock parses HH:MM into the time since midnight. 24:00 is accepted as
+// the end of the day.
+func parseClock(clock string) (time.Duration, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &hours, &minutes); err != nil || len(clock) != 5 {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// next returns t if a window is open at t, and otherwise the time the next
+// window opens.
+func (ws RestartWindows) next(t time.Time) time.Time {
+	if len(ws) == 0 {
+		return t
+	}
+
+	var earliest time.Time
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	// A window opened yesterday may still be open; otherwise one opens
+	// within the coming week.
+	for offset := -1; offset <= 7; offset++ {
+		day := midnight.AddDate(0, 0, offset)
+		for _, w := range ws {
+			if !w.days[day.Weekday()] {
+				continue
+			}
+			start := day.Add(w.start)
+			end := day.Add(w.end)
+			if w.end < w.start {
+				end = end.AddDate(0, 0, 1)
+			}
+			if !t.Before(start) && t.Before(end) {
+				return t
+			}
+			if start.After(t) && (earliest.IsZero() || start.Before(earliest)) {
+				earliest = start
+			}
+		}
+	}
+	return earliest
+}
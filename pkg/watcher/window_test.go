@@ -0,0 +1,94 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindows(t *testing.T) {
+	for _, test := range []struct {
+		spec  string
+		valid bool
+	}{
+		{"02:00-04:00", true},
+		{"22:00-06:00", true},
+		{"00:00-24:00", true},
+		{"Mon-Fri 22:00-06:00", true},
+		{"sat 10:00-12:00", true},
+		{"Fri-Mon 01:00-02:00", true},
+		{"", false},
+		{"Mon Tue 02:00-04:00", false},
+		{"Mon,Wed 02:00-04:00", false},
+		{"Someday 02:00-04:00", false},
+		{"02:00", false},
+		{"2:00-4:00", false},
+		{"02:00-24:30", false},
+		{"02:60-04:00", false},
+		{"25:00-04:00", false},
+		{"02:00-02:00", false},
+	} {
+		_, err := ParseWindows([]string{test.spec})
+		if test.valid && err != nil {
+			t.Errorf("ParseWindows(%q): %v", test.spec, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("ParseWindows(%q) succeeded, want an error", test.spec)
+		}
+	}
+}
+
+func TestRestartWindowsNext(t *testing.T) {
+	// 2024-05-01 is a Wednesday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.May, day, hour, minute, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		name    string
+		windows []string
+		t       time.Time
+		want    time.Time
+	}{
+		{"no windows", nil, at(1, 12, 0), at(1, 12, 0)},
+		{"inside", []string{"02:00-04:00"}, at(1, 3, 0), at(1, 3, 0)},
+		{"at the start", []string{"02:00-04:00"}, at(1, 2, 0), at(1, 2, 0)},
+		{"at the end", []string{"02:00-04:00"}, at(1, 4, 0), at(2, 2, 0)},
+		{"before, same day", []string{"02:00-04:00"}, at(1, 1, 0), at(1, 2, 0)},
+		{"after, next day", []string{"02:00-04:00"}, at(1, 5, 0), at(2, 2, 0)},
+		{"past midnight, before it", []string{"22:00-06:00"}, at(1, 23, 0), at(1, 23, 0)},
+		{"past midnight, after it", []string{"22:00-06:00"}, at(2, 5, 0), at(2, 5, 0)},
+		{"past midnight, closed", []string{"22:00-06:00"}, at(1, 12, 0), at(1, 22, 0)},
+		{"weekdays, on a weekday", []string{"Mon-Fri 09:00-17:00"}, at(1, 10, 0), at(1, 10, 0)},
+		{"weekdays, on Saturday", []string{"Mon-Fri 09:00-17:00"}, at(4, 10, 0), at(6, 9, 0)},
+		{"Friday night runs into Saturday", []string{"Mon-Fri 22:00-06:00"}, at(4, 3, 0), at(4, 3, 0)},
+		{"no Saturday night", []string{"Mon-Fri 22:00-06:00"}, at(4, 23, 0), at(6, 22, 0)},
+		{"wrapping day range", []string{"Sat-Mon 01:00-02:00"}, at(1, 12, 0), at(4, 1, 0)},
+		{"single day", []string{"Wed 01:00-02:00"}, at(1, 3, 0), at(8, 1, 0)},
+		{"earliest of several", []string{"Fri 01:00-02:00", "Thu 05:00-06:00"}, at(1, 12, 0), at(2, 5, 0)},
+		{"any of several open", []string{"01:00-02:00", "11:00-13:00"}, at(1, 12, 0), at(1, 12, 0)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			windows, err := ParseWindows(test.windows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := windows.next(test.t); !got.Equal(test.want) {
+				t.Errorf("next(%s) = %s, want %s", test.t, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRestartWindowsNextTimezone(t *testing.T) {
+	windows, err := ParseWindows([]string{"02:00-04:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Windows are read in the location of the time they are asked about:
+	// 23:00 UTC is 01:00 in UTC+2, an hour before the window opens there.
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	now := time.Date(2024, time.May, 1, 23, 0, 0, 0, time.UTC).In(zone)
+	want := time.Date(2024, time.May, 2, 2, 0, 0, 0, zone)
+	if got := windows.next(now); !got.Equal(want) {
+		t.Errorf("next(%s) = %s, want %s", now, got, want)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof exposes the net/http/pprof handlers on their own listener so
+// profiling never shares a port with metrics.
+func servePprof(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	fmt.Printf("Serving pprof on %s\n", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		fmt.Printf("pprof server failed: %v\n", err)
+	}
+}
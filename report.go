@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+	"github.com/andreistefanzx/cert-watcher/pkg/watcher"
+)
+
+// reportPageSize is how many secrets the report lists per API request.
+const reportPageSize = 500
+
+// reportEntry is one TLS secret in the report. Error says why its tls.crt
+// could not be parsed.
+type reportEntry struct {
+	Namespace   string                  `json:"namespace"`
+	Name        string                  `json:"name"`
+	Certificate *notify.CertificateInfo `json:"certificate,omitempty"`
+	Error       string                  `json:"error,omitempty"`
+}
+
+// newReportCommand returns the report command, which lists the certificates
+// of every kubernetes.io/tls secret in the cluster, or in one namespace,
+// whether or not anything watches them.
+func newReportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "List the certificates of all TLS secrets",
+		Args:  cobra.NoArgs,
+	}
+	flags := cmd.Flags()
+	namespace := flags.String("namespace", "", "Only list secrets in this namespace; lists all namespaces when empty")
+	expiringWithin := flags.Duration("expiring-within", 0, "Only list certificates that expire within this duration, or could not be parsed")
+	output := flags.String("output", "table", "Output format; one of: table, json, csv")
+	insideCluster := flags.Bool("inside-cluster", false, "Run from inside the cluster")
+	kubeconfig := flags.String("kubeconfig", "", "Path to a kubeconfig file; defaults to $KUBECONFIG or $HOME/.kube/config")
+	kubeContext := flags.String("context", "", "Kubeconfig context to use; defaults to the current context")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *output != "table" && *output != "json" && *output != "csv" {
+			fmt.Printf("unknown output format %q\n", *output)
+			os.Exit(1)
+		}
+		clientset, err := newClientset(*insideCluster, *kubeconfig, *kubeContext)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		entries, err := tlsInventory(context.Background(), clientset, *namespace)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *expiringWithin > 0 {
+			entries = expiringEntries(entries, *expiringWithin)
+		}
+
+		switch *output {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(entries)
+		case "csv":
+			err = writeReportCSV(os.Stdout, entries)
+		default:
+			err = writeReportTable(os.Stdout, entries)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	return cmd
+}
+
+// tlsInventory lists the kubernetes.io/tls secrets in namespace, or in all
+// Namespaces when it is empty, a page at a time, sorted by namespace and
+// name.
+func tlsInventory(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]reportEntry, error) {
+	entries := []reportEntry{}
+	opts := metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("type", string(corev1.SecretTypeTLS)).String(),
+		Limit:         reportPageSize,
+	}
+	for {
+		list, err := clientset.CoreV1().Secrets(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("listing secrets: %w", err)
+		}
+		for _, secret := range list.Items {
+			entry := reportEntry{Namespace: secret.Namespace, Name: secret.Name}
+			if cert, err := watcher.ParseCertificate(secret.Data[corev1.TLSCertKey]); err != nil {
+				entry.Error = err.Error()
+			} else {
+				entry.Certificate = notify.NewCertificateInfo(cert)
+			}
+			entries = append(entries, entry)
+		}
+		if list.Continue == "" {
+			break
+		}
+		opts.Continue = list.Continue
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Namespace != entries[j].Namespace {
+			return entries[i].Namespace < entries[j].Namespace
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// expiringEntries returns the entries whose certificate expires within d,
+// along with those that have none.
+func expiringEntries(entries []reportEntry, d time.Duration) []reportEntry {
+	expiring := []reportEntry{}
+	for _, e := range entries {
+		if e.Certificate == nil || time.Until(e.Certificate.NotAfter) < d {
+			expiring = append(expiring, e)
+		}
+	}
+	return expiring
+}
+
+func writeReportTable(out io.Writer, entries []reportEntry) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tNAME\tSUBJECT\tSANS\tISSUER\tNOT AFTER\tEXPIRES IN")
+	for _, e := range entries {
+		c := e.Certificate
+		if c == nil {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\t-\t-\n", e.Namespace, e.Name, e.Error)
+			continue
+		}
+		expiresIn := "expired"
+		if remaining := time.Until(c.NotAfter); remaining > 0 {
+			expiresIn = remaining.Round(time.Minute).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Namespace, e.Name, c.Subject, strings.Join(c.SANs(), ","), c.Issuer, c.NotAfter.Local().Format(time.RFC3339), expiresIn)
+	}
+	return tw.Flush()
+}
+
+// writeReportCSV writes one row per entry, with the SANs of each kind
+// separated by semicolons.
+func writeReportCSV(out io.Writer, entries []reportEntry) error {
+	cw := csv.NewWriter(out)
+	_ = cw.Write([]string{"namespace", "name", "subject", "commonName", "dnsNames", "ipAddresses", "emailAddresses", "issuer", "serialNumber", "notBefore", "notAfter", "error"})
+	for _, e := range entries {
+		row := []string{e.Namespace, e.Name, "", "", "", "", "", "", "", "", "", e.Error}
+		if c := e.Certificate; c != nil {
+			row = []string{
+				e.Namespace,
+				e.Name,
+				c.Subject,
+				c.CommonName,
+				strings.Join(c.DNSNames, ";"),
+				strings.Join(c.IPAddresses, ";"),
+				strings.Join(c.EmailAddresses, ";"),
+				c.Issuer,
+				c.SerialNumber,
+				c.NotBefore.Format(time.RFC3339),
+				c.NotAfter.Format(time.RFC3339),
+				"",
+			}
+		}
+		_ = cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
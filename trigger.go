@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/notify"
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+)
+
+// newTriggerCommand returns the trigger command, which restarts one
+// workload on demand: through the admin API of a running watcher, so that
+// its cooldowns, windows and pauses apply, or directly with a strategy.
+func newTriggerCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "trigger",
+		Short: "Restart a workload now",
+		Args:  cobra.NoArgs,
+	}
+	flags := cmd.Flags()
+	name := flags.String("name", "", "Name of the workload to restart")
+	kind := flags.String("kind", restarter.KindDeployment, "Kind of the workload; one of: Deployment, StatefulSet, DaemonSet, Rollout, DeploymentConfig")
+	namespace := flags.String("namespace", "default", "Namespace of the workload")
+	adminURL := flags.String("admin-url", "", "URL of a watcher's admin API to schedule the restart through, e.g. http://localhost:8081; restarts directly when empty")
+	tokenFile := flags.String("token-file", "", "File holding the bearer token for -admin-url")
+	restartStrategy := flags.String("restart-strategy", restarter.StrategyAnnotation, "How to restart the workload directly; one of: annotation, delete-pods, evict-pods, scale")
+	wait := flags.Duration("wait", 0, "Wait this long for the rollout of a direct restart to finish; 0 does not wait")
+	insideCluster := flags.Bool("inside-cluster", false, "Run from inside the cluster")
+	kubeconfig := flags.String("kubeconfig", "", "Path to a kubeconfig file; defaults to $KUBECONFIG or $HOME/.kube/config")
+	kubeContext := flags.String("context", "", "Kubeconfig context to use; defaults to the current context")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *name == "" {
+			fmt.Println("name is required")
+			os.Exit(1)
+		}
+		var err error
+		if *adminURL != "" {
+			err = triggerThroughAdmin(*adminURL, *tokenFile, *namespace, *kind, *name)
+		} else {
+			err = triggerDirectly(*insideCluster, *kubeconfig, *kubeContext, *namespace, *kind, *name, *restartStrategy, *wait)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	return cmd
+}
+
+// triggerThroughAdmin asks the watcher behind adminURL to restart the
+// workload.
+func triggerThroughAdmin(adminURL, tokenFile, namespace, kind, name string) error {
+	path := fmt.Sprintf("/api/v1/targets/%s/%s/%s/restart", url.PathEscape(namespace), url.PathEscape(kind), url.PathEscape(name))
+	req, err := adminRequest(http.MethodPost, adminURL, tokenFile, path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := notify.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("admin API returned %s", resp.Status)
+	}
+	fmt.Printf("Restart of %s %s %s scheduled\n", namespace, kind, name)
+	return nil
+}
+
+// triggerDirectly restarts the workload with strategy and waits up to wait
+// for its rollout.
+func triggerDirectly(insideCluster bool, kubeconfig, kubeContext, namespace, kind, name, strategy string, wait time.Duration) error {
+	if !restarter.ValidKind(kind) {
+		return fmt.Errorf("unknown workload kind %q", kind)
+	}
+	// The other strategies need the changed source.
+	switch strategy {
+	case restarter.StrategyAnnotation, restarter.StrategyDeletePods, restarter.StrategyEvictPods, restarter.StrategyScale:
+	default:
+		return fmt.Errorf("trigger cannot use restart strategy %q", strategy)
+	}
+	config, err := buildConfig(insideCluster, kubeconfig, kubeContext)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	r := restarter.New(clientset, dynamicClient, restarter.NewEventRecorder(clientset))
+	r.Config = config
+
+	ctx := context.Background()
+	started := time.Now()
+	if err := r.Restart(ctx, namespace, "", kind, name, strategy, ""); err != nil {
+		return err
+	}
+	if wait <= 0 {
+		return nil
+	}
+	return r.WaitForRollout(ctx, namespace, kind, name, started, wait)
+}
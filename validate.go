@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/restarter"
+	"github.com/andreistefanzx/cert-watcher/pkg/watcher"
+)
+
+// newValidateCommand returns the validate command, which checks a config
+// file the way watch does at startup, and optionally that the secrets,
+// ConfigMaps and workloads it names exist, and exits non-zero on any
+// problem, for CI pipelines.
+func newValidateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate a config file",
+		Args:  cobra.NoArgs,
+	}
+	flags := cmd.Flags()
+	configFile := flags.String("config", "", "Path to the config file to validate")
+	namespace := flags.String("namespace", "default", "Namespace of mappings that do not set one")
+	workloadKind := flags.String("workload-kind", restarter.KindDeployment, "Kind of mappings that do not set one")
+	verifyCluster := flags.Bool("verify-cluster", false, "Also check that the sources and workloads of the mappings exist in the cluster")
+	insideCluster := flags.Bool("inside-cluster", false, "Run from inside the cluster")
+	kubeconfig := flags.String("kubeconfig", "", "Path to a kubeconfig file; defaults to $KUBECONFIG or $HOME/.kube/config")
+	kubeContext := flags.String("context", "", "Kubeconfig context to use; defaults to the current context")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *configFile == "" {
+			fmt.Println("config is required")
+			os.Exit(1)
+		}
+		config, err := watcher.LoadConfig(*configFile, watcher.Mapping{Namespace: *namespace, Kind: *workloadKind, Delay: &metav1.Duration{Duration: defaultDelay}})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *verifyCluster {
+			restConfig, err := buildConfig(*insideCluster, *kubeconfig, *kubeContext)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			clientset, err := kubernetes.NewForConfig(restConfig)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			dynamicClient, err := dynamic.NewForConfig(restConfig)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			r := restarter.New(clientset, dynamicClient, nil)
+			if err := verifyMappings(context.Background(), clientset, r, config.Mappings); err != nil {
+				fmt.Printf("%s does not match the cluster:\n%v\n", *configFile, err)
+				os.Exit(1)
+			}
+		}
+		fmt.Printf("%s is valid: %d mappings\n", *configFile, len(config.Mappings))
+	}
+	return cmd
+}
+
+// verifyMappings checks that the source and workload of every mapping exist,
+// and reports all that are missing. Patterns and selectors must match at
+// least one object; external sources are not checked.
+func verifyMappings(ctx context.Context, clientset kubernetes.Interface, r *restarter.Restarter, mappings []watcher.Mapping) error {
+	var errs []error
+	for i, m := range mappings {
+		if err := verifySource(ctx, clientset, m); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %d: %w", i, err))
+		}
+		if m.Kind == restarter.KindJob {
+			continue
+		}
+		if _, err := r.Workload(ctx, m.Namespace, m.Kind, m.Deployment); err != nil {
+			if apierrors.IsNotFound(err) {
+				err = fmt.Errorf("%s %s/%s not found", m.Kind, m.Namespace, m.Deployment)
+			}
+			errs = append(errs, fmt.Errorf("mapping %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func verifySource(ctx context.Context, clientset kubernetes.Interface, m watcher.Mapping) error {
+	switch {
+	case m.External():
+		return nil
+	case m.ConfigMap != "":
+		list, err := clientset.CoreV1().ConfigMaps(m.Namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, configMap := range list.Items {
+			if watcher.MatchName(m.ConfigMap, configMap.Name) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no ConfigMap in %s matches %s", m.Namespace, m.ConfigMap)
+	}
+	secrets, err := checkedSecrets(ctx, clientset, []watcher.Mapping{m})
+	if err != nil {
+		return err
+	}
+	if len(secrets) == 0 {
+		return fmt.Errorf("no secret in %s matches %s%s", m.Namespace, m.Secret, m.SecretSelector)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/spf13/cobra"
+
+	"github.com/andreistefanzx/cert-watcher/pkg/metrics"
+)
+
+// Build information, set with -ldflags "-X main.version=... -X
+// main.commit=... -X main.date=..."; see the Makefile.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+func init() {
+	// go build records the commit of a build from a git checkout, which
+	// covers builds without the ldflags.
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			}
+		}
+	}
+	metrics.BuildInfo.WithLabelValues(version, commit, date, runtime.Version()).Set(1)
+}
+
+func newVersionCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Print the version, commit and build date of cert-watcher",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("cert-watcher %s\n", version)
+			fmt.Printf("commit: %s\n", valueOr(commit, "unknown"))
+			fmt.Printf("built: %s\n", valueOr(date, "unknown"))
+			fmt.Printf("go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		},
+	}
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}